@@ -0,0 +1,179 @@
+/*
+ * Copyright 2016 DGraph Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+var githubGraphqlUrl = "https://api.github.com/graphql"
+
+// githubForum creates and searches for discussions in a GitHub repository.
+// Categories are the names of the discussion categories. Tags aren't added
+// to the discussions.
+type githubForum struct {
+	token string
+	// Repository as owner/name.
+	repo string
+}
+
+type graphqlError struct {
+	Message string `json:"message"`
+}
+
+// query runs the GraphQL query with vars against the GitHub API and decodes
+// the data in the response into data.
+func (g *githubForum) query(q string, vars map[string]interface{},
+	data interface{}) error {
+	req := map[string]interface{}{"query": q, "variables": vars}
+	var res struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []graphqlError  `json:"errors"`
+	}
+	if err := jsonRequest("POST", githubGraphqlUrl, g.token, req,
+		&res); err != nil {
+		return err
+	}
+	if len(res.Errors) > 0 {
+		return fmt.Errorf("GitHub returned error: %s", res.Errors[0].Message)
+	}
+	return json.Unmarshal(res.Data, data)
+}
+
+const githubRepoQuery = `query($owner: String!, $name: String!) {
+  repository(owner: $owner, name: $name) {
+    id
+    discussionCategories(first: 100) { nodes { id name } }
+  }
+}`
+
+const githubCreateDiscussion = `mutation($input: CreateDiscussionInput!) {
+  createDiscussion(input: $input) { discussion { url } }
+}`
+
+func (g *githubForum) CreateTopic(t Topic) (string, error) {
+	parts := strings.SplitN(g.repo, "/", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Invalid github repo %q", g.repo)
+	}
+	var rd struct {
+		Repository struct {
+			Id                   string `json:"id"`
+			DiscussionCategories struct {
+				Nodes []struct {
+					Id   string `json:"id"`
+					Name string `json:"name"`
+				} `json:"nodes"`
+			} `json:"discussionCategories"`
+		} `json:"repository"`
+	}
+	if err := g.query(githubRepoQuery, map[string]interface{}{
+		"owner": parts[0], "name": parts[1]}, &rd); err != nil {
+		return "", err
+	}
+	categoryId := ""
+	for _, n := range rd.Repository.DiscussionCategories.Nodes {
+		if strings.EqualFold(n.Name, t.Category) {
+			categoryId = n.Id
+			break
+		}
+	}
+	if categoryId == "" {
+		return "", fmt.Errorf("Category %s doesn't exist in %s.", t.Category,
+			g.repo)
+	}
+
+	var cd struct {
+		CreateDiscussion struct {
+			Discussion struct {
+				Url string `json:"url"`
+			} `json:"discussion"`
+		} `json:"createDiscussion"`
+	}
+	input := map[string]string{"repositoryId": rd.Repository.Id,
+		"categoryId": categoryId, "title": t.Title, "body": t.Raw}
+	if err := g.query(githubCreateDiscussion, map[string]interface{}{
+		"input": input}, &cd); err != nil {
+		return "", err
+	}
+	return cd.CreateDiscussion.Discussion.Url, nil
+}
+
+const githubSearchQuery = `query($q: String!) {
+  search(query: $q, type: DISCUSSION, first: 50) {
+    nodes {
+      ... on Discussion {
+        title
+        url
+        upvoteCount
+        comments { totalCount }
+        category { name }
+      }
+    }
+  }
+}`
+
+// GitHub doesn't count views, so they are ordered by relevance instead.
+var githubSearchSort = map[string]string{
+	"latest": " sort:created-desc",
+	"likes":  " sort:reactions-+1-desc",
+}
+
+func (g *githubForum) Search(query string, order string,
+	categories []string) ([]SearchResult, error) {
+	var sd struct {
+		Search struct {
+			Nodes []struct {
+				Title       string `json:"title"`
+				Url         string `json:"url"`
+				UpvoteCount int    `json:"upvoteCount"`
+				Comments    struct {
+					TotalCount int `json:"totalCount"`
+				} `json:"comments"`
+				Category struct {
+					Name string `json:"name"`
+				} `json:"category"`
+			} `json:"nodes"`
+		} `json:"search"`
+	}
+	q := fmt.Sprintf("repo:%s %s%s", g.repo, query, githubSearchSort[order])
+	if err := g.query(githubSearchQuery, map[string]interface{}{"q": q},
+		&sd); err != nil {
+		return nil, err
+	}
+
+	var res []SearchResult
+	for _, n := range sd.Search.Nodes {
+		keep := len(categories) == 0
+		for _, cat := range categories {
+			if strings.EqualFold(n.Category.Name, cat) {
+				keep = true
+				break
+			}
+		}
+		if !keep {
+			continue
+		}
+		res = append(res, SearchResult{Title: n.Title, Url: n.Url,
+			Stats: fmt.Sprintf("Upvotes - %d, Comments - %d",
+				n.UpvoteCount, n.Comments.TotalCount)})
+	}
+	return res, nil
+}
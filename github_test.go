@@ -0,0 +1,75 @@
+/*
+ * Copyright 2016 DGraph Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGithubForumCreateTopic(t *testing.T) {
+	var input map[string]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ghtoken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Query     string                     `json:"query"`
+			Variables map[string]json.RawMessage `json:"variables"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if strings.Contains(req.Query, "createDiscussion") {
+			json.Unmarshal(req.Variables["input"], &input)
+			w.Write([]byte(`{"data": {"createDiscussion": {"discussion":
+				{"url": "https://github.com/dgraph-io/wisemonk/discussions/1"}}}}`))
+			return
+		}
+		w.Write([]byte(`{"data": {"repository": {"id": "R1",
+			"discussionCategories": {"nodes": [{"id": "C1", "name": "General"},
+			{"id": "C2", "name": "Slack"}]}}}}`))
+	}))
+	defer ts.Close()
+	old := githubGraphqlUrl
+	githubGraphqlUrl = ts.URL
+	defer func() { githubGraphqlUrl = old }()
+
+	g := &githubForum{token: "ghtoken", repo: "dgraph-io/wisemonk"}
+	u, err := g.CreateTopic(Topic{Title: "Discussion from slack",
+		Raw: "Some messages", Category: "slack"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "https://github.com/dgraph-io/wisemonk/discussions/1" {
+		t.Errorf("Expected url of the discussion, Got: %s", u)
+	}
+	if input["repositoryId"] != "R1" || input["categoryId"] != "C2" ||
+		input["title"] != "Discussion from slack" ||
+		input["body"] != "Some messages" {
+		t.Errorf("Expected discussion to be created in Slack, Got: %v", input)
+	}
+
+	if _, err := g.CreateTopic(Topic{Title: "Discussion from slack",
+		Category: "missing"}); err == nil {
+		t.Errorf("Expected error for a missing category")
+	}
+}
@@ -23,24 +23,38 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/nlopes/slack"
 )
 
 var yoda []byte
 
-const slackPrefix = "https://slack.com/api"
+var slackPrefix = "https://slack.com/api"
+
+const slackWebPrefix = "https://slack.com"
+
+// Message sent to the channel when a call to Discourse fails.
+const errMsg = "Sorry, something went wrong."
+
+// Message sent to the channel when wisemonk finishes meditating.
+const wakeMsg = "I have finished meditating and am back to watching the channel."
 
 // Message to send when number of messages in an interval >= *maxmsg. We send
 // the Go Proverbs so that we learn all of them eventually :P.
@@ -65,631 +79,4727 @@ var proverbs []string = []string{
 	"Documentation is for users.",
 	"Don't panic."}
 
+// Quotes that the alert picks from. These are the Go Proverbs unless quotes
+// are given in the config.
+var quotes = proverbs
+
+// loadQuotes returns the quotes given inline in the config, or read from the
+// quotes file with one quote per line. It falls back to the Go Proverbs.
+func loadQuotes(conf Config) ([]string, error) {
+	if len(conf.Quotes) > 0 {
+		return conf.Quotes, nil
+	}
+	if conf.QuotesFile == "" {
+		return proverbs, nil
+	}
+
+	b, err := ioutil.ReadFile(conf.QuotesFile)
+	if err != nil {
+		return nil, err
+	}
+	var qs []string
+	for _, q := range strings.Split(string(b), "\n") {
+		if q = strings.TrimSpace(q); q != "" {
+			qs = append(qs, q)
+		}
+	}
+	if len(qs) == 0 {
+		return nil, fmt.Errorf("No quotes found in %s", conf.QuotesFile)
+	}
+	return qs, nil
+}
+
+// A message stored in a bucket.
+type BucketMsg struct {
+	// Slack user id of the sender.
+	User string `json:"user"`
+	// Username of the sender, resolved when the message was received.
+	Name      string `json:"name"`
+	Text      string `json:"text"`
+	Timestamp string `json:"ts"`
+}
+
+// String returns the message as it is shown in a discourse topic.
+func (m BucketMsg) String() string {
+	return fmt.Sprintf("%-14s: %s", m.Name, m.Text)
+}
+
 type Bucket struct {
 	// Unix time for the bucket
 	utime int64
+	// Part of the second that the bucket is for, if buckets are smaller
+	// than a second.
+	slot int64
 	// message count
 	count int
-	// Slack RTM library that we are using doesn't give us the username of
-	// the user sending the message, so we store only messages for now.
-	msgs []string
+	msgs  []BucketMsg
 }
 
 type ByTimestamp []Bucket
 
 func (a ByTimestamp) Len() int           { return len(a) }
 func (a ByTimestamp) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a ByTimestamp) Less(i, j int) bool { return a[i].utime < a[j].utime }
+func (a ByTimestamp) Less(i, j int) bool { return a[i].before(a[j]) }
+
+// before returns whether b is for an earlier time than o.
+func (b Bucket) before(o Bucket) bool {
+	return b.utime < o.utime || (b.utime == o.utime && b.slot < o.slot)
+}
+
+// Clock tells the time for a Counter, so that the tests can control it.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is a time.Ticker made by a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the Clock used outside of tests.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
 
 type Counter struct {
 	sync.RWMutex
+	// Set before the counter is used, the real clock if nil.
+	clock Clock
+	// Picks the quotes for the alerts. Seeded with the time when it is
+	// first needed if nil, tests set it to get the same quotes every time.
+	rng *rand.Rand
+	// Sorted by utime and slot, so that expired buckets are always at the
+	// start.
 	buckets []Bucket
 	// Slack channel id for the channel this counter belongs to.
 	ChannelId     string `json:"id"`
 	meditationEnd time.Time
-	messages      chan *slack.Msg
+	// Closed to wake wisemonk up before his meditation ends.
+	wake     chan struct{}
+	messages chan *slack.Msg
+	// Closed to stop the counter once its channel is removed from the config.
+	stop chan struct{}
 
 	// interval duration in minutes.
-	Interval      string   `json:"interval"`
+	Interval string `json:"interval"`
+	// Interval parsed, when the config is loaded.
+	interval      time.Duration
 	MaxMsg        int      `json:"maxmsg"`
 	SearchOver    []string `json:"search_over"`
 	CreateTopicIn string   `json:"create_topic_in"`
+	// Longest duration wisemonk can be asked to meditate for. Defaults to
+	// an hour.
+	MaxMeditation string `json:"max_meditation"`
+	// Tags added to the topics created for this channel, along with
+	// from-slack.
+	TopicTags []string `json:"topic_tags"`
+	// Whether replies in threads should not be counted.
+	IgnoreThreads bool `json:"ignore_threads"`
+	// Whether the alert should be posted as a reply to the last message
+	// instead of in the channel.
+	NudgeInThread bool `json:"nudge_in_thread"`
+	// Timestamp of the last message counted.
+	lastTimestamp string
+	// Time of the latest message counted, zero if there hasn't been one.
+	lastMessage time.Time
+	// Least time between two alerts, even if the count stays above MaxMsg.
+	// Defaults to 5m.
+	NudgeCooldown string `json:"nudge_cooldown"`
+	lastNudge     time.Time
+	// Most messages kept for creating topics. Older messages are dropped
+	// beyond this, but are still counted. Defaults to 1000.
+	MaxBufferedMsgs int `json:"max_buffered_msgs"`
+	// Alerts aren't sent in channels with fewer members than this.
+	MinMembers int `json:"min_members"`
+	// Alerts aren't sent till then, but unlike meditation nothing is
+	// announced when it ends.
+	quietEnd time.Time
+	// Shown in the alert instead of a quote, e.g. to point to another
+	// channel.
+	NudgeMessage string `json:"nudge_message"`
+	// A topic is created with the messages once the channel has been
+	// silent for this long after a discussion. Disabled if empty.
+	SummarizeAfter string `json:"summarize_after"`
+	// Time of the last message that a summary was created for.
+	lastSummarized int64
+	// Messages matching any of these regexes aren't counted, e.g. those
+	// from CI or deploy scripts posting as users.
+	IgnorePatterns []string `json:"ignore_patterns"`
+	ignoreRegexes  []*regexp.Regexp
+	// Set if CreateTopicIn doesn't exist in discourse, so that we don't
+	// keep trying to create topics in it.
+	topicsDisabled bool
+	// Whether the alert is sent as Block Kit blocks, with a button for the
+	// topic. Only works on slack.
+	NudgeBlocks bool `json:"nudge_blocks"`
+	// Either messages, where every message counts once, or weighted, where
+	// long messages count once for every weightedMsgLen characters.
+	// Defaults to messages.
+	CountMode string `json:"count_mode"`
+	// Alerts are only sent between these times of the day, e.g.
+	// "09:00-18:00". The window can cross midnight. Always if empty.
+	ActiveHours string `json:"active_hours"`
+	// Name of the IANA time zone that ActiveHours is in. Defaults to UTC.
+	Timezone string `json:"timezone"`
+	active   *activeWindow
+	// Whether a reaction is added to the latest message as a hint when the
+	// count reaches MaxMsg, with the alert sent only if the channel stays
+	// busy. Only works on slack.
+	ReactionHint bool `json:"reaction_hint"`
+	// Timestamp of the message that the hint was added to, empty if there
+	// is no hint since the last alert.
+	hintTs string
+	// After this many alerts in a row, each within streakCooldowns
+	// cooldowns of the last, the admins are mentioned. Disabled if 0.
+	EscalateAfter int `json:"escalate_after"`
+	// Sent along with the mentions when escalating.
+	EscalationMessage string `json:"escalation_message"`
+	// Alerts sent in a row, and the time of the last one.
+	nudgesInRow int
+	lastInRow   time.Time
+	// How much time a bucket is for. Can be less than a second, e.g.
+	// 100ms, to keep bursts apart. Defaults to 1s.
+	BucketGranularity string `json:"bucket_granularity"`
+	// Messages counted and urls of the topics created since the last
+	// digest.
+	digestMsgs   int
+	digestTopics []string
+	// Whether topics are created and searched for in the forum for this
+	// channel. Defaults to true, the channel is only monitored if false.
+	DiscourseEnabled *bool `json:"discourse_enabled"`
+	// Once this long has passed since an alert and the channel has calmed
+	// down, the alert is tidied up as set by TidyNudge. Disabled if empty.
+	// Only works on slack.
+	TidyNudgeAfter string `json:"tidy_nudge_after"`
+	// Either shorten, to edit the alert down to a line, or delete. Defaults
+	// to shorten.
+	TidyNudge string `json:"tidy_nudge"`
+	// Timestamp, topic and time of the last alert, kept till it is tidied.
+	nudgeTs    string
+	nudgeTopic string
+	nudgedAt   time.Time
+	// Index in quotes of the quote used in the last alert, if quoted is set.
+	lastQuote int
+	quoted    bool
+	// Topics created for the channel, oldest first. At most
+	// maxTopicHistory are kept.
+	topicHistory []TopicRecord
 }
 
-func (c *Counter) MeditationEnd() time.Duration {
-	c.RLock()
-	defer c.RUnlock()
-	return c.meditationEnd.Sub(time.Now())
+// TopicRecord is a topic that wisemonk created for a channel.
+type TopicRecord struct {
+	Title   string    `json:"title"`
+	Url     string    `json:"url"`
+	Created time.Time `json:"created"`
 }
 
-func (c *Counter) SetMeditationEnd(d time.Duration) {
+// Most topics kept in the history of a channel.
+const maxTopicHistory = 50
+
+// recordTopic adds the topic to the history of the channel, dropping the
+// oldest one if the history is full.
+func (c *Counter) recordTopic(title string, url string) {
 	c.Lock()
 	defer c.Unlock()
-	c.meditationEnd = time.Now().Add(d)
+	c.topicHistory = append(c.topicHistory,
+		TopicRecord{Title: title, Url: url, Created: c.now()})
+	if n := len(c.topicHistory); n > maxTopicHistory {
+		c.topicHistory = c.topicHistory[n-maxTopicHistory:]
+	}
+}
+
+// recentTopics returns the last n topics created for the channel, latest
+// first.
+func (c *Counter) recentTopics(n int) []TopicRecord {
+	c.RLock()
+	defer c.RUnlock()
+	var ts []TopicRecord
+	for i := len(c.topicHistory) - 1; i >= 0 && len(ts) < n; i-- {
+		ts = append(ts, c.topicHistory[i])
+	}
+	return ts
 }
 
-var meditateRegex, createRegex, queryCountRegex, queryRegex *regexp.Regexp
+// activeWindow is the part of the day during which alerts are sent, as
+// minutes since midnight in loc.
+type activeWindow struct {
+	start, end int
+	loc        *time.Location
+}
 
-// Gives back the count of messages for the buckets which were created in the
-// interval.
-func (c *Counter) Count() int {
-	sort.Sort(ByTimestamp(c.buckets))
-	interval, err := time.ParseDuration(c.Interval)
+// parseActiveHours parses the active_hours of a channel, in the time zone tz.
+// It returns nil if hours is empty.
+func parseActiveHours(hours, tz string) (*activeWindow, error) {
+	loc, err := time.LoadLocation(tz)
 	if err != nil {
-		log.Fatalf("Got error while parsing duration. %s", err)
+		return nil, err
 	}
-	timeSince := time.Now().Add(-interval).Unix()
-	idx := 0
-	for i, b := range c.buckets {
-		if b.utime > timeSince {
-			idx = i
-			break
+	if hours == "" {
+		return nil, nil
+	}
+	parts := strings.Split(hours, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("expected start-end, got %q", hours)
+	}
+	w := &activeWindow{loc: loc}
+	for i, p := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(p))
+		if err != nil {
+			return nil, err
 		}
+		m := t.Hour()*60 + t.Minute()
+		if i == 0 {
+			w.start = m
+		} else {
+			w.end = m
+		}
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("start and end can't be the same, got %q", hours)
+	}
+	return w, nil
+}
+
+// contains returns whether t is within the window.
+func (w *activeWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	// The window crosses midnight.
+	return m >= w.start || m < w.end
+}
+
+// inActiveHours returns whether alerts can be sent at t.
+func (c *Counter) inActiveHours(t time.Time) bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.active == nil || c.active.contains(t)
+}
+
+const (
+	countMessages = "messages"
+	countWeighted = "weighted"
+	// Length of a message that counts once in the weighted mode.
+	weightedMsgLen = 280
+)
+
+// weight returns how much the message text adds to the count. It should be
+// called with the lock held.
+func (c *Counter) weight(text string) int {
+	if c.CountMode != countWeighted {
+		return 1
 	}
+	w := (utf8.RuneCountInString(text) + weightedMsgLen - 1) / weightedMsgLen
+	if w < 1 {
+		return 1
+	}
+	return w
+}
 
-	// We left shift the elements including the one at index idx to the
-	// start of the bucket
-	if idx > 0 {
-		for i := idx; i < len(c.buckets); i++ {
-			c.buckets[i-idx] = c.buckets[i]
+// compilePatterns compiles the ignore_patterns of a channel.
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
 		}
-		c.buckets = c.buckets[0 : len(c.buckets)-idx]
+		res = append(res, re)
 	}
+	return res, nil
+}
 
-	count := 0
-	for _, b := range c.buckets {
-		count += b.count
+// ignored returns whether text matches one of the ignore_patterns. It should
+// be called with the lock held.
+func (c *Counter) ignored(text string) bool {
+	for _, re := range c.ignoreRegexes {
+		if re.MatchString(text) {
+			return true
+		}
 	}
-	return count
+	return false
 }
 
-// Defining an interface so that these methods can be mocked easily while testing.
-type RTM interface {
-	SendMessage(msg *slack.OutgoingMessage)
-	NewOutgoingMessage(text string, channel string) *slack.OutgoingMessage
+// getClock returns the clock of the counter.
+func (c *Counter) getClock() Clock {
+	if c.clock == nil {
+		return realClock{}
+	}
+	return c.clock
 }
 
-func callYoda(c *Counter, rtm RTM, m string) {
-	// Buckets set to nil after getting messages from it.
-	c.buckets = nil
-	msg := fmt.Sprintf("```%s\n%s\n%s```",
-		string(yoda), proverbs[rand.Intn(len(proverbs))],
-		m)
-	rtm.SendMessage(rtm.NewOutgoingMessage(msg, c.ChannelId))
+// now returns the current time according to the clock of the counter.
+func (c *Counter) now() time.Time {
+	return c.getClock().Now()
 }
 
-func discourseQuery(suffix string, args string) string {
-	return fmt.Sprintf("%s/%s?api_key=%s&api_username=wisemonk&%s",
-		conf.DiscPrefix, suffix, conf.DiscKey, args)
+func (c *Counter) MeditationEnd() time.Duration {
+	c.RLock()
+	defer c.RUnlock()
+	return c.meditationEnd.Sub(c.now())
 }
 
-// Required fields for a discourse topic
-type Topic struct {
-	Title    string `json:"title"`
-	Raw      string `json:"raw"`
-	Category string `json:"category"`
+// QuietRemaining returns how long wisemonk stays quiet for. It is negative if
+// he isn't quiet.
+func (c *Counter) QuietRemaining() time.Duration {
+	c.RLock()
+	defer c.RUnlock()
+	return c.quietEnd.Sub(c.now())
 }
 
-// We need to extract these fields from the response that discourse sends
-// when a topic is created successfully.
-type TopicBody struct {
-	Id   int    `json:"topic_id"`
-	Slug string `json:"topic_slug"`
+func (c *Counter) SetQuiet(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.quietEnd = c.now().Add(d)
 }
 
-func topicUrl(tb TopicBody) string {
-	return fmt.Sprintf("%s/t/%s/%d", conf.DiscPrefix, tb.Slug, tb.Id)
+func (c *Counter) SetMeditationEnd(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.meditationEnd = c.now().Add(d)
+	c.wake = make(chan struct{})
 }
 
-func sanitizeTitle(title string) string {
-	t := strings.Trim(title, " ")
-	// Discourse requires title to be atleast 20 chars.
-	minLen := 20
-	if len(t) < minLen {
-		t = "Topic created by wisemonk with title: " + t
-		return t
+// wakeChan returns the channel which is closed if wisemonk is woken up before
+// his meditation ends.
+func (c *Counter) wakeChan() <-chan struct{} {
+	c.Lock()
+	defer c.Unlock()
+	if c.wake == nil {
+		c.wake = make(chan struct{})
 	}
+	return c.wake
+}
 
-	maxLen := 100
-	// This is the max that discourse allows.
-	if len(t) > maxLen {
-		t = t[:maxLen]
+// WakeUp ends the meditation right away. It returns false if wisemonk wasn't
+// meditating.
+func (c *Counter) WakeUp() bool {
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	if !c.meditationEnd.After(now) {
+		return false
 	}
-	// So that truncation happens at the last word break if possible.
-	idx := strings.LastIndex(t, " ")
-	if idx != -1 && idx >= minLen {
-		t = t[:idx]
+	c.meditationEnd = now
+	if c.wake != nil {
+		close(c.wake)
+		c.wake = nil
 	}
-	return t
+	return true
 }
 
-func createTopic(c *Counter, title string) string {
-	var buf bytes.Buffer
+// Commands that wisemonk understands, after the command prefix. The regexes
+// and the help text are both built from these so that they stay in sync.
+const (
+	meditateCmd = "meditate for"
+	createCmd   = "create topic"
+	queryCmd    = "query"
+	wakeCmd     = "wake up"
+	statusCmd   = "status"
+	helpCmd     = "help"
+	quietCmd    = "quiet for"
+	setMaxCmd   = "set maxmsg"
+	appendCmd   = "append to"
+	channelsCmd = "channels"
+	previewCmd  = "preview topic"
+	statsCmd    = "stats"
+)
 
-	buf.WriteString("```")
-	count := 1
-	for _, b := range c.buckets {
-		for _, m := range b.msgs {
-			fmt.Fprintf(&buf, "[%2d] %s\n", count, m)
-			count++
-		}
-	}
-	buf.WriteString("```")
+const defaultCommandPrefix = "wisemonk"
 
-	t := Topic{Title: title, Raw: buf.String(), Category: c.CreateTopicIn}
-	bb := new(bytes.Buffer)
-	json.NewEncoder(bb).Encode(t)
-	q := discourseQuery("posts.json", "")
-	res, err := http.Post(q, "application/json", bb)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer res.Body.Close()
+// What the commands start with, set using command_prefix in the config.
+var commandPrefix = defaultCommandPrefix
 
-	if res.StatusCode != http.StatusOK {
-		if res.StatusCode == http.StatusForbidden {
-			log.Fatal("Discourse returned forbidden error.")
-		}
+var commandHelp = []struct {
+	usage string
+	desc  string
+}{
+	{meditateCmd + " [duration]", "Stop alerting for the duration, e.g. 20m or 20 minutes."},
+	{quietCmd + " [duration]",
+		"Stop alerting for the duration, without announcing when it ends."},
+	{createCmd + " [title]", "Create a discourse topic with the recent messages."},
+	{previewCmd, "Show what a topic created now would contain."},
+	{appendCmd + " [topic url]",
+		"Add the recent messages to an existing discourse topic."},
+	{queryCmd + " [query_string] [max_count] [views|latest|likes] [" + searchAll + "]",
+		"Search discourse for topics."},
+	{wakeCmd, "Stop meditating right away."},
+	{setMaxCmd + " [n]",
+		"Alert after n messages in the interval, till restart or reload."},
+	{statusCmd, "Show the message count and whether I am meditating."},
+	{statsCmd + " [n]", "List the last n topics I created for this channel."},
+	{channelsCmd, "List the channels I am watching and their settings."},
+	{helpCmd, "Show this message."},
+}
 
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			log.Fatal(err)
-		}
-		log.Printf("Topic: %v\nResponse status code: %d, body: %s",
-			t, res.StatusCode, string(body))
-		return ""
-	}
+const defaultMaxMeditation = time.Hour
 
-	dec := json.NewDecoder(res.Body)
-	var tb TopicBody
-	err = dec.Decode(&tb)
+// maxMeditation returns the longest duration wisemonk can meditate for in
+// this channel.
+func (c *Counter) maxMeditation() time.Duration {
+	c.RLock()
+	max := c.MaxMeditation
+	c.RUnlock()
+	if max == "" {
+		return defaultMaxMeditation
+	}
+	d, err := time.ParseDuration(max)
 	if err != nil {
-		log.Fatal(err)
+		logger.Warnf("Got error while parsing max_meditation. %s", err)
+		return defaultMaxMeditation
 	}
-	url := topicUrl(tb)
-	return url
+	return d
 }
 
-func sendMessage(c *Counter, rtm RTM) {
-	msg := ""
-	if conf.DiscKey == "" {
-		callYoda(c, rtm, msg)
-		return
+const defaultNudgeCooldown = 5 * time.Minute
+
+// nudgeCooldown returns the least time between two alerts in this channel.
+func (c *Counter) nudgeCooldown() time.Duration {
+	c.RLock()
+	cooldown := c.NudgeCooldown
+	c.RUnlock()
+	if cooldown == "" {
+		return defaultNudgeCooldown
 	}
-	// Picking the first message in the bucket as the discourse topic.
-	title := sanitizeTitle(c.buckets[0].msgs[0])
-	// The first message becomes the title.
-	url := createTopic(c, title)
-	// Incase we encountered an error from discourse, createTopic
-	// would return an empty string as url.
-	if url != "" {
-		msg = fmt.Sprintf("Please move your discussion to %s", url)
+	d, err := time.ParseDuration(cooldown)
+	if err != nil {
+		logger.Warnf("Got error while parsing nudge_cooldown. %s", err)
+		return defaultNudgeCooldown
 	}
-	callYoda(c, rtm, msg)
+	return d
 }
 
-func substituteUsernames(text string, memmap map[string]string) string {
-	userRegex, err := regexp.Compile(`<@U[A-Z0-9]{8}>`)
-	if err != nil {
-		log.Fatal(err)
+// nudgeDue returns whether an alert should be sent now. Alerts aren't sent
+// while wisemonk is meditating or quiet, or outside the active hours.
+func (c *Counter) nudgeDue() bool {
+	if c.MeditationEnd() > 0 || c.QuietRemaining() > 0 ||
+		!c.inActiveHours(c.now()) {
+		return false
 	}
+	return c.shouldNudge()
+}
 
-	res := userRegex.FindAllString(text, -1)
-	if res == nil {
-		return text
+// shouldNudge returns whether the count has reached MaxMsg, the cooldown
+// since the last alert has passed and the channel has at least MinMembers
+// members. If so, the time of the alert is recorded.
+func (c *Counter) shouldNudge() bool {
+	count := c.Count()
+	cooldown := c.nudgeCooldown()
+	c.RLock()
+	max, minMembers, lastNudge := c.MaxMsg, c.MinMembers, c.lastNudge
+	c.RUnlock()
+	if count < max {
+		// The channel calmed down after the hint.
+		c.Lock()
+		c.hintTs = ""
+		c.Unlock()
+		return false
 	}
-
-	for _, u := range res {
-		// extracting the userid
-		uid := u[2 : len(u)-1]
-		if uname, ok := memmap[uid]; ok {
-			text = strings.Replace(text, u, "@"+uname, -1)
+	if c.now().Sub(lastNudge) < cooldown {
+		return false
+	}
+	if minMembers > 0 && members != nil {
+		n, err := members.count(c.ChannelId, c.now())
+		if err != nil {
+			logger.Warnf("Error while fetching members of %s. %s",
+				c.ChannelId, err)
+		} else if n < minMembers {
+			return false
 		}
 	}
-	return text
+	c.Lock()
+	c.lastNudge = c.now()
+	c.Unlock()
+	return true
 }
 
-// Increment increases the count for a bucket or adds a new bucket with count 1
-// to the Counter c
-func (c *Counter) Increment(m *slack.Msg, memmap map[string]string) {
-	if m.Channel != c.ChannelId {
-		log.Fatalf("Channel mismatch, Expected: %s, Got: %s",
-			c.ChannelId, m.Channel)
-	}
-	var tsf float64
-	var err error
-	if tsf, err = strconv.ParseFloat(m.Timestamp, 64); err != nil {
-		log.Fatal(err)
+// shouldSummarize returns whether the channel has been silent for
+// SummarizeAfter since the last message, and the messages haven't been
+// summarized yet. If so, they are marked as summarized.
+func (c *Counter) shouldSummarize(now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.SummarizeAfter == "" || len(c.buckets) == 0 {
+		return false
 	}
-	ts := int64(tsf)
-	m.Text = substituteUsernames(m.Text, memmap)
-	msg := fmt.Sprintf("%-14s: %s", memmap[m.User], m.Text)
-
-	// To check if a bucket for the timestamp already exists
-	exists := false
-	for i := len(c.buckets) - 1; i >= 0; i-- {
-		b := &c.buckets[i]
-		if b.utime == ts {
-			b.count++
-			b.msgs = append(b.msgs, msg)
-			exists = true
-			break
-		}
+	d, err := time.ParseDuration(c.SummarizeAfter)
+	if err != nil {
+		logger.Warnf("Got error while parsing summarize_after. %s", err)
+		return false
 	}
-
-	if exists != true {
-		c.buckets = append(c.buckets, Bucket{utime: ts, count: 1,
-			msgs: []string{msg}})
+	// The buckets are sorted, so the last one has the latest message.
+	last := c.buckets[len(c.buckets)-1].utime
+	if last <= c.lastSummarized || now.Sub(time.Unix(last, 0)) < d {
+		return false
 	}
+	c.lastSummarized = last
+	return true
 }
 
-// This method listens for incoming events. It puts message events onto
-// a channel
-func listen(rtm *slack.RTM) {
-	// This has been mostly picked up from
-	// https://github.com/nlopes/slack/blob/master/examples/websocket/websocket.go
-	for {
-		msg := <-rtm.IncomingEvents
-		switch ev := msg.Data.(type) {
-		case *slack.ConnectedEvent:
-		case *slack.MessageEvent:
-			if sm, ok := msg.Data.(*slack.MessageEvent); ok {
-				// Putting the message on the Counter it belongs
-				// to
-				m := sm.Msg
-
-				if c, ok := conf.Channels[m.Channel]; ok {
-					c.messages <- &m
-				}
-			}
-		case *slack.RTMError:
-			log.Fatal(ev.Error())
-		case *slack.InvalidAuthEvent:
-			log.Fatal(errors.New("Invalid credentails"))
-		}
-	}
+var meditateRegex, createRegex, queryCountRegex, queryRegex,
+	statusRegex, helpRegex, wakeRegex, quietRegex, setMaxRegex,
+	appendRegex, channelsRegex, previewRegex, statsRegex *regexp.Regexp
+
+// LastMessage returns the time of the latest message counted. It is zero if
+// no message has been counted since wisemonk started.
+func (c *Counter) LastMessage() time.Time {
+	c.RLock()
+	defer c.RUnlock()
+	return c.lastMessage
 }
 
-// This function checks if wisemonk was asked to create a topic. If he ways,
-// it creates a new topic and returns its url.
-func createNewTopic(c *Counter, m string, rtm RTM) {
-	if conf.DiscKey == "" {
-		return
+// Gives back the count of messages for the buckets which were created in the
+// interval.
+func (c *Counter) Count() int {
+	c.Lock()
+	defer c.Unlock()
+	c.dropExpired(c.now().Add(-c.interval).Unix())
+
+	count := 0
+	for _, b := range c.buckets {
+		count += b.count
 	}
+	return count
+}
 
-	res := createRegex.FindStringSubmatch(m)
-	if res == nil {
-		return
+// dropExpired drops the buckets created at or before timeSince. It should be
+// called with the lock held.
+func (c *Counter) dropExpired(timeSince int64) {
+	// The buckets are sorted, so the expired ones are all before idx and are
+	// dropped by reslicing.
+	idx := sort.Search(len(c.buckets), func(i int) bool {
+		return c.buckets[i].utime > timeSince
+	})
+	for i := 0; i < idx; i++ {
+		// So that their messages can be collected before the slice is
+		// reallocated.
+		c.buckets[i] = Bucket{}
 	}
+	c.buckets = c.buckets[idx:]
+}
 
-	title := sanitizeTitle(res[1])
-	url := createTopic(c, title)
+// clearBuckets removes all the messages stored in the counter.
+func (c *Counter) clearBuckets() {
+	c.Lock()
+	defer c.Unlock()
 	c.buckets = nil
-
-	msg := "New topic created with url: " + url
-	rtm.SendMessage(rtm.NewOutgoingMessage(msg,
-		c.ChannelId))
 }
 
-// This function checks if wisemonk was asked to meditate by matching the
-// message against a regex. If the message was a valid command then wisemonk
-// stops sending messages for the specified duration.
-func askToMeditate(c *Counter, m string) string {
-	res := meditateRegex.FindStringSubmatch(m)
-	if res == nil {
-		return ""
+// firstMessage returns the first message stored in the counter, or an empty
+// string if there are none.
+func (c *Counter) firstMessage() string {
+	c.RLock()
+	defer c.RUnlock()
+	for _, b := range c.buckets {
+		if len(b.msgs) > 0 {
+			return b.msgs[0].String()
+		}
 	}
+	return ""
+}
 
-	// Captured time is available at the first index. The duration can be
-	// anything that time.ParseDuration accepts.
-	d, err := time.ParseDuration(res[1])
-	if err != nil {
-		return "Sorry, I don't understand you."
-	}
+// transcript returns the stored messages numbered in the order they were
+// received.
+func (c *Counter) transcript() string {
+	return c.truncatedTranscript(0)
+}
 
-	if d < 0 {
-		return "Sorry, going back in time is not what I can do."
-	}
+// Room left in a truncated transcript for the note about the messages
+// omitted.
+const omittedNoteLen = 40
 
-	if d >= time.Hour {
-		return "It's hard to meditate for more than an hour at one go you know."
+// truncatedTranscript returns the transcript with at most max characters. The
+// messages which don't fit are left out, with a note saying how many were. It
+// isn't truncated if max is 0.
+func (c *Counter) truncatedTranscript(max int) string {
+	c.RLock()
+	defer c.RUnlock()
+	var buf bytes.Buffer
+	count, length, omitted := 1, 0, 0
+	for _, b := range c.buckets {
+		for _, m := range b.msgs {
+			if omitted > 0 {
+				omitted++
+				continue
+			}
+			line := fmt.Sprintf("[%2d] %s\n", count, m)
+			n := utf8.RuneCountInString(line)
+			if max > 0 && length+n > max-omittedNoteLen {
+				omitted++
+				continue
+			}
+			buf.WriteString(line)
+			length += n
+			count++
+		}
 	}
-
-	if d := c.MeditationEnd(); d > 0 {
-		return fmt.Sprintf("I am meditating. My meditation will finish in %.0f mins",
-			d.Minutes())
+	if omitted > 0 {
+		fmt.Fprintf(&buf, "... %d more messages omitted\n", omitted)
 	}
+	return buf.String()
+}
 
-	c.SetMeditationEnd(d)
-	go func() {
-		time.Sleep(d)
-		// We clear the buckets when wisemonk wakes up from his meditation.
-		c.buckets = nil
-		// TODO(pawan) - Send message when wisemonk has ended his
-		// meditation.
-
-	}()
-	return fmt.Sprintf("Okay, I am going to meditate for %s", d)
+// Defining an interface so that these methods can be mocked easily while testing.
+type RTM interface {
+	SendMessage(msg *slack.OutgoingMessage)
+	NewOutgoingMessage(text string, channel string) *slack.OutgoingMessage
 }
 
-type SearchTopic struct {
-	Id       int    `json:"id"`
-	Slug     string `json:"slug"`
-	Category int    `json:"category_id"`
-	Replies  int    `json:"reply_count"`
-	Posts    int    `json:"posts_count"`
-	Views    int    `json:"views"`
+// ThreadReplier is implemented by clients which can post a message as a reply
+// in the thread started by the message with timestamp threadTs.
+type ThreadReplier interface {
+	SendThreadReply(msg *slack.OutgoingMessage, threadTs string)
 }
 
-type SearchResponse struct {
-	Topics []SearchTopic `json:"topics"`
+// MessageEditor is implemented by clients which return the timestamp of the
+// messages they post, so that the messages can be edited or deleted later.
+type MessageEditor interface {
+	PostMessage(msg *slack.OutgoingMessage, blocks []block,
+		threadTs string) (string, error)
+	UpdateMessage(channel string, ts string, text string) error
+	DeleteMessage(channel string, ts string) error
 }
 
-func filterTopics(c *Counter, topics []SearchTopic) []SearchTopic {
-	var filteredTopics []SearchTopic
-	for idx, t := range topics {
-		keep := false
-		for _, cat := range c.SearchOver {
-			if discourseCategory[t.Category] == cat {
-				keep = true
-				break
+// Number of users called out in the alert as the most active.
+const numActiveUsers = 3
+
+type UserCount struct {
+	Name  string
+	Count int
+}
+
+// topUsers returns upto n users who sent the most messages stored in the
+// counter. Users with the same count are ordered by name.
+func (c *Counter) topUsers(n int) []UserCount {
+	c.RLock()
+	counts := make(map[string]int)
+	for _, b := range c.buckets {
+		for _, m := range b.msgs {
+			name := m.Name
+			if name == "" {
+				name = m.User
+			}
+			if name != "" {
+				counts[name]++
 			}
 		}
-		if keep {
-			filteredTopics = append(filteredTopics, topics[idx])
+	}
+	c.RUnlock()
+
+	var ucs []UserCount
+	for name, count := range counts {
+		ucs = append(ucs, UserCount{Name: name, Count: count})
+	}
+	sort.Slice(ucs, func(i, j int) bool {
+		if ucs[i].Count != ucs[j].Count {
+			return ucs[i].Count > ucs[j].Count
 		}
+		return ucs[i].Name < ucs[j].Name
+	})
+	if len(ucs) > n {
+		ucs = ucs[:n]
 	}
-	return filteredTopics
+	return ucs
 }
 
-func parseSearchQuery(m string) (string, int) {
-	var query string
-	var count int
+// mostActive returns a line calling out the users who sent the most messages,
+// or an empty string if we don't know who sent them.
+func mostActive(c *Counter) string {
+	ucs := c.topUsers(numActiveUsers)
+	if len(ucs) == 0 {
+		return ""
+	}
+	var users []string
+	for _, uc := range ucs {
+		users = append(users, fmt.Sprintf("@%s (%d)", uc.Name, uc.Count))
+	}
+	return "Most active: " + strings.Join(users, ", ")
+}
 
-	res := queryCountRegex.FindStringSubmatch(m)
-	if res == nil {
-		// TODO(pawan) - Get all info from just one regex.
-		match := queryRegex.FindStringSubmatch(m)
-		if match != nil {
-			// Default value of count is kept as 3.
-			return match[1], 3
+// BlockSender is implemented by clients which can send Block Kit blocks. The
+// text of msg is shown in notifications and by clients which can't show the
+// blocks.
+type BlockSender interface {
+	SendBlocks(msg *slack.OutgoingMessage, blocks []block, threadTs string)
+}
+
+// block is a Block Kit block. Only the fields that wisemonk uses are here.
+type block struct {
+	Type     string        `json:"type"`
+	Text     *blockText    `json:"text,omitempty"`
+	Elements []blockButton `json:"elements,omitempty"`
+}
+
+type blockText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type blockButton struct {
+	Type string    `json:"type"`
+	Text blockText `json:"text"`
+	Url  string    `json:"url"`
+}
+
+// nudgeBlocks returns the blocks for an alert with the quote and message m. A
+// button for the topic is added if topicUrl isn't empty.
+func nudgeBlocks(quote string, m string, topicUrl string) []block {
+	blocks := []block{
+		{Type: "section", Text: &blockText{Type: "mrkdwn",
+			Text: fmt.Sprintf("```%s```", string(yoda))}},
+		{Type: "section", Text: &blockText{Type: "mrkdwn",
+			Text: "_" + quote + "_"}},
+	}
+	if m != "" {
+		blocks = append(blocks, block{Type: "section",
+			Text: &blockText{Type: "mrkdwn", Text: m}})
+	}
+	if topicUrl != "" {
+		blocks = append(blocks, block{Type: "actions",
+			Elements: []blockButton{{Type: "button",
+				Text: blockText{Type: "plain_text", Text: "Go to topic"},
+				Url:  topicUrl}}})
+	}
+	return blocks
+}
+
+func callYoda(c *Counter, rtm RTM, m string) {
+	nudge(c, rtm, m, "")
+}
+
+// nudge sends the alert with the message m. It has a button for the topic at
+// topicUrl, if there is one and the alert is sent as blocks.
+func nudge(c *Counter, rtm RTM, m string, topicUrl string) {
+	active := mostActive(c)
+	if active != "" {
+		m = active + "\n" + m
+	}
+	c.RLock()
+	threadTs := ""
+	if c.NudgeInThread {
+		threadTs = c.lastTimestamp
+	}
+	quote := c.NudgeMessage
+	useBlocks := c.NudgeBlocks
+	c.RUnlock()
+	if quote == "" {
+		quote = c.pickQuote()
+	}
+	// Buckets set to nil after getting messages from it, so that the count
+	// is reset after every alert.
+	c.clearBuckets()
+	om := rtm.NewOutgoingMessage(nudgeText(quote, m), c.ChannelId)
+	if me, ok := rtm.(MessageEditor); ok && c.tidyEnabled() {
+		var blocks []block
+		if useBlocks {
+			blocks = nudgeBlocks(quote, m, topicUrl)
+		}
+		ts, err := me.PostMessage(om, blocks, threadTs)
+		if err != nil {
+			logger.Errorf("Error while sending message: %v", err)
+			return
+		}
+		c.Lock()
+		c.nudgeTs, c.nudgeTopic, c.nudgedAt = ts, topicUrl, c.now()
+		c.Unlock()
+		return
+	}
+	if bs, ok := rtm.(BlockSender); ok && useBlocks {
+		bs.SendBlocks(om, nudgeBlocks(quote, m, topicUrl), threadTs)
+		return
+	}
+	if tr, ok := rtm.(ThreadReplier); ok && threadTs != "" {
+		tr.SendThreadReply(om, threadTs)
+		return
+	}
+	rtm.SendMessage(om)
+}
+
+// pickQuote returns a random quote for the alert, which differs from the one
+// in the last alert in the channel unless there is only one quote.
+func (c *Counter) pickQuote() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.rng == nil {
+		// Each counter has its own source since a rand.Rand isn't safe
+		// to share between goroutines.
+		c.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	n := len(quotes)
+	var i int
+	if !c.quoted || n == 1 {
+		i = c.rng.Intn(n)
+	} else {
+		// Picking among the others, by skipping over the last one.
+		if i = c.rng.Intn(n - 1); i >= c.lastQuote {
+			i++
+		}
+	}
+	c.lastQuote, c.quoted = i, true
+	return quotes[i]
+}
+
+const (
+	tidyShorten = "shorten"
+	tidyDelete  = "delete"
+)
+
+// tidyEnabled returns whether the alerts are tidied up once the channel calms
+// down.
+func (c *Counter) tidyEnabled() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.TidyNudgeAfter != ""
+}
+
+// tidyDue returns the timestamp and topic of the last alert if it is time to
+// tidy it up. The alert is then forgotten, so that it is only tidied once.
+func (c *Counter) tidyDue() (ts string, topicUrl string, ok bool) {
+	count := c.Count()
+	c.Lock()
+	defer c.Unlock()
+	if c.nudgeTs == "" || count >= c.MaxMsg {
+		return "", "", false
+	}
+	// The duration has been validated along with the config.
+	d, err := time.ParseDuration(c.TidyNudgeAfter)
+	if err != nil || c.now().Sub(c.nudgedAt) < d {
+		return "", "", false
+	}
+	ts, topicUrl = c.nudgeTs, c.nudgeTopic
+	c.nudgeTs, c.nudgeTopic = "", ""
+	return ts, topicUrl, true
+}
+
+// tidyNudge shortens the alert with timestamp ts to a line, or deletes it, so
+// that it doesn't clutter the channel once the discussion is over.
+func tidyNudge(c *Counter, rtm RTM, ts string, topicUrl string) {
+	me, ok := rtm.(MessageEditor)
+	if !ok {
+		return
+	}
+	c.RLock()
+	mode := c.TidyNudge
+	c.RUnlock()
+	if mode == tidyDelete {
+		if err := me.DeleteMessage(c.ChannelId, ts); err != nil {
+			logger.Errorf("Error while deleting alert %s: %v", ts, err)
+		}
+		return
+	}
+	text := "This channel got busy, so I asked for a break here."
+	if topicUrl != "" {
+		text = "Please move your discussion to " + topicUrl
+	}
+	if err := me.UpdateMessage(c.ChannelId, ts, text); err != nil {
+		logger.Errorf("Error while shortening alert %s: %v", ts, err)
+	}
+}
+
+// escapeFences breaks up runs of backticks in text with zero width spaces, so
+// that it can't close the slack code block that it is shown in. Slack doesn't
+// understand longer fences, unlike markdown.
+func escapeFences(text string) string {
+	return strings.Replace(text, "``", "`\u200b`", -1)
+}
+
+// codeFence returns a markdown code fence which is longer than any run of
+// backticks in text, so that the code block isn't closed by text.
+func codeFence(text string) string {
+	longest, run := 0, 0
+	for _, r := range text {
+		if r != '`' {
+			run = 0
+			continue
+		}
+		run++
+		if run > longest {
+			longest = run
+		}
+	}
+	if longest < 3 {
+		return "```"
+	}
+	return strings.Repeat("`", longest+1)
+}
+
+// Slack truncates messages longer than this.
+const maxSlackMsgLen = 40000
+
+// nudgeText returns the text of the alert with the quote and the message m,
+// which has the link to the topic at its end. If it would be too long for
+// slack, yoda is left out first, then the quote is shortened and finally the
+// start of m is cut so that the link is still there.
+func nudgeText(quote, m string) string {
+	quote, m = escapeFences(quote), escapeFences(m)
+	msg := fmt.Sprintf("```%s\n%s\n%s```", string(yoda), quote, m)
+	if utf8.RuneCountInString(msg) <= maxSlackMsgLen {
+		return msg
+	}
+	// For the code block and the newline between the quote and m.
+	const markup = 7
+	room := maxSlackMsgLen - markup - utf8.RuneCountInString(m)
+	if room < 0 {
+		r := []rune(m)
+		return "```" + string(r[len(r)-(maxSlackMsgLen-6):]) + "```"
+	}
+	if utf8.RuneCountInString(quote) > room {
+		if room < 3 {
+			quote = ""
+		} else {
+			quote = truncateRunes(quote, room-3) + "..."
+		}
+	}
+	return fmt.Sprintf("```%s\n%s```", quote, m)
+}
+
+// DiscourseClient talks to the discourse at Prefix, as Username, and caches
+// its categories. The handlers use the one for the config returned by
+// discourse().
+type DiscourseClient struct {
+	Prefix string
+	Key    string
+	// Defaults to wisemonk.
+	Username string
+	// Whether the credentials are sent as headers instead of in the url.
+	AuthHeaders bool
+	// Used for the requests, the shared client if nil.
+	HTTP *http.Client
+	cats *categoryCache
+}
+
+// newDiscourseClient returns a client for the discourse at prefix, with a
+// category cache of its own.
+func newDiscourseClient(prefix, key, username string) *DiscourseClient {
+	return &DiscourseClient{Prefix: prefix, Key: key, Username: username,
+		cats: &categoryCache{}}
+}
+
+// Guards discourseClient.
+var discourseMu sync.Mutex
+
+// Client for the discourse in the config, nil till discourse() is first
+// called.
+var discourseClient *DiscourseClient
+
+// discourse returns the client for the discourse in the config. The client is
+// replaced if the settings in the config have changed, with the new one
+// taking over the categories cached by the old one.
+func discourse() *DiscourseClient {
+	discourseMu.Lock()
+	defer discourseMu.Unlock()
+	d := discourseClient
+	if d != nil && d.Prefix == conf.DiscPrefix && d.Key == conf.DiscKey &&
+		d.Username == conf.DiscUsername &&
+		d.AuthHeaders == conf.DiscAuthHeaders {
+		return d
+	}
+	nd := newDiscourseClient(conf.DiscPrefix, conf.DiscKey, conf.DiscUsername)
+	nd.AuthHeaders = conf.DiscAuthHeaders
+	if d != nil {
+		nd.cats = d.cats
+	}
+	discourseClient = nd
+	return nd
+}
+
+// discourseQuery returns the url for the endpoint of the discourse in the
+// config.
+func discourseQuery(suffix string, args string) string {
+	return discourse().query(suffix, args)
+}
+
+// query returns the url for the discourse endpoint. The credentials are part
+// of the url unless they are sent as headers.
+func (d *DiscourseClient) query(suffix string, args string) string {
+	if d.AuthHeaders {
+		return fmt.Sprintf("%s/%s?%s", d.Prefix, suffix, args)
+	}
+	return fmt.Sprintf("%s/%s?api_key=%s&api_username=%s&%s",
+		d.Prefix, suffix, d.Key, url.QueryEscape(d.username()), args)
+}
+
+// username returns the discourse user that wisemonk acts as.
+func (d *DiscourseClient) username() string {
+	if d.Username == "" {
+		return "wisemonk"
+	}
+	return d.Username
+}
+
+// setAuth adds the credentials to the headers of a request to discourse, if
+// they are to be sent as headers.
+func (d *DiscourseClient) setAuth(req *http.Request) {
+	if !d.AuthHeaders {
+		return
+	}
+	req.Header.Set("Api-Key", d.Key)
+	req.Header.Set("Api-Username", d.username())
+}
+
+func (d *DiscourseClient) httpClient() *http.Client {
+	if d.HTTP == nil {
+		return client
+	}
+	return d.HTTP
+}
+
+// get sends a GET request to q with the credentials and parses the JSON
+// response into data.
+func (d *DiscourseClient) get(q string, data interface{}) error {
+	return getAndParse(d.httpClient(), q, d.setAuth, data)
+}
+
+// Required fields for a discourse topic
+type Topic struct {
+	Title    string   `json:"title"`
+	Raw      string   `json:"raw"`
+	Category string   `json:"category"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// Tag added to every topic created by wisemonk.
+const slackTag = "from-slack"
+
+// topicTags returns the tags for topics created from the counter.
+func (c *Counter) topicTags() []string {
+	c.RLock()
+	defer c.RUnlock()
+	tags := []string{slackTag}
+	for _, t := range c.TopicTags {
+		if t != slackTag {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// We need to extract these fields from the response that discourse sends
+// when a topic is created successfully.
+type TopicBody struct {
+	Id   int    `json:"topic_id"`
+	Slug string `json:"topic_slug"`
+}
+
+func topicUrl(tb TopicBody) string {
+	return discourse().topicUrl(tb)
+}
+
+func (d *DiscourseClient) topicUrl(tb TopicBody) string {
+	return fmt.Sprintf("%s/t/%s/%d", d.Prefix, tb.Slug, tb.Id)
+}
+
+// Discourse requires titles to have between 20 and 100 characters. It counts
+// characters, not bytes.
+const (
+	minTitleLen = 20
+	maxTitleLen = 100
+)
+
+const defaultTitlePrefix = "Topic created by wisemonk with title: "
+
+// titlePrefix returns what is prepended to titles that are too short.
+func titlePrefix() string {
+	if conf.TitlePrefix == "" {
+		return defaultTitlePrefix
+	}
+	return conf.TitlePrefix
+}
+
+// truncateRunes returns the first n runes of t, so that we don't cut a
+// character in half.
+func truncateRunes(t string, n int) string {
+	if r := []rune(t); len(r) > n {
+		return string(r[:n])
+	}
+	return t
+}
+
+func sanitizeTitle(title string) string {
+	t := strings.Trim(title, " ")
+	if utf8.RuneCountInString(t) < minTitleLen {
+		// The prefix is at least minTitleLen long, but could make the
+		// title too long.
+		return truncateRunes(titlePrefix()+t, maxTitleLen)
+	}
+
+	t = truncateRunes(t, maxTitleLen)
+	// So that truncation happens at the last word break if possible.
+	idx := strings.LastIndex(t, " ")
+	if idx != -1 && utf8.RuneCountInString(t[:idx]) >= minTitleLen {
+		t = t[:idx]
+	}
+	return t
+}
+
+// timeRange returns the times of the first and last buckets in the counter.
+// ok is false if there are no buckets.
+func (c *Counter) timeRange() (first time.Time, last time.Time, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if len(c.buckets) == 0 {
+		return first, last, false
+	}
+	min, max := c.buckets[0].utime, c.buckets[0].utime
+	for _, b := range c.buckets {
+		if b.utime < min {
+			min = b.utime
+		}
+		if b.utime > max {
+			max = b.utime
+		}
+	}
+	return time.Unix(min, 0).UTC(), time.Unix(max, 0).UTC(), true
+}
+
+// topicRaw returns the body of the discourse topic created for the counter.
+// It links back to the slack channel and mentions the time window that the
+// messages are from, followed by the messages.
+func topicRaw(c *Counter) string {
+	var buf bytes.Buffer
+	name := channelName(c.ChannelId)
+	if conf.Platform == platformMattermost {
+		fmt.Fprintf(&buf, "Created from Mattermost channel %s", name)
+	} else {
+		fmt.Fprintf(&buf, "Created from Slack channel [%s](%s/app_redirect?channel=%s)",
+			name, slackWebPrefix, c.ChannelId)
+	}
+	if first, last, ok := c.timeRange(); ok {
+		fmt.Fprintf(&buf, " with messages from %s to %s",
+			first.Format(time.RFC1123), last.Format(time.RFC1123))
+	}
+	// The messages could have fences of their own.
+	fence := codeFence(c.transcript())
+	buf.WriteString(".\n\n" + fence + "\n")
+	// The code block needs the fence again to be closed.
+	buf.WriteString(c.truncatedTranscript(maxPostLength() -
+		utf8.RuneCount(buf.Bytes()) - len(fence)))
+	buf.WriteString(fence)
+	return buf.String()
+}
+
+// Shortest max_post_length allowed, so that the header of the topic and a few
+// messages fit.
+const minPostLength = 500
+
+// Discourse doesn't accept posts longer than this by default.
+const defaultMaxPostLength = 32000
+
+// maxPostLength returns the most characters a topic created by wisemonk can
+// have.
+func maxPostLength() int {
+	if conf.MaxPostLength > 0 {
+		return conf.MaxPostLength
+	}
+	return defaultMaxPostLength
+}
+
+// Forum is where topics are created with the messages from a channel, and
+// searched for.
+type Forum interface {
+	// CreateTopic creates the topic and returns its url.
+	CreateTopic(t Topic) (string, error)
+	// Search returns the topics matching query, in the given order. Only
+	// topics in categories are returned, unless it is empty.
+	Search(query string, order string, categories []string) ([]SearchResult,
+		error)
+}
+
+// SearchResult is a topic found by searching a Forum.
+type SearchResult struct {
+	Title string
+	Url   string
+	// Shown after the url, e.g. the number of views.
+	Stats string
+}
+
+const (
+	forumDiscourse = "discourse"
+	forumGithub    = "github"
+)
+
+// forumEnabled returns whether wisemonk has a forum to create topics in.
+func forumEnabled() bool {
+	return conf.Forum == forumGithub || conf.DiscKey != ""
+}
+
+// activeForum returns the forum selected in the config.
+func activeForum() Forum {
+	if conf.Forum == forumGithub {
+		return &githubForum{token: conf.GithubToken, repo: conf.GithubRepo}
+	}
+	return discourse()
+}
+
+// discourseEnabled returns whether the channel hasn't opted out of the
+// forum. The caller must hold the lock.
+func (c *Counter) discourseEnabled() bool {
+	return c.DiscourseEnabled == nil || *c.DiscourseEnabled
+}
+
+// forumEnabled returns whether the forum can be used for the channel.
+func (c *Counter) forumEnabled() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return forumEnabled() && c.discourseEnabled()
+}
+
+// topicsEnabled returns whether topics can be created for the channel.
+func (c *Counter) topicsEnabled() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return forumEnabled() && c.discourseEnabled() && !c.topicsDisabled
+}
+
+// disableTopics stops topics from being created for the channel, till its
+// create_topic_in is changed. The hint is logged along with the reason.
+func (c *Counter) disableTopics(hint string) {
+	c.Lock()
+	defer c.Unlock()
+	if !c.topicsDisabled {
+		logger.Warnf("Category %s doesn't exist in discourse, not creating topics for channel %s.%s",
+			c.CreateTopicIn, c.ChannelId, hint)
+	}
+	c.topicsDisabled = true
+}
+
+var errTopicsDisabled = errors.New("Topics are disabled for the channel.")
+
+func createTopic(c *Counter, title string) (string, error) {
+	c.RLock()
+	disabled := c.topicsDisabled || !c.discourseEnabled()
+	c.RUnlock()
+	if disabled {
+		return "", errTopicsDisabled
+	}
+	raw := topicRaw(c)
+	c.RLock()
+	category := c.CreateTopicIn
+	c.RUnlock()
+	t := Topic{Title: title, Raw: raw, Category: category,
+		Tags: c.topicTags()}
+	if conf.DryRun {
+		logger.Infof("Dry run, not creating topic: %+v", t)
+		return topicUrl(TopicBody{Slug: "dry-run"}), nil
+	}
+	forum := activeForum()
+	u, err := forum.CreateTopic(t)
+	if err == errUnknownCategory {
+		hint := ""
+		if d, ok := forum.(*DiscourseClient); ok {
+			hint = d.categoryHint(category)
+		}
+		c.disableTopics(hint)
+	}
+	if err != nil {
+		return "", err
+	}
+	metrics.TopicCreated()
+	c.Lock()
+	c.digestTopics = append(c.digestTopics, u)
+	c.Unlock()
+	c.recordTopic(title, u)
+	return u, nil
+}
+
+// TopicError is returned when discourse doesn't create a topic, with what is
+// needed to find out why.
+type TopicError struct {
+	Title     string `json:"title"`
+	Category  string `json:"category"`
+	Status    int    `json:"status"`
+	Body      string `json:"body"`
+	RequestId string `json:"request_id,omitempty"`
+}
+
+// Error returns the details as JSON, so that they can be picked out of the
+// logs.
+func (e *TopicError) Error() string {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Sprintf("Discourse returned status %d", e.Status)
+	}
+	return "Discourse didn't create the topic: " + string(b)
+}
+
+// post sends v as JSON to posts.json, which creates topics as well as replies
+// to them.
+func (d *DiscourseClient) post(v interface{}) (*http.Response, error) {
+	bb := new(bytes.Buffer)
+	json.NewEncoder(bb).Encode(v)
+	body := bb.Bytes()
+	q := d.query("posts.json", "")
+	return doWithRetry(d.httpClient(), func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", q, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		d.setAuth(req)
+		return req, nil
+	})
+}
+
+func (d *DiscourseClient) CreateTopic(t Topic) (string, error) {
+	if t.Category != "" {
+		id, err := d.categoryId(t.Category)
+		if err != nil {
+			return "", err
 		}
-		return query, count
+		t.Category = id
+	}
+	res, err := d.post(t)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return "", err
+		}
+		return "", &TopicError{Title: t.Title, Category: t.Category,
+			Status: res.StatusCode, Body: string(body),
+			RequestId: res.Header.Get("X-Request-Id")}
+	}
+
+	dec := json.NewDecoder(res.Body)
+	var tb TopicBody
+	if err = dec.Decode(&tb); err != nil {
+		return "", err
+	}
+	return d.topicUrl(tb), nil
+}
+
+// Reply is a post added to an existing discourse topic.
+type Reply struct {
+	TopicId int    `json:"topic_id"`
+	Raw     string `json:"raw"`
+}
+
+// ReplyBody has the fields we need from the response to a reply.
+type ReplyBody struct {
+	TopicBody
+	PostNumber int `json:"post_number"`
+}
+
+// AddReply posts raw as a reply to the topic with the given id and returns
+// the url of the reply.
+func (d *DiscourseClient) AddReply(topicId int, raw string) (string, error) {
+	res, err := d.post(Reply{TopicId: topicId, Raw: raw})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("Discourse didn't add the reply to topic %d. Status: %d, body: %s",
+			topicId, res.StatusCode, body)
+	}
+
+	var rb ReplyBody
+	if err = json.NewDecoder(res.Body).Decode(&rb); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%d", d.topicUrl(rb.TopicBody), rb.PostNumber), nil
+}
+
+func (d *DiscourseClient) Search(query string, order string,
+	categories []string) ([]SearchResult, error) {
+	q := d.query("search.json", fmt.Sprintf("q=%s&order=%s",
+		url.QueryEscape(query), order))
+
+	var sr SearchResponse
+	if err := d.get(q, &sr); err != nil {
+		return nil, err
+	}
+	var res []SearchResult
+	// A topic is in the results once for every post in it that matches.
+	// Only the first is kept, so that the order discourse ranked them in
+	// stays.
+	seen := make(map[int]bool)
+	for _, t := range d.filterTopics(categories, sr.Topics) {
+		if seen[t.Id] {
+			continue
+		}
+		seen[t.Id] = true
+		title := t.Title
+		if title == "" {
+			title = t.Slug
+		}
+		res = append(res, SearchResult{Title: title,
+			Url: fmt.Sprintf("%s/t/%s/%d", d.Prefix, t.Slug, t.Id),
+			Stats: fmt.Sprintf("Views - %d, Replies - %d, Posts %d",
+				t.Views, t.Replies, t.Posts)})
+	}
+	return res, nil
+}
+
+// Reactor is implemented by clients which can react to messages.
+type Reactor interface {
+	AddReaction(channel string, ts string, name string) error
+}
+
+// Reaction added to the latest message as a hint.
+const hintReaction = "zipper_mouth_face"
+
+// giveHint adds a reaction to the latest message instead of sending the alert,
+// if reaction_hint is set and there hasn't been a hint yet. It returns false
+// if the alert should be sent, which is also the case if there haven't been
+// new messages since the hint.
+func giveHint(c *Counter, rtm RTM) bool {
+	reactor, ok := rtm.(Reactor)
+	c.Lock()
+	if !c.ReactionHint || !ok || c.lastTimestamp == "" {
+		c.Unlock()
+		return false
+	}
+	if c.hintTs != "" {
+		// The hint was ignored if there have been messages since.
+		escalate := c.hintTs != c.lastTimestamp
+		if escalate {
+			c.hintTs = ""
+		}
+		c.Unlock()
+		return !escalate
+	}
+	ts := c.lastTimestamp
+	c.hintTs = ts
+	c.Unlock()
+	if err := reactor.AddReaction(c.ChannelId, ts, hintReaction); err != nil {
+		logger.Warnf("Error while adding the hint, sending the alert. %s", err)
+		c.Lock()
+		c.hintTs = ""
+		c.Unlock()
+		return false
+	}
+	return true
+}
+
+const defaultEscalationMessage = "This channel has ignored my alerts for a while, could you help?"
+
+// Alerts are in a row if each is sent within this many cooldowns of the last
+// one. The count can't be used for this since every alert resets it.
+const streakCooldowns = 3
+
+// escalate counts the alert that was sent, and mentions the admins once
+// escalate_after alerts have been sent in a row.
+func escalate(c *Counter, rtm RTM) {
+	cooldown := c.nudgeCooldown()
+	c.Lock()
+	now := c.now()
+	if now.Sub(c.lastInRow) > streakCooldowns*cooldown {
+		c.nudgesInRow = 0
+	}
+	c.lastInRow = now
+	c.nudgesInRow++
+	due := c.EscalateAfter > 0 && c.nudgesInRow >= c.EscalateAfter
+	if due {
+		c.nudgesInRow = 0
+	}
+	msg := c.EscalationMessage
+	c.Unlock()
+	if !due {
+		return
+	}
+	if msg == "" {
+		msg = defaultEscalationMessage
+	}
+	adminsMu.RLock()
+	var mentions []string
+	for _, a := range admins {
+		mentions = append(mentions, mention(a))
+	}
+	adminsMu.RUnlock()
+	if len(mentions) > 0 {
+		msg = strings.Join(mentions, " ") + " " + msg
+	}
+	rtm.SendMessage(rtm.NewOutgoingMessage(msg, c.ChannelId))
+}
+
+var userIdRegex = regexp.MustCompile(`^[UW][A-Z0-9]+$`)
+
+// mention returns the markup mentioning the user, who is given by their slack
+// id or name.
+func mention(user string) string {
+	if conf.Platform != platformMattermost && userIdRegex.MatchString(user) {
+		return "<@" + user + ">"
+	}
+	return "@" + user
+}
+
+// sendMessage sends the alert once the count for the channel reaches MaxMsg.
+// If a forum is configured, a topic is created with the messages and linked
+// in the alert. Either way, the alert goes through callYoda which clears the
+// buckets, so the count starts afresh after every alert, even if creating the
+// topic failed.
+func sendMessage(c *Counter, rtm RTM) {
+	if giveHint(c, rtm) {
+		return
+	}
+	metrics.NudgeSent(c.ChannelId)
+	defer escalate(c, rtm)
+	msg := ""
+	if !c.topicsEnabled() {
+		callYoda(c, rtm, msg)
+		return
+	}
+	// Picking the first message in the bucket as the discourse topic.
+	first := c.firstMessage()
+	// The buckets could have been cleared after the count was checked, in
+	// which case there is nothing to create a topic with.
+	if first == "" {
+		callYoda(c, rtm, msg)
+		return
+	}
+	// The first message becomes the title.
+	url, err := createTopic(c, sanitizeTitle(first))
+	if err != nil {
+		logger.Warnf("Topic creation failed, posted nudge without link. %v",
+			err)
+		msg = errMsg
+	} else {
+		msg = fmt.Sprintf("Please move your discussion to %s", url)
+	}
+	nudge(c, rtm, msg, url)
+}
+
+func substituteUsernames(text string, memmap map[string]string) string {
+	// Older ids have U followed by 8 characters, newer ones can be longer and
+	// start with W for users in an enterprise grid.
+	userRegex, err := regexp.Compile(`<@[UW][A-Z0-9]+>`)
+	if err != nil {
+		logger.Errorf("Error while compiling user regex. %s", err)
+		return text
+	}
+
+	res := userRegex.FindAllString(text, -1)
+	if res == nil {
+		return text
+	}
+
+	for _, u := range res {
+		// extracting the userid
+		uid := u[2 : len(u)-1]
+		text = strings.Replace(text, u, "@"+username(uid, memmap), -1)
+	}
+	return text
+}
+
+// Slack markup in messages, like <#C1234|general>, <!here> and
+// <https://dgraph.io|dgraph>. Other text in angle brackets is left alone.
+var markupRegex = regexp.MustCompile(`<([#@!][^<>]*|[a-z][a-z0-9+.-]*:[^<>]*)>`)
+
+// Slack escapes these characters in the text of messages.
+var slackUnescaper = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+
+// stripFormatting converts the Slack markup in text to what it shows as, so
+// that it reads well in a topic. Channel links become #name, links become
+// their label or url and special mentions like <!here> become @here.
+func stripFormatting(text string) string {
+	text = markupRegex.ReplaceAllStringFunc(text, func(m string) string {
+		token := m[1 : len(m)-1]
+		label := ""
+		if idx := strings.Index(token, "|"); idx != -1 {
+			token, label = token[:idx], token[idx+1:]
+		}
+		switch token[0] {
+		case '#':
+			if label != "" {
+				return "#" + label
+			}
+			return token
+		case '@':
+			if label != "" {
+				return "@" + strings.TrimPrefix(label, "@")
+			}
+			return token
+		case '!':
+			// Like <!subteam^S1234|@eng> or <!date^1392734382^{date}|Feb 18>.
+			if label != "" {
+				return label
+			}
+			return "@" + strings.SplitN(token[1:], "^", 2)[0]
+		}
+		if label != "" {
+			return label
+		}
+		return strings.TrimPrefix(token, "mailto:")
+	})
+	return slackUnescaper.Replace(text)
+}
+
+// username returns the name of the user with id uid, or the id itself if we
+// don't know the user, e.g. if they are from a shared channel or joined after
+// the names were fetched.
+func username(uid string, memmap map[string]string) string {
+	if uname, ok := memmap[uid]; ok && uname != "" {
+		return uname
+	}
+	return uid
+}
+
+// parseTimestamp splits a slack timestamp, like 1503435956.000247, into
+// seconds and nanoseconds.
+func parseTimestamp(ts string) (int64, int64, error) {
+	parts := strings.SplitN(ts, ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) == 1 || parts[1] == "" {
+		return sec, 0, err
+	}
+	frac := parts[1]
+	if len(frac) > 9 {
+		frac = frac[:9]
+	}
+	nsec, err := strconv.ParseUint(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+	return sec, int64(nsec), err
+}
+
+// slot returns the bucket within a second for a message nsec nanoseconds into
+// it. It should be called with the lock held.
+func (c *Counter) slot(nsec int64) int64 {
+	if c.BucketGranularity == "" {
+		return 0
+	}
+	// It has been validated along with the config.
+	g, err := time.ParseDuration(c.BucketGranularity)
+	if err != nil || g <= 0 || g >= time.Second {
+		return 0
+	}
+	return nsec / int64(g)
+}
+
+// Increment increases the count for a bucket or adds a new bucket with the
+// weight of the message to the Counter c
+func (c *Counter) Increment(m *slack.Msg, memmap map[string]string) {
+	if m.Channel != c.ChannelId {
+		logger.Errorf("Channel mismatch, Expected: %s, Got: %s",
+			c.ChannelId, m.Channel)
+		return
+	}
+	ts, nsec, err := parseTimestamp(m.Timestamp)
+	if err != nil {
+		logger.Errorf("Error while parsing timestamp %q. %s", m.Timestamp, err)
+		return
+	}
+	c.RLock()
+	ignored := c.ignored(m.Text)
+	slot := c.slot(nsec)
+	c.RUnlock()
+	if ignored {
+		return
+	}
+	m.Text = stripFormatting(substituteUsernames(m.Text, memmap))
+	msg := BucketMsg{User: m.User, Name: username(m.User, memmap),
+		Text: m.Text, Timestamp: m.Timestamp}
+
+	metrics.MessageCounted(c.ChannelId)
+	c.Lock()
+	defer c.Unlock()
+	c.lastTimestamp = m.Timestamp
+	c.digestMsgs++
+	if t := time.Unix(ts, 0); t.After(c.lastMessage) {
+		c.lastMessage = t
+	}
+	// Messages mostly arrive in order, in which case the bucket is the last
+	// one or is appended. Otherwise it's inserted where it keeps the buckets
+	// sorted.
+	nb := Bucket{utime: ts, slot: slot}
+	idx := sort.Search(len(c.buckets), func(i int) bool {
+		return !c.buckets[i].before(nb)
+	})
+	if idx < len(c.buckets) && c.buckets[idx].utime == ts &&
+		c.buckets[idx].slot == slot {
+		b := &c.buckets[idx]
+		b.count += c.weight(m.Text)
+		b.msgs = append(b.msgs, msg)
+	} else {
+		c.buckets = append(c.buckets, Bucket{})
+		copy(c.buckets[idx+1:], c.buckets[idx:])
+		nb.count, nb.msgs = c.weight(m.Text), []BucketMsg{msg}
+		c.buckets[idx] = nb
+	}
+	max := c.MaxBufferedMsgs
+	if max == 0 {
+		max = defaultMaxBufferedMsgs
+	}
+	c.trimMessages(max)
+}
+
+const defaultMaxBufferedMsgs = 1000
+
+// trimMessages drops the oldest messages once more than max of them are kept
+// in the buckets. The counts of the buckets are left as they are, so that the
+// count stays accurate. It should be called with the lock held.
+func (c *Counter) trimMessages(max int) {
+	total := 0
+	for _, b := range c.buckets {
+		total += len(b.msgs)
+	}
+	for i := 0; total > max && i < len(c.buckets); i++ {
+		b := &c.buckets[i]
+		drop := total - max
+		if drop >= len(b.msgs) {
+			drop = len(b.msgs)
+			b.msgs = nil
+		} else {
+			// Copying so that the dropped messages can be collected.
+			b.msgs = append([]BucketMsg(nil), b.msgs[drop:]...)
+		}
+		total -= drop
+	}
+}
+
+// Message is a slack message along with the fields that the version of the
+// slack library that we vendor doesn't know about.
+type Message struct {
+	slack.Msg
+	// Timestamp of the parent message if the message is part of a thread.
+	// The RTM library drops this, so it is only set in socket mode and on
+	// mattermost. validateConfig rejects ignore_threads otherwise.
+	ThreadTimestamp string `json:"thread_ts,omitempty"`
+}
+
+// isThreadReply returns whether the message is a reply in a thread. The
+// parent message of a thread has its own timestamp as the thread timestamp.
+func (m *Message) isThreadReply() bool {
+	return m.ThreadTimestamp != "" && m.ThreadTimestamp != m.Timestamp
+}
+
+// Slack user id of wisemonk, fetched using auth.test at startup.
+var botUserId string
+
+// normalizeCommand replaces a leading mention of wisemonk in m with the
+// command prefix, so that "@wisemonk meditate for 10m" works the same as
+// "wisemonk meditate for 10m".
+func normalizeCommand(m string) string {
+	if botUserId == "" {
+		return m
+	}
+	t := strings.TrimLeft(m, " ")
+	mention := "<@" + botUserId
+	if !strings.HasPrefix(t, mention) {
+		return m
+	}
+	// The mention can also have the username, like <@U12345678|wisemonk>.
+	rest := t[len(mention):]
+	end := strings.Index(rest, ">")
+	if end == -1 || (end > 0 && rest[0] != '|') {
+		return m
+	}
+	return commandPrefix + " " + strings.TrimLeft(rest[end+1:], ": ")
+}
+
+// dispatch puts the message on the Counter it belongs to, if the channel is
+// being monitored. Messages from bots, including wisemonk, are dropped so that
+// they aren't counted. So are thread replies for channels which ignore them.
+func dispatch(m *Message) {
+	if m.BotID != "" || m.SubType == "bot_message" {
+		return
+	}
+	if botUserId != "" && m.User == botUserId {
+		return
+	}
+	c, ok := counterFor(m.Channel)
+	if !ok {
+		return
+	}
+	c.RLock()
+	ignoreThreads := c.IgnoreThreads
+	c.RUnlock()
+	if ignoreThreads && m.isThreadReply() {
+		return
+	}
+	c.messages <- &m.Msg
+}
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevels = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+func (l logLevel) String() string {
+	for name, lvl := range logLevels {
+		if lvl == l {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// Logger writes messages through the standard logger, dropping those below
+// its level.
+type Logger struct {
+	sync.RWMutex
+	level logLevel
+}
+
+var logger = &Logger{level: levelInfo}
+
+// SetLevel sets the level of the logger from its name. An empty name means
+// info.
+func (l *Logger) SetLevel(name string) error {
+	if name == "" {
+		name = "info"
+	}
+	lvl, ok := logLevels[name]
+	if !ok {
+		return fmt.Errorf("unknown log level %q", name)
+	}
+	l.Lock()
+	l.level = lvl
+	l.Unlock()
+	return nil
+}
+
+func (l *Logger) logf(lvl logLevel, format string, args ...interface{}) {
+	l.RLock()
+	min := l.level
+	l.RUnlock()
+	if lvl < min {
+		return
+	}
+	log.Printf("level=%s msg=%q", lvl, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(levelDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(levelInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(levelWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(levelError, format, args...)
+}
+
+// Fatalf logs irrespective of the level and exits. It should only be used
+// for errors at startup that wisemonk can't run without.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	log.Fatalf("level=fatal msg=%q", fmt.Sprintf(format, args...))
+}
+
+// Health tracks whether wisemonk is connected to slack and has started
+// handling messages for all the channels.
+type Health struct {
+	sync.RWMutex
+	connected bool
+	ready     bool
+}
+
+var health = &Health{}
+
+func (h *Health) SetConnected(connected bool) {
+	h.Lock()
+	defer h.Unlock()
+	h.connected = connected
+}
+
+func (h *Health) SetReady(ready bool) {
+	h.Lock()
+	defer h.Unlock()
+	h.ready = ready
+}
+
+// Handler returns the handler for the /healthz and /ready endpoints. They
+// return 503 until wisemonk is connected and ready respectively.
+func (h *Health) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h.RLock()
+		ok := h.connected
+		h.RUnlock()
+		writeHealth(w, ok)
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		h.RLock()
+		ok := h.ready
+		h.RUnlock()
+		writeHealth(w, ok)
+	})
+	return mux
+}
+
+func writeHealth(w http.ResponseWriter, ok bool) {
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ok\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// Metrics keeps track of what wisemonk has been up to, so that it can be
+// scraped by Prometheus.
+type Metrics struct {
+	sync.Mutex
+	// Messages counted, by channel.
+	messages map[string]int
+	// Alerts sent, by channel.
+	nudges        map[string]int
+	topicsCreated int
+	// Times the connection to slack was re-established after dropping.
+	reconnects int
+}
+
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{messages: make(map[string]int),
+		nudges: make(map[string]int)}
+}
+
+func (m *Metrics) MessageCounted(channel string) {
+	m.Lock()
+	defer m.Unlock()
+	m.messages[channel]++
+}
+
+func (m *Metrics) NudgeSent(channel string) {
+	m.Lock()
+	defer m.Unlock()
+	m.nudges[channel]++
+}
+
+func (m *Metrics) TopicCreated() {
+	m.Lock()
+	defer m.Unlock()
+	m.topicsCreated++
+}
+
+func (m *Metrics) Reconnected() {
+	m.Lock()
+	defer m.Unlock()
+	m.reconnects++
+}
+
+func (m *Metrics) Reconnects() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.reconnects
+}
+
+// writeByChannel writes the metric with a value for each channel, sorted by
+// channel so that the output is stable.
+func writeByChannel(w io.Writer, name string, typ string, help string,
+	values map[string]int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	var cids []string
+	for cid := range values {
+		cids = append(cids, cid)
+	}
+	sort.Strings(cids)
+	for _, cid := range cids {
+		fmt.Fprintf(w, "%s{channel=%q} %d\n", name, cid, values[cid])
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler(channels func() map[string]*Counter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		meditating := make(map[string]int)
+		lastMessage := make(map[string]int)
+		for cid, c := range channels() {
+			meditating[cid] = 0
+			if c.MeditationEnd() > 0 {
+				meditating[cid] = 1
+			}
+			if lm := c.LastMessage(); !lm.IsZero() {
+				lastMessage[cid] = int(lm.Unix())
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.Lock()
+		defer m.Unlock()
+		writeByChannel(w, "wisemonk_messages_total", "counter",
+			"Messages counted.", m.messages)
+		writeByChannel(w, "wisemonk_nudges_total", "counter",
+			"Alerts sent.", m.nudges)
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n",
+			"wisemonk_topics_created_total", "Discourse topics created.",
+			"wisemonk_topics_created_total", "wisemonk_topics_created_total",
+			m.topicsCreated)
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n",
+			"wisemonk_reconnects_total", "Reconnections to slack.",
+			"wisemonk_reconnects_total", "wisemonk_reconnects_total",
+			m.reconnects)
+		writeByChannel(w, "wisemonk_meditating", "gauge",
+			"Whether wisemonk is meditating.", meditating)
+		writeByChannel(w, "wisemonk_last_message_timestamp_seconds", "gauge",
+			"Unix time of the latest message counted.", lastMessage)
+	})
+}
+
+const defaultHealthPort = 8080
+
+// serveHealth serves the health check and metrics endpoints on the configured
+// port.
+func serveHealth() {
+	port := conf.HealthPort
+	if port == 0 {
+		port = defaultHealthPort
+	}
+	addr := fmt.Sprintf(":%d", port)
+	mux := http.NewServeMux()
+	mux.Handle("/", health.Handler())
+	mux.Handle("/metrics", metrics.Handler(channels))
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Errorf("Error while serving health checks on %s. %s", addr, err)
+	}
+}
+
+// How long we wait for the first RTM connection before giving up.
+const connectTimeout = 2 * time.Minute
+
+// waitForConnection reads events till the first connection to slack is
+// established, so that the channels are only started once the token works.
+// It returns an error if the token is invalid or no connection is made within
+// timeout.
+func waitForConnection(events <-chan slack.RTMEvent,
+	timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case msg, ok := <-events:
+			if !ok {
+				return errors.New("RTM events channel closed")
+			}
+			switch ev := msg.Data.(type) {
+			case *slack.ConnectedEvent:
+				health.SetConnected(true)
+				return nil
+			case *slack.ConnectionErrorEvent:
+				logger.Warnf("Error while connecting to slack, attempt %d. %s",
+					ev.Attempt, ev.Error())
+			case *slack.InvalidAuthEvent:
+				return errors.New("Invalid credentials, couldn't connect to slack")
+			}
+		case <-deadline:
+			return fmt.Errorf("Couldn't connect to slack in %v", timeout)
+		}
+	}
+}
+
+// startChannels starts every channel in cs with start, once the first
+// connection to slack has been made on events. events is nil on the other
+// platforms, whose sources connect when they start listening. Nothing is
+// started if the connection can't be made.
+func startChannels(events <-chan slack.RTMEvent, timeout time.Duration,
+	cs map[string]*Counter, start func(c *Counter)) error {
+	if events != nil {
+		if err := waitForConnection(events, timeout); err != nil {
+			return err
+		}
+	}
+	for _, c := range cs {
+		start(c)
+	}
+	return nil
+}
+
+// handleEvents handles the events from the RTM connection till events is
+// closed. ManageConnection reconnects with a backoff when the connection
+// drops, so apart from invalid credentials the errors here are only logged.
+func handleEvents(events <-chan slack.RTMEvent) {
+	// This has been mostly picked up from
+	// https://github.com/nlopes/slack/blob/master/examples/websocket/websocket.go
+	for msg := range events {
+		switch ev := msg.Data.(type) {
+		case *slack.ConnectedEvent:
+			health.SetConnected(true)
+			if ev.ConnectionCount > 1 {
+				metrics.Reconnected()
+				logger.Infof("Reconnected to slack, connection %d.",
+					ev.ConnectionCount)
+			}
+		case *slack.DisconnectedEvent:
+			health.SetConnected(false)
+			if !ev.Intentional {
+				logger.Warnf("Disconnected from slack. Reconnecting.")
+			}
+		case *slack.ConnectionErrorEvent:
+			logger.Warnf("Error while connecting to slack, attempt %d. %s",
+				ev.Attempt, ev.Error())
+		case *slack.MessageEvent:
+			dispatch(&Message{Msg: ev.Msg})
+		case *slack.RTMError:
+			logger.Errorf("RTM error. %s", ev.Error())
+		case *slack.InvalidAuthEvent:
+			logger.Fatalf("Invalid credentails")
+		}
+	}
+}
+
+// summarize creates a topic with the messages from a discussion that has
+// ended, so that it is on record, and shares its url with the channel.
+func summarize(c *Counter, rtm RTM) {
+	if !c.topicsEnabled() {
+		return
+	}
+	first := c.firstMessage()
+	if first == "" {
+		return
+	}
+	url, err := createTopic(c, sanitizeTitle(first))
+	if err != nil {
+		logger.Errorf("Error while creating summary topic: %v", err)
+		return
+	}
+	c.clearBuckets()
+	rtm.SendMessage(rtm.NewOutgoingMessage(
+		"The discussion has been saved to "+url, c.ChannelId))
+}
+
+// Replier is implemented by forums which can add the messages to an existing
+// topic.
+type Replier interface {
+	AddReply(topicId int, raw string) (string, error)
+}
+
+// parseTopicId returns the id of the discourse topic given either by its url,
+// like https://discuss.dgraph.io/t/slug/12 (optionally followed by the post
+// number), or just its id.
+func parseTopicId(topic string) (int, error) {
+	// Slack wraps urls in angle brackets, possibly with a label.
+	topic = strings.Trim(strings.TrimSpace(topic), "<>")
+	if idx := strings.Index(topic, "|"); idx != -1 {
+		topic = topic[:idx]
+	}
+	if id, err := strconv.Atoi(topic); err == nil && id > 0 {
+		return id, nil
+	}
+
+	prefix := strings.TrimSuffix(conf.DiscPrefix, "/") + "/t/"
+	if !strings.HasPrefix(topic, prefix) {
+		return 0, fmt.Errorf("%s is not a topic on %s", topic, conf.DiscPrefix)
+	}
+	// The path is slug/id, or slug/id/post_number.
+	parts := strings.Split(strings.Trim(topic[len(prefix):], "/"), "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("%s is not a topic url", topic)
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("%s is not a topic url", topic)
+	}
+	return id, nil
+}
+
+// appendToTopic adds the messages to the topic that wisemonk was asked to
+// append them to.
+func appendToTopic(c *Counter, m string, rtm RTM) {
+	if !c.forumEnabled() {
+		return
+	}
+	res := appendRegex.FindStringSubmatch(m)
+	if res == nil {
+		return
+	}
+
+	reply := func(msg string) {
+		rtm.SendMessage(rtm.NewOutgoingMessage(msg, c.ChannelId))
+	}
+	r, ok := activeForum().(Replier)
+	if !ok {
+		reply("Sorry, I can't add messages to topics on this forum.")
+		return
+	}
+	id, err := parseTopicId(res[1])
+	if err != nil {
+		reply("Sorry, I don't understand which topic that is.")
+		return
+	}
+	if c.firstMessage() == "" {
+		reply("There are no messages to add.")
+		return
+	}
+	if conf.DryRun {
+		logger.Infof("Dry run, not adding to topic %d: %s", id, topicRaw(c))
+		return
+	}
+
+	url, err := r.AddReply(id, topicRaw(c))
+	if err != nil {
+		logger.Errorf("Error while adding to topic: %v", err)
+		reply(errMsg)
+		return
+	}
+	c.clearBuckets()
+	reply("Messages added to " + formatLink(url, "the topic"))
+}
+
+// This function checks if wisemonk was asked to create a topic. If he ways,
+// it creates a new topic and returns its url.
+func createNewTopic(c *Counter, m string, rtm RTM) {
+	if !c.forumEnabled() {
+		return
+	}
+
+	res := createRegex.FindStringSubmatch(m)
+	if res == nil {
+		return
+	}
+
+	title := sanitizeTitle(res[1])
+	url, err := createTopic(c, title)
+	if err != nil {
+		logger.Errorf("Error while creating topic: %v", err)
+		msg := errMsg
+		if err == errTopicsDisabled || err == errUnknownCategory {
+			msg = "Sorry, topics can't be created for this channel."
+		}
+		rtm.SendMessage(rtm.NewOutgoingMessage(msg, c.ChannelId))
+		return
+	}
+	c.clearBuckets()
+
+	msg := "New topic created: " + formatLink(url, title)
+	rtm.SendMessage(rtm.NewOutgoingMessage(msg,
+		c.ChannelId))
+}
+
+// formatLink returns a link to url showing text, in the markup of the chat
+// platform.
+func formatLink(url string, text string) string {
+	if conf.Platform == platformMattermost {
+		return fmt.Sprintf("[%s](%s)", text, url)
+	}
+	// Slack links can't have these in their text.
+	text = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;",
+		"|", "-").Replace(text)
+	return fmt.Sprintf("<%s|%s>", url, text)
+}
+
+// Durations that are asked for in words.
+var durationPhrases = map[string]time.Duration{
+	"half an hour":       30 * time.Minute,
+	"half hour":          30 * time.Minute,
+	"quarter of an hour": 15 * time.Minute,
+	"quarter hour":       15 * time.Minute,
+	"an hour":            time.Hour,
+	"a minute":           time.Minute,
+}
+
+var durationUnits = map[string]time.Duration{
+	"s": time.Second, "sec": time.Second, "secs": time.Second,
+	"second": time.Second, "seconds": time.Second,
+	"m": time.Minute, "min": time.Minute, "mins": time.Minute,
+	"minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hr": time.Hour, "hrs": time.Hour,
+	"hour": time.Hour, "hours": time.Hour,
+}
+
+var durationPartRegex = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?) ?([a-z]+)$`)
+
+// parseDuration parses durations the way people ask for them, like 30
+// minutes, 1 hour and 15 mins or half an hour. Anything else is parsed by
+// time.ParseDuration.
+func parseDuration(s string) (time.Duration, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if d, ok := durationPhrases[s]; ok {
+		return d, nil
+	}
+	// The number and unit pairs, e.g. 1 hour and 15 mins.
+	words := strings.Fields(strings.Replace(s, ",", " ", -1))
+	var total time.Duration
+	var parts int
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		if w == "and" && parts > 0 && i+1 < len(words) {
+			continue
+		}
+		if i+1 < len(words) && durationUnits[words[i+1]] != 0 {
+			w += " " + words[i+1]
+			i++
+		}
+		m := durationPartRegex.FindStringSubmatch(w)
+		if m == nil || durationUnits[m[2]] == 0 {
+			return time.ParseDuration(s)
+		}
+		n, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			return time.ParseDuration(s)
+		}
+		total += time.Duration(n * float64(durationUnits[m[2]]))
+		parts++
+	}
+	if parts == 0 {
+		return time.ParseDuration(s)
+	}
+	return total, nil
+}
+
+// This function checks if wisemonk was asked to meditate by matching the
+// message against a regex. If the message was a valid command then wisemonk
+// stops sending messages for the specified duration and lets the channel know
+// once he is back.
+func askToMeditate(c *Counter, rtm RTM, m string) string {
+	res := meditateRegex.FindStringSubmatch(m)
+	if res == nil {
+		return ""
+	}
+
+	// Captured time is available at the first index. The duration can be
+	// a phrase like 30 minutes, or anything that time.ParseDuration accepts.
+	d, err := parseDuration(res[1])
+	if err != nil {
+		return "Sorry, I don't understand you."
+	}
+
+	if d < 0 {
+		return "Sorry, going back in time is not what I can do."
+	}
+
+	if max := c.maxMeditation(); d >= max {
+		if max == time.Hour {
+			return "It's hard to meditate for more than an hour at one go you know."
+		}
+		return fmt.Sprintf("It's hard to meditate for more than %s at one go you know.",
+			max)
+	}
+
+	if d := c.MeditationEnd(); d > 0 {
+		return fmt.Sprintf("I am meditating. My meditation will finish in %s",
+			formatRemaining(d))
+	}
+
+	c.SetMeditationEnd(d)
+	go wakeAfter(c, rtm, d, c.wakeChan())
+	return fmt.Sprintf("Okay, I am going to meditate for %s", d)
+}
+
+// This function checks if wisemonk was asked to be quiet. If so, he stops
+// alerting for the duration but keeps replying to commands.
+func beQuiet(c *Counter, m string, rtm RTM) {
+	res := quietRegex.FindStringSubmatch(m)
+	if res == nil {
+		return
+	}
+
+	msg := ""
+	d, err := parseDuration(res[1])
+	switch {
+	case err != nil:
+		msg = "Sorry, I don't understand you."
+	case d < 0:
+		msg = "Sorry, going back in time is not what I can do."
+	case d >= c.maxMeditation():
+		msg = fmt.Sprintf("Sorry, I can't stay quiet for more than %s.",
+			c.maxMeditation())
+	default:
+		c.SetQuiet(d)
+		msg = fmt.Sprintf("Okay, I won't alert for %s. I'll still answer commands.", d)
+	}
+	rtm.SendMessage(rtm.NewOutgoingMessage(msg, c.ChannelId))
+}
+
+// This function sets the maxmsg for the channel, if asked to. It stays till
+// wisemonk is restarted or the config is reloaded.
+func setMaxMsg(c *Counter, m string, rtm RTM) {
+	res := setMaxRegex.FindStringSubmatch(m)
+	if res == nil {
+		return
+	}
+
+	msg := ""
+	n, err := strconv.Atoi(strings.TrimSpace(res[1]))
+	if err != nil || n <= 0 {
+		msg = "Sorry, maxmsg should be a positive number."
+	} else {
+		c.Lock()
+		c.MaxMsg = n
+		c.Unlock()
+		msg = fmt.Sprintf("Okay, I will alert after %d messages.", n)
+	}
+	rtm.SendMessage(rtm.NewOutgoingMessage(msg, c.ChannelId))
+}
+
+// Topics listed by the stats command if it isn't given a count.
+const defaultStatsCount = 5
+
+// reportStats replies with the last topics that wisemonk created for the
+// channel.
+func reportStats(c *Counter, m string, rtm RTM) {
+	res := statsRegex.FindStringSubmatch(m)
+	if res == nil {
+		return
+	}
+
+	n := defaultStatsCount
+	if res[1] != "" {
+		// The regex only matches digits, so only overflow can fail.
+		if v, err := strconv.Atoi(res[1]); err == nil && v > 0 {
+			n = v
+		}
+	}
+	topics := c.recentTopics(n)
+	if len(topics) == 0 {
+		rtm.SendMessage(rtm.NewOutgoingMessage(
+			"I haven't created any topics for this channel yet.", c.ChannelId))
+		return
+	}
+	msg := fmt.Sprintf("The last %d topics I created for this channel:",
+		len(topics))
+	for _, t := range topics {
+		msg += fmt.Sprintf("\n%s on %s", formatLink(t.Url, t.Title),
+			t.Created.UTC().Format("Jan 2, 2006"))
+	}
+	rtm.SendMessage(rtm.NewOutgoingMessage(msg, c.ChannelId))
+}
+
+// formatRemaining formats the remaining meditation time to the second, e.g.
+// 30s or 4m30s. Anything less than a second is shown as 1s.
+func formatRemaining(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d < time.Second {
+		d = time.Second
+	}
+	return d.String()
+}
+
+// wakeAfter ends the meditation of wisemonk after duration d, unless he is
+// woken up before that by closing wake.
+func wakeAfter(c *Counter, rtm RTM, d time.Duration, wake <-chan struct{}) {
+	select {
+	case <-c.getClock().After(d):
+	case <-wake:
+		return
+	}
+	// We clear the buckets when wisemonk wakes up from his meditation.
+	c.clearBuckets()
+	rtm.SendMessage(rtm.NewOutgoingMessage(wakeMsg, c.ChannelId))
+}
+
+// This function checks if wisemonk was asked to wake up. If he was meditating,
+// the meditation is ended right away.
+func wakeUp(c *Counter, m string, rtm RTM) {
+	if !wakeRegex.MatchString(m) {
+		return
+	}
+
+	msg := "I am not meditating."
+	if c.WakeUp() {
+		c.clearBuckets()
+		msg = "I'm awake now."
+	}
+	rtm.SendMessage(rtm.NewOutgoingMessage(msg, c.ChannelId))
+}
+
+// This function checks if wisemonk was asked for his status. If he was, he
+// replies with the message count for the interval and whether he is
+// meditating.
+func reportStatus(c *Counter, m string, rtm RTM) {
+	if !statusRegex.MatchString(m) {
+		return
+	}
+
+	count := c.Count()
+	c.RLock()
+	msg := fmt.Sprintf("Messages in the last %s: %d, Max messages: %d. ",
+		c.Interval, count, c.MaxMsg)
+	c.RUnlock()
+	if d := c.MeditationEnd(); d > 0 {
+		msg += fmt.Sprintf("I am meditating for another %s.",
+			formatRemaining(d))
+	} else {
+		msg += "I am not meditating."
+	}
+	if d := c.QuietRemaining(); d > 0 {
+		msg += fmt.Sprintf(" I am quiet for another %s.", formatRemaining(d))
+	}
+	if lm := c.LastMessage(); lm.IsZero() {
+		msg += " No messages since I started."
+	} else {
+		msg += fmt.Sprintf(" The last message was %s ago.",
+			formatRemaining(c.now().Sub(lm)))
+	}
+	rtm.SendMessage(rtm.NewOutgoingMessage(msg, c.ChannelId))
+}
+
+// channelName returns the name of the channel with id cid, or the id if the
+// name can't be found.
+func channelName(cid string) string {
+	if namer == nil {
+		return cid
+	}
+	n, err := namer.ChannelName(cid)
+	if err != nil {
+		logger.Warnf("Error while fetching name of %s. %s", cid, err)
+		return cid
+	}
+	return "#" + n
+}
+
+// listChannels replies with the channels being monitored and their settings.
+func listChannels(c *Counter, m string, rtm RTM) {
+	if !channelsRegex.MatchString(m) {
+		return
+	}
+
+	cs := channels()
+	var cids []string
+	for cid := range cs {
+		cids = append(cids, cid)
+	}
+	sort.Strings(cids)
+	var buf bytes.Buffer
+	for _, cid := range cids {
+		name := channelName(cid)
+		ch := cs[cid]
+		ch.RLock()
+		fmt.Fprintf(&buf, "%s (%s): interval %s, maxmsg %d", name, cid,
+			ch.Interval, ch.MaxMsg)
+		if ch.CreateTopicIn != "" {
+			fmt.Fprintf(&buf, ", topics in %s", ch.CreateTopicIn)
+		}
+		ch.RUnlock()
+		buf.WriteString("\n")
+	}
+	rtm.SendMessage(rtm.NewOutgoingMessage(buf.String(), c.ChannelId))
+}
+
+// previewTopic replies with the body of the topic that would be created with
+// the recent messages, without creating it. The reply is sent in the thread
+// of the last message where possible, to keep the channel readable.
+func previewTopic(c *Counter, m string, rtm RTM) {
+	if !previewRegex.MatchString(m) {
+		return
+	}
+
+	if c.transcript() == "" {
+		rtm.SendMessage(rtm.NewOutgoingMessage(
+			"There are no messages to create a topic with.", c.ChannelId))
+		return
+	}
+	msg := rtm.NewOutgoingMessage(topicRaw(c), c.ChannelId)
+	c.RLock()
+	threadTs := c.lastTimestamp
+	c.RUnlock()
+	if tr, ok := rtm.(ThreadReplier); ok && threadTs != "" {
+		tr.SendThreadReply(msg, threadTs)
+		return
+	}
+	rtm.SendMessage(msg)
+}
+
+// This function checks if wisemonk was asked for help. If he was, he replies
+// with the list of commands he understands.
+func sendHelp(c *Counter, m string, rtm RTM) {
+	if !helpRegex.MatchString(m) {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("Here is what I understand:\n")
+	for _, h := range commandHelp {
+		fmt.Fprintf(&buf, "`%s %s` - %s\n", commandPrefix, h.usage, h.desc)
+	}
+	rtm.SendMessage(rtm.NewOutgoingMessage(buf.String(), c.ChannelId))
+}
+
+type SearchTopic struct {
+	Id       int    `json:"id"`
+	Title    string `json:"title"`
+	Slug     string `json:"slug"`
+	Category int    `json:"category_id"`
+	Replies  int    `json:"reply_count"`
+	Posts    int    `json:"posts_count"`
+	Views    int    `json:"views"`
+}
+
+type SearchResponse struct {
+	Topics []SearchTopic `json:"topics"`
+}
+
+// filterTopics returns the topics which are in any of the searchOver
+// categories.
+func (d *DiscourseClient) filterTopics(searchOver []string,
+	topics []SearchTopic) []SearchTopic {
+	// No categories to search over means that all of them are searched.
+	if len(searchOver) == 0 {
+		return topics
+	}
+
+	var filteredTopics []SearchTopic
+	for idx, t := range topics {
+		keep := false
+		for _, cat := range searchOver {
+			if d.cats.slug(t.Category) == cat {
+				keep = true
+				break
+			}
+		}
+		if keep {
+			filteredTopics = append(filteredTopics, topics[idx])
+		}
+	}
+	return filteredTopics
+}
+
+const defaultMaxSearchResults = 10
+
+// searchResultsLimit returns the most results that a search can return.
+func searchResultsLimit() int {
+	if conf.MaxSearchResults > 0 {
+		return conf.MaxSearchResults
+	}
+	return defaultMaxSearchResults
+}
+
+// Orders that discourse can sort search results by.
+var searchOrders = []string{"views", "latest", "likes"}
+
+const defaultSearchOrder = "views"
+
+// Given after the count, or the order, to search all the categories instead
+// of just the search_over ones of the channel.
+const searchAll = "all"
+
+func validSearchOrder(order string) bool {
+	for _, o := range searchOrders {
+		if o == order {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSearchQuery returns the query, the number of results and the order of
+// the results asked for in the message, and whether all the categories should
+// be searched.
+func parseSearchQuery(m string) (string, int, string, bool) {
+	var query string
+	var count int
+
+	res := queryCountRegex.FindStringSubmatch(m)
+	if res == nil {
+		// TODO(pawan) - Get all info from just one regex.
+		match := queryRegex.FindStringSubmatch(m)
+		if match != nil {
+			// Default value of count is kept as 3.
+			return match[1], 3, defaultSearchOrder, false
+		}
+		return query, count, "", false
+	}
+
+	query = res[1]
+	var err error
+	count, err = strconv.Atoi(res[2])
+	if err != nil {
+		count = 3
+	}
+	order := res[3]
+	all := res[4] == searchAll
+	// all without an order is matched as the order.
+	if order == searchAll && !all {
+		order, all = "", true
+	}
+	if order == "" {
+		order = defaultSearchOrder
+	}
+	return query, count, order, all
+}
+
+func searchDiscourse(c *Counter, m string, rtm RTM) {
+	if !c.forumEnabled() {
+		return
+	}
+
+	query, maxResults, order, all := parseSearchQuery(m)
+	if query == "" {
+		return
+	}
+	if !validSearchOrder(order) {
+		rtm.SendMessage(rtm.NewOutgoingMessage(fmt.Sprintf(
+			"Sorry, I can only order results by %s.",
+			strings.Join(searchOrders, ", ")), c.ChannelId))
+		return
+	}
+	if maxResults < 0 {
+		rtm.SendMessage(rtm.NewOutgoingMessage(
+			"Sorry, I can't find less than zero topics.", c.ChannelId))
+		return
+	}
+	if maxResults == 0 {
+		rtm.SendMessage(rtm.NewOutgoingMessage(
+			"Okay, I won't look for any topics then.", c.ChannelId))
+		return
+	}
+	if max := searchResultsLimit(); maxResults > max {
+		maxResults = max
+	}
+
+	// Topics in any of the search_over categories are returned, or in all
+	// of them if asked for.
+	var searchOver []string
+	if !all {
+		c.RLock()
+		searchOver = c.SearchOver
+		c.RUnlock()
+	}
+	results, err := activeForum().Search(query, order, searchOver)
+	if err != nil {
+		logger.Errorf("Error while searching discourse: %v", err)
+		rtm.SendMessage(rtm.NewOutgoingMessage(errMsg, c.ChannelId))
+		return
+	}
+	// Picking just the top maxResults topics
+	if len(results) > maxResults {
+		results = results[:maxResults]
+	}
+	var buf bytes.Buffer
+	for _, r := range results {
+		buf.WriteString(fmt.Sprintf("%s — %s (%s)\n", r.Title, r.Url,
+			r.Stats))
+	}
+	if buf.Len() > 0 {
+		rtm.SendMessage(rtm.NewOutgoingMessage(buf.String(), c.ChannelId))
+	} else {
+		rtm.SendMessage(rtm.NewOutgoingMessage("Sorry, I didn't find anything.",
+			c.ChannelId))
+	}
+}
+
+// command is a command that wisemonk understands, handled by handle when a
+// message matches re.
+type command struct {
+	name string
+	// Pointer since the regexes are compiled again if the command prefix
+	// changes.
+	re     **regexp.Regexp
+	handle func(c *Counter, m string, rtm RTM)
+	// Whether only admins can use the command, if any are configured.
+	admin bool
+}
+
+// Commands in the order that they are tried in.
+var commands = []command{
+	{"query", &queryRegex, searchDiscourse, false},
+	{"create", &createRegex, createNewTopic, false},
+	{"append", &appendRegex, appendToTopic, false},
+	{"preview", &previewRegex, previewTopic, false},
+	{"status", &statusRegex, reportStatus, false},
+	{"stats", &statsRegex, reportStats, false},
+	{"channels", &channelsRegex, listChannels, true},
+	{"help", &helpRegex, sendHelp, false},
+	{"wake", &wakeRegex, wakeUp, true},
+	{"quiet", &quietRegex, beQuiet, true},
+	{"set maxmsg", &setMaxRegex, setMaxMsg, true},
+	{"meditate", &meditateRegex, meditate, true},
+}
+
+// Guards admins, which can change when the config is reloaded.
+var adminsMu sync.RWMutex
+
+// Slack user ids or names of the users who can use admin commands. Anyone
+// can use them if it is empty.
+var admins []string
+
+func setAdmins(a []string) {
+	adminsMu.Lock()
+	admins = a
+	adminsMu.Unlock()
+}
+
+// isAdmin returns whether the user with the given id and name can use admin
+// commands.
+func isAdmin(id, name string) bool {
+	adminsMu.RLock()
+	defer adminsMu.RUnlock()
+	if len(admins) == 0 {
+		return true
+	}
+	for _, a := range admins {
+		if a == id || (name != "" && a == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// findCommand returns the first command that m matches, or nil if it isn't a
+// command.
+func findCommand(m string) *command {
+	for i := range commands {
+		if (*commands[i].re).MatchString(m) {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// handleCommand handles m, sent by the user with the given id and name, if it
+// is a command. It returns whether it was one.
+func handleCommand(c *Counter, m, user, name string, rtm RTM) bool {
+	cmd := findCommand(m)
+	if cmd == nil {
+		return false
+	}
+	if cmd.admin && !isAdmin(user, name) {
+		rtm.SendMessage(rtm.NewOutgoingMessage(
+			"You're not allowed to do that.", c.ChannelId))
+		return true
+	}
+	cmd.handle(c, m, rtm)
+	return true
+}
+
+// meditate replies to a request to meditate.
+func meditate(c *Counter, m string, rtm RTM) {
+	if reply := askToMeditate(c, rtm, m); reply != "" {
+		rtm.SendMessage(rtm.NewOutgoingMessage(reply, c.ChannelId))
+	}
+}
+
+// Number of messages remembered for dropping the ones which are delivered
+// again.
+const recentMsgsSize = 500
+
+// recentMsgs remembers the last few messages seen, so that messages which
+// slack delivers again, e.g. after a reconnect, aren't counted twice.
+type recentMsgs struct {
+	keys []string
+	// Where the next key goes in keys, overwriting the oldest one.
+	next int
+	seen map[string]bool
+}
+
+func newRecentMsgs(size int) *recentMsgs {
+	return &recentMsgs{keys: make([]string, size), seen: make(map[string]bool)}
+}
+
+// add remembers the message and returns false if it was seen already. A
+// message is identified by its sender and timestamp, the timestamp being
+// unique within a channel.
+func (r *recentMsgs) add(m *slack.Msg) bool {
+	key := m.User + "/" + m.Timestamp
+	if r.seen[key] {
+		return false
+	}
+	delete(r.seen, r.keys[r.next])
+	r.keys[r.next] = key
+	r.seen[key] = true
+	r.next = (r.next + 1) % len(r.keys)
+	return true
+}
+
+// checkOrIncr handles the messages for the counter and periodically checks if
+// an alert needs to be sent. It returns once done is closed.
+func (c *Counter) checkOrIncr(rtm RTM, wg *sync.WaitGroup,
+	users *userCache, done <-chan struct{}) {
+	defer wg.Done()
+	ticker := c.getClock().NewTicker(time.Second * 10)
+	defer ticker.Stop()
+	recent := newRecentMsgs(recentMsgsSize)
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-c.stop:
+			return
+		case msg := <-c.messages:
+			if !recent.add(msg) {
+				logger.Debugf("Dropping message %s delivered again.",
+					msg.Timestamp)
+				continue
+			}
+			memmap := users.Names()
+			// Commands aren't counted.
+			if handleCommand(c, normalizeCommand(msg.Text), msg.User,
+				memmap[msg.User], rtm) {
+				continue
+			}
+			// If we receive a message on the channel, we increment
+			// the counter.
+			c.Increment(msg, memmap)
+		case <-ticker.C():
+			// We perform this check only if the monk is not meditating.
+			if c.nudgeDue() {
+				go sendMessage(c, rtm)
+			} else if c.shouldSummarize(c.now()) {
+				go summarize(c, rtm)
+			}
+			if ts, topicUrl, ok := c.tidyDue(); ok {
+				go tidyNudge(c, rtm, ts, topicUrl)
+			}
+		}
+	}
+}
+
+type Members struct {
+	Users []Member `json:"members"`
+}
+
+type Member struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Initial wait before retrying a failed call. It is doubled after every
+// attempt.
+var retryBackoff = time.Second
+
+// doWithRetry sends the request returned by newReq using hc. On connection
+// errors and 5xx responses the request is retried with exponential backoff up
+// to maxRetries times. 429 responses are retried after the time asked for in
+// their Retry-After header. Other responses, including other 4xx, are returned
+// right away. Only the discourse calls are retried, since a retried post to
+// slack or mattermost could show up twice.
+func doWithRetry(hc *http.Client,
+	newReq func() (*http.Request, error)) (*http.Response, error) {
+	backoff := retryBackoff
+	var waited time.Duration
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := hc.Do(req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError &&
+			resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+		if attempt >= maxRetries {
+			return resp, err
+		}
+
+		wait := backoff
+		if err == nil {
+			if d, ok := retryAfter(resp); ok {
+				wait = d
+			}
+		}
+		if waited+wait > maxRetryWait {
+			return resp, err
+		}
+		if err != nil {
+			logger.Warnf("Url: %s. Error: %v. Retrying in %v", req.URL, err,
+				wait)
+		} else {
+			logger.Warnf("Url: %s. Status: %v. Retrying in %v", req.URL,
+				resp.Status, wait)
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		time.Sleep(wait)
+		waited += wait
+		backoff *= 2
+	}
+}
+
+// Most time that doWithRetry waits between the attempts for a request, so
+// that a rate limited call doesn't block for too long.
+var maxRetryWait = time.Minute
+
+// retryAfter returns how long the Retry-After header of resp asks us to wait
+// for. ok is false if it isn't set.
+func retryAfter(resp *http.Response) (d time.Duration, ok bool) {
+	h := resp.Header.Get("Retry-After")
+	if h == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(h); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		if d = time.Until(t); d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+func runQueryAndParseResponse(q string, data interface{}) error {
+	resp, err := client.Get(q)
+	return parseResponse(q, resp, err, data)
+}
+
+// getAndParse sends a GET request to q using hc, after passing it to prepare
+// if it isn't nil, and parses the JSON response into data. Failed requests
+// are retried.
+func getAndParse(hc *http.Client, q string, prepare func(*http.Request),
+	data interface{}) error {
+	resp, err := doWithRetry(hc, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		if prepare != nil {
+			prepare(req)
+		}
+		return req, nil
+	})
+	return parseResponse(q, resp, err, data)
+}
+
+// parseResponse parses the JSON body of resp, the response to q, into data.
+// err is the error from sending the request.
+func parseResponse(q string, resp *http.Response, err error,
+	data interface{}) error {
+	if err != nil {
+		return fmt.Errorf("Url: %s. Error: %v", q, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Url: %s. Status: %v", q, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Url: %s. Error: %v", q, err)
+	}
+
+	ct := resp.Header.Get("Content-Type")
+	if len(bytes.TrimSpace(body)) == 0 {
+		return fmt.Errorf("Url: %s. Empty response with content type %q", q, ct)
+	}
+	if err := json.Unmarshal(body, data); err != nil {
+		return fmt.Errorf("Url: %s. Invalid JSON with content type %q: %v. Body: %s",
+			q, ct, err, bodySnippet(body))
+	}
+	return nil
+}
+
+// Length of the part of a response that is shown in errors.
+const snippetLen = 200
+
+// bodySnippet returns the start of body on a single line, so that an HTML
+// error page doesn't flood the logs.
+func bodySnippet(body []byte) string {
+	s := strings.Join(strings.Fields(string(body)), " ")
+	if t := truncateRunes(s, snippetLen); t != s {
+		return t + "..."
+	}
+	return s
+}
+
+const (
+	modeRTM    = "rtm"
+	modeSocket = "socket"
+)
+
+const (
+	platformSlack      = "slack"
+	platformMattermost = "mattermost"
+	// Messages are read from stdin and replies written to stdout, so that
+	// wisemonk can be tried out without a workspace.
+	platformStdin = "stdin"
+)
+
+// webClient sends messages using the Slack Web API. It is used in socket mode
+// where we don't have an RTM connection to send messages on.
+type webClient struct {
+	token string
+}
+
+func (w *webClient) NewOutgoingMessage(text string,
+	channel string) *slack.OutgoingMessage {
+	return &slack.OutgoingMessage{Text: text, Channel: channel,
+		Type: "message"}
+}
+
+func (w *webClient) SendMessage(msg *slack.OutgoingMessage) {
+	w.SendThreadReply(msg, "")
+}
+
+func (w *webClient) SendThreadReply(msg *slack.OutgoingMessage,
+	threadTs string) {
+	w.SendBlocks(msg, nil, threadTs)
+}
+
+func (w *webClient) SendBlocks(msg *slack.OutgoingMessage, blocks []block,
+	threadTs string) {
+	if _, err := w.PostMessage(msg, blocks, threadTs); err != nil {
+		logger.Errorf("Error while sending message: %v", err)
+	}
+}
+
+type postMessageResponse struct {
+	slackResponse
+	Ts string `json:"ts"`
+}
+
+// PostMessage sends the message using chat.postMessage and returns its
+// timestamp.
+func (w *webClient) PostMessage(msg *slack.OutgoingMessage, blocks []block,
+	threadTs string) (string, error) {
+	v := url.Values{"channel": {msg.Channel}, "text": {msg.Text}}
+	if threadTs != "" {
+		v.Set("thread_ts", threadTs)
+	}
+	if len(blocks) > 0 {
+		b, err := json.Marshal(blocks)
+		if err != nil {
+			return "", fmt.Errorf("Error while encoding blocks: %v", err)
+		}
+		v.Set("blocks", string(b))
+	}
+	var pr postMessageResponse
+	if err := slackPost(slackPrefix+"/chat.postMessage", w.token, v,
+		&pr); err != nil {
+		return "", err
+	}
+	return pr.Ts, nil
+}
+
+func (w *webClient) UpdateMessage(channel string, ts string,
+	text string) error {
+	v := url.Values{"channel": {channel}, "ts": {ts}, "text": {text},
+		"blocks": {"[]"}}
+	var sr slackResponse
+	return slackPost(slackPrefix+"/chat.update", w.token, v, &sr)
+}
+
+func (w *webClient) DeleteMessage(channel string, ts string) error {
+	v := url.Values{"channel": {channel}, "ts": {ts}}
+	var sr slackResponse
+	return slackPost(slackPrefix+"/chat.delete", w.token, v, &sr)
+}
+
+func (w *webClient) AddReaction(channel string, ts string, name string) error {
+	v := url.Values{"channel": {channel}, "timestamp": {ts}, "name": {name}}
+	var sr slackResponse
+	return slackPost(slackPrefix+"/reactions.add", w.token, v, &sr)
+}
+
+// rtmClient sends messages over the RTM connection. Replies in threads are
+// sent using the Web API since the RTM library doesn't support them.
+type rtmClient struct {
+	*slack.RTM
+	web *webClient
+}
+
+func (r *rtmClient) SendThreadReply(msg *slack.OutgoingMessage,
+	threadTs string) {
+	r.web.SendThreadReply(msg, threadTs)
+}
+
+func (r *rtmClient) SendBlocks(msg *slack.OutgoingMessage, blocks []block,
+	threadTs string) {
+	r.web.SendBlocks(msg, blocks, threadTs)
+}
+
+func (r *rtmClient) AddReaction(channel string, ts string, name string) error {
+	return r.web.AddReaction(channel, ts, name)
+}
+
+func (r *rtmClient) PostMessage(msg *slack.OutgoingMessage, blocks []block,
+	threadTs string) (string, error) {
+	return r.web.PostMessage(msg, blocks, threadTs)
+}
+
+func (r *rtmClient) UpdateMessage(channel string, ts string,
+	text string) error {
+	return r.web.UpdateMessage(channel, ts, text)
+}
+
+func (r *rtmClient) DeleteMessage(channel string, ts string) error {
+	return r.web.DeleteMessage(channel, ts)
+}
+
+// dryRunClient logs the messages that would have been sent instead of sending
+// them. It is used when dry_run is set in the config.
+type dryRunClient struct {
+	RTM
+}
+
+func (d *dryRunClient) SendMessage(msg *slack.OutgoingMessage) {
+	logger.Infof("Dry run, not sending to channel %s: %s", msg.Channel,
+		msg.Text)
+}
+
+func (d *dryRunClient) SendThreadReply(msg *slack.OutgoingMessage,
+	threadTs string) {
+	logger.Infof("Dry run, not sending to thread %s in channel %s: %s",
+		threadTs, msg.Channel, msg.Text)
+}
+
+func (d *dryRunClient) SendBlocks(msg *slack.OutgoingMessage, blocks []block,
+	threadTs string) {
+	logger.Infof("Dry run, not sending blocks to channel %s: %s", msg.Channel,
+		msg.Text)
+}
+
+func (d *dryRunClient) AddReaction(channel string, ts string, name string) error {
+	logger.Infof("Dry run, not reacting with %s to %s in channel %s", name,
+		ts, channel)
+	return nil
+}
+
+// Fields common to all Slack Web API responses.
+type slackResponse struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+func (sr slackResponse) err() error {
+	if !sr.Ok {
+		return fmt.Errorf("Slack returned error: %s", sr.Error)
+	}
+	return nil
+}
+
+// slackPost posts the form values to the Slack Web API method at u using
+// token for auth and parses the response into data.
+func slackPost(u string, token string, v url.Values, data interface{}) error {
+	req, err := http.NewRequest("POST", u, strings.NewReader(v.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Url: %s. Error: %v", u, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Url: %s. Status: %v", u, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Url: %s. Error: %v", u, err)
+	}
+	var sr slackResponse
+	if err := json.Unmarshal(b, &sr); err != nil {
+		return fmt.Errorf("Url: %s. Error: %v", u, err)
+	}
+	if err := sr.err(); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, data)
+}
+
+type authTest struct {
+	slackResponse
+	UserId string `json:"user_id"`
+}
+
+// fetchBotUserId returns the user id that the token belongs to.
+func fetchBotUserId(token string) (string, error) {
+	var at authTest
+	if err := slackPost(slackPrefix+"/auth.test", token, nil, &at); err != nil {
+		return "", err
+	}
+	return at.UserId, nil
+}
+
+type conversationsList struct {
+	slackResponse
+	Channels []struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"channels"`
+	ResponseMetadata struct {
+		NextCursor string `json:"next_cursor"`
+	} `json:"response_metadata"`
+}
+
+// fetchChannelIds returns the ids of the channels in the workspace by name,
+// going through all the pages of conversations.list.
+func fetchChannelIds(token string) (map[string]string, error) {
+	ids := make(map[string]string)
+	cursor := ""
+	for {
+		v := url.Values{"types": {"public_channel,private_channel"},
+			"exclude_archived": {"true"}, "limit": {"1000"}}
+		if cursor != "" {
+			v.Set("cursor", cursor)
+		}
+		var cl conversationsList
+		if err := slackPost(slackPrefix+"/conversations.list", token, v,
+			&cl); err != nil {
+			return nil, err
+		}
+		for _, ch := range cl.Channels {
+			ids[ch.Name] = ch.Id
+		}
+		if cursor = cl.ResponseMetadata.NextCursor; cursor == "" {
+			return ids, nil
+		}
+	}
+}
+
+// resolveChannelNames replaces the channels in nc that are given by name,
+// like #general, with their ids, so that the counters are always keyed by id.
+// On stdin the name without the # is the id, as lines are sent to #general.
+func resolveChannelNames(nc *Config) error {
+	var names []string
+	for cid := range nc.Channels {
+		if strings.HasPrefix(cid, "#") {
+			names = append(names, cid)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	var ids map[string]string
+	switch nc.Platform {
+	case platformMattermost:
+		return fmt.Errorf("Channels can only be given by name on slack, got %s",
+			strings.Join(names, ", "))
+	case platformStdin:
+		ids = make(map[string]string)
+		for _, name := range names {
+			ids[name[1:]] = name[1:]
+		}
+	default:
+		var err error
+		if ids, err = fetchChannelIds(nc.Token); err != nil {
+			return fmt.Errorf("Error while fetching slack channels. %s", err)
+		}
+	}
+	var missing []string
+	for _, name := range names {
+		id, ok := ids[strings.TrimPrefix(name, "#")]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		if _, ok := nc.Channels[id]; ok {
+			return fmt.Errorf("Channel %s is in the config as both %s and %s",
+				name, name, id)
+		}
+		nc.Channels[id] = nc.Channels[name]
+		delete(nc.Channels, name)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Couldn't find the channels %s in slack",
+			strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// MessageSource receives the messages from the chat platform and dispatches
+// them to the counters.
+type MessageSource interface {
+	// Listen dispatches the messages received till the connection fails.
+	Listen() error
+}
+
+// rtmSource receives the messages over a Slack RTM connection.
+// ManageConnection takes care of reconnecting it.
+type rtmSource struct {
+	rtm *slack.RTM
+}
+
+func (s *rtmSource) Listen() error {
+	handleEvents(s.rtm.IncomingEvents)
+	return errors.New("RTM events channel closed")
+}
+
+// runSource keeps listening on src, reconnecting whenever the connection is
+// dropped.
+func runSource(src MessageSource) {
+	for {
+		err := src.Listen()
+		logger.Warnf("Connection closed: %v. Reconnecting.", err)
+		time.Sleep(retryBackoff)
+	}
+}
+
+// jsonRequest sends body as JSON with the token as a bearer token, and decodes
+// the response into data, if it isn't nil.
+func jsonRequest(method string, u string, token string,
+	body interface{}, data interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Url: %s. Error: %v", u, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Url: %s. Status: %v", u, resp.Status)
+	}
+	if data == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(data); err != nil {
+		return fmt.Errorf("Url: %s. Error: %v", u, err)
+	}
+	return nil
+}
+
+// MemberCounter returns the number of members in a channel.
+type MemberCounter interface {
+	MemberCount(channel string) (int, error)
+}
+
+// Used to check min_members before sending an alert. The check is skipped if
+// it is nil.
+var members *memberCache
+
+// ChannelNamer returns the name of a channel.
+type ChannelNamer interface {
+	ChannelName(channel string) (string, error)
+}
+
+// Used to show the names of the channels being monitored. Their ids are shown
+// if it is nil.
+var namer ChannelNamer
+
+// nameCache caches the names returned by source. Channels are rarely renamed,
+// so the names are kept for as long as wisemonk runs.
+type nameCache struct {
+	sync.Mutex
+	source ChannelNamer
+	names  map[string]string
+}
+
+func newNameCache(source ChannelNamer) *nameCache {
+	return &nameCache{source: source, names: make(map[string]string)}
+}
+
+func (n *nameCache) ChannelName(channel string) (string, error) {
+	n.Lock()
+	name, ok := n.names[channel]
+	n.Unlock()
+	if ok {
+		return name, nil
+	}
+	name, err := n.source.ChannelName(channel)
+	if err != nil {
+		return "", err
+	}
+	n.Lock()
+	n.names[channel] = name
+	n.Unlock()
+	return name, nil
+}
+
+// How long the member count of a channel is cached for.
+const memberCacheTTL = time.Hour
+
+type memberCount struct {
+	count   int
+	fetched time.Time
+}
+
+// memberCache caches the member counts returned by source for ttl, so that we
+// don't hit the API on every tick. The age of a count is measured with the
+// time passed in by the counter, which comes from its Clock.
+type memberCache struct {
+	sync.Mutex
+	source MemberCounter
+	ttl    time.Duration
+	counts map[string]memberCount
+}
+
+func newMemberCache(source MemberCounter, ttl time.Duration) *memberCache {
+	return &memberCache{source: source, ttl: ttl,
+		counts: make(map[string]memberCount)}
+}
+
+// count returns the member count of channel, fetching it if it is older than
+// the ttl at now.
+func (m *memberCache) count(channel string, now time.Time) (int, error) {
+	m.Lock()
+	mc, ok := m.counts[channel]
+	m.Unlock()
+	if ok && now.Sub(mc.fetched) < m.ttl {
+		return mc.count, nil
+	}
+	n, err := m.source.MemberCount(channel)
+	if err != nil {
+		return 0, err
+	}
+	m.Lock()
+	m.counts[channel] = memberCount{count: n, fetched: now}
+	m.Unlock()
+	return n, nil
+}
+
+// slackMembers gets the member count and name of a channel from
+// conversations.info.
+type slackMembers struct {
+	token string
+}
+
+type conversationsInfo struct {
+	slackResponse
+	Channel struct {
+		Name       string `json:"name"`
+		NumMembers int    `json:"num_members"`
+	} `json:"channel"`
+}
+
+func (s *slackMembers) ChannelName(channel string) (string, error) {
+	var ci conversationsInfo
+	v := url.Values{"channel": {channel}}
+	if err := slackPost(slackPrefix+"/conversations.info", s.token, v,
+		&ci); err != nil {
+		return "", err
+	}
+	return ci.Channel.Name, nil
+}
+
+func (s *slackMembers) MemberCount(channel string) (int, error) {
+	var ci conversationsInfo
+	v := url.Values{"channel": {channel}, "include_num_members": {"true"}}
+	if err := slackPost(slackPrefix+"/conversations.info", s.token, v,
+		&ci); err != nil {
+		return 0, err
+	}
+	return ci.Channel.NumMembers, nil
+}
+
+const defaultUserRefresh = time.Hour
+
+// userCache holds the map of user ids to usernames, which is fetched again
+// periodically so that users who joined later have their names. The map is
+// replaced on every refresh and never modified, so it can be read without the
+// lock once it has been got from Names.
+type userCache struct {
+	sync.RWMutex
+	names map[string]string
+	fetch func() map[string]string
+}
+
+func newUserCache(fetch func() map[string]string) *userCache {
+	return &userCache{names: fetch(), fetch: fetch}
+}
+
+// Names returns the current map of user ids to usernames.
+func (u *userCache) Names() map[string]string {
+	u.RLock()
+	defer u.RUnlock()
+	return u.names
+}
+
+// refresh fetches the usernames again. The old ones are kept if none could be
+// fetched, since the errors are only logged while fetching.
+func (u *userCache) refresh() {
+	names := u.fetch()
+	if len(names) == 0 {
+		return
+	}
+	u.Lock()
+	u.names = names
+	u.Unlock()
+}
+
+// refreshUsers refreshes the usernames in u every interval.
+func refreshUsers(u *userCache, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		u.refresh()
+	}
+}
+
+const defaultDigestInterval = 24 * time.Hour
+
+// digestInterval returns how often the digest is posted.
+func digestInterval() time.Duration {
+	if conf.DigestInterval == "" {
+		return defaultDigestInterval
+	}
+	// It has been validated along with the config.
+	d, _ := time.ParseDuration(conf.DigestInterval)
+	return d
+}
+
+// takeDigest returns the number of messages counted and the urls of the
+// topics created since it was last called.
+func (c *Counter) takeDigest() (int, []string) {
+	c.Lock()
+	defer c.Unlock()
+	n, topics := c.digestMsgs, c.digestTopics
+	c.digestMsgs, c.digestTopics = 0, nil
+	return n, topics
+}
+
+// digest returns the activity in the channels cs since the last digest, one
+// channel per line.
+func digest(cs map[string]*Counter) string {
+	var cids []string
+	for cid := range cs {
+		cids = append(cids, cid)
+	}
+	sort.Strings(cids)
+	var buf bytes.Buffer
+	buf.WriteString("Activity since the last digest:\n")
+	for _, cid := range cids {
+		n, topics := cs[cid].takeDigest()
+		fmt.Fprintf(&buf, "%s (%s): %d messages", channelName(cid), cid, n)
+		if len(topics) > 0 {
+			fmt.Fprintf(&buf, ", topics: %s", strings.Join(topics, ", "))
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// postDigests posts the digest to the channel cid every interval.
+func postDigests(rtm RTM, cid string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		rtm.SendMessage(rtm.NewOutgoingMessage(digest(channels()), cid))
+	}
+}
+
+// userRefresh returns how often the usernames are fetched again.
+func userRefresh() time.Duration {
+	if conf.UserRefresh == "" {
+		return defaultUserRefresh
+	}
+	// It has been validated along with the config.
+	d, _ := time.ParseDuration(conf.UserRefresh)
+	return d
+}
+
+func slackQuery(suffix string) string {
+	return fmt.Sprintf("%s/%s?token=%s", slackPrefix, suffix, conf.Token)
+}
+
+func cacheUsernames(url string) map[string]string {
+	memmap := make(map[string]string)
+	var m Members
+
+	if err := runQueryAndParseResponse(url, &m); err != nil {
+		logger.Errorf("Error while fetching slack users. %s", err)
+		return memmap
+	}
+	for _, u := range m.Users {
+		memmap[u.Id] = u.Name
+	}
+	return memmap
+}
+
+type CategoryRes struct {
+	CategoryList Categories `json:"category_list"`
+}
+
+type Categories struct {
+	Cats []Category `json:"categories"`
+}
+
+type Category struct {
+	Id   int    `json:"id"`
+	Slug string `json:"slug"`
+}
+
+// categoryCache maps the ids of the discourse categories to their slugs. It
+// is fetched again when a category isn't found in it.
+type categoryCache struct {
+	sync.RWMutex
+	slugs map[int]string
+}
+
+func (cc *categoryCache) set(slugs map[int]string) {
+	cc.Lock()
+	cc.slugs = slugs
+	cc.Unlock()
+}
+
+// slug returns the slug of the category with the given id.
+func (cc *categoryCache) slug(id int) string {
+	cc.RLock()
+	defer cc.RUnlock()
+	return cc.slugs[id]
+}
+
+// lookup returns the id of the category with the given slug.
+func (cc *categoryCache) lookup(slug string) (int, bool) {
+	cc.RLock()
+	defer cc.RUnlock()
+	for id, cname := range cc.slugs {
+		if cname == slug {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// sortedSlugs returns the slugs of all the categories, sorted.
+func (cc *categoryCache) sortedSlugs() []string {
+	cc.RLock()
+	var slugs []string
+	for _, slug := range cc.slugs {
+		slugs = append(slugs, slug)
 	}
+	cc.RUnlock()
+	sort.Strings(slugs)
+	return slugs
+}
 
-	query = res[1]
-	var err error
-	count, err = strconv.Atoi(res[2])
-	if err != nil {
-		count = 3
+var errUnknownCategory = errors.New("Category doesn't exist in discourse.")
+
+// Categories fetches the discourse categories and caches them. It returns
+// their slugs by id.
+func (d *DiscourseClient) Categories() (map[int]string, error) {
+	var cr CategoryRes
+	if err := d.get(d.query("categories.json", ""), &cr); err != nil {
+		return nil, err
+	}
+	cats := make(map[int]string)
+	for _, c := range cr.CategoryList.Cats {
+		cats[c.Id] = c.Slug
 	}
-	return query, count
+	d.cats.set(cats)
+	return cats, nil
 }
 
-func searchDiscourse(c *Counter, m string, rtm RTM) {
+// cacheCategories fetches the categories of the discourse in the config and
+// disables topics for the channels whose category doesn't exist.
+func cacheCategories() {
 	if conf.DiscKey == "" {
 		return
 	}
 
-	query, maxResults := parseSearchQuery(m)
-	if query == "" {
+	d := discourse()
+	if _, err := d.Categories(); err != nil {
+		logger.Errorf("Error while fetching discourse categories. %s", err)
 		return
 	}
+	d.checkDiscourseCategory(conf.Channels)
+}
 
-	q := discourseQuery("search.json", fmt.Sprintf("q=%s&order=%s",
-		url.QueryEscape(query), "activity"))
-
-	var sr SearchResponse
-	runQueryAndParseResponse(q, &sr)
-	sr.Topics = filterTopics(c, sr.Topics)
-	// Picking just the top 3 topics
-	if len(sr.Topics) > maxResults {
-		sr.Topics = sr.Topics[:maxResults]
+// categoryHint returns the category closest to the unknown category name, and
+// the categories that exist, to help fix typos in the config.
+func (d *DiscourseClient) categoryHint(name string) string {
+	slugs := d.cats.sortedSlugs()
+	if len(slugs) == 0 {
+		return ""
 	}
-	var buf bytes.Buffer
-	for _, t := range sr.Topics {
-		buf.WriteString(fmt.Sprintf("%s/t/%s/%d (Views - %d, Replies - %d, Posts %d)\n",
-			conf.DiscPrefix, t.Slug, t.Id, t.Views, t.Replies, t.Posts))
+
+	closest, dist := "", -1
+	for _, slug := range slugs {
+		d := levenshtein(strings.ToLower(name), strings.ToLower(slug))
+		if dist == -1 || d < dist {
+			closest, dist = slug, d
+		}
 	}
-	if buf.Len() > 0 {
-		rtm.SendMessage(rtm.NewOutgoingMessage(buf.String(), c.ChannelId))
-	} else {
-		rtm.SendMessage(rtm.NewOutgoingMessage("Sorry, I didn't find anything.",
-			c.ChannelId))
+	hint := ""
+	// Suggestions which need most of the name changed won't help.
+	if dist <= utf8.RuneCountInString(name)/2 {
+		hint = fmt.Sprintf(" Did you mean %s?", closest)
 	}
+	return fmt.Sprintf("%s Available categories: %s.", hint,
+		strings.Join(slugs, ", "))
 }
 
-func (c *Counter) checkOrIncr(rtm *slack.RTM, wg sync.WaitGroup,
-	memmap map[string]string) {
-	defer wg.Done()
-	ticker := time.NewTicker(time.Second * 10)
-
-	for {
-		select {
-		case msg := <-c.messages:
-			searchDiscourse(c, msg.Text, rtm)
-			createNewTopic(c, msg.Text, rtm)
-			m := askToMeditate(c, msg.Text)
-			if m != "" {
-				rtm.SendMessage(rtm.NewOutgoingMessage(m,
-					c.ChannelId))
+// levenshtein returns the number of single character edits needed to turn a
+// into b.
+func levenshtein(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
 			}
-			// If we receive a message on the channel, we increment
-			// the counter.
-			c.Increment(msg, memmap)
-		case <-ticker.C:
-			// We perform this check only if the monk is not meditating.
-			if d := c.MeditationEnd(); d < 0 {
-				count := c.Count()
-				if count >= c.MaxMsg {
-					go sendMessage(c, rtm)
-				}
+			// Deleting, inserting or substituting a character.
+			cur[j] = prev[j] + 1
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
 			}
 		}
+		prev, cur = cur, prev
 	}
+	return prev[len(rb)]
 }
 
-type Members struct {
-	Users []Member `json:"members"`
+// categoryId returns the id of the category, which is given either by its id
+// or slug. The categories are fetched again if the slug isn't found, in case
+// the category was created after they were cached.
+func (d *DiscourseClient) categoryId(category string) (string, error) {
+	if _, err := strconv.Atoi(category); err == nil {
+		return category, nil
+	}
+	if id, ok := d.cats.lookup(category); ok {
+		return strconv.Itoa(id), nil
+	}
+	if _, err := d.Categories(); err != nil {
+		return "", err
+	}
+	if id, ok := d.cats.lookup(category); ok {
+		return strconv.Itoa(id), nil
+	}
+	return "", errUnknownCategory
 }
 
-type Member struct {
-	Id   string `json:"id"`
-	Name string `json:"name"`
+// Checks if the discourse category that topics are created in exists for
+// every channel. Topics aren't created for the channels whose category
+// doesn't.
+func (d *DiscourseClient) checkDiscourseCategory(channels map[string]*Counter) {
+	for _, channel := range channels {
+		cat := channel.CreateTopicIn
+		if _, err := strconv.Atoi(cat); err == nil {
+			continue
+		}
+		if _, ok := d.cats.lookup(cat); !ok {
+			channel.disableTopics(d.categoryHint(cat))
+		}
+	}
 }
 
-func runQueryAndParseResponse(q string, data interface{}) {
-	resp, err := http.Get(q)
+func init() {
+	var err error
+	yoda, err = ioutil.ReadFile("yoda.txt")
 	if err != nil {
-		log.Fatalf("Url: %s. Error: %v", q, err)
+		logger.Fatalf("%s", err)
 	}
+	if err = compileCommands(defaultCommandPrefix); err != nil {
+		logger.Fatalf("%s", err)
+	}
+}
 
-	if resp.StatusCode != 200 {
-		log.Fatalf("Url: %s. Status: %v", q, resp.Status)
+// compileCommands builds the regexes for the commands, starting with prefix.
+// It should be called before the counters are started.
+func compileCommands(prefix string) error {
+	p := regexp.QuoteMeta(prefix) + " "
+	for _, rc := range []struct {
+		re   **regexp.Regexp
+		expr string
+	}{
+		// We capture the duration using a capturing group.
+		{&meditateRegex, meditateCmd + ` (.+)`},
+		{&createRegex, createCmd + ` (.+)`},
+		{&queryCountRegex, queryCmd + ` (.+) (-?[0-9]+)(?: ([a-z_]+))?(?: (` +
+			searchAll + `))?$`},
+		{&queryRegex, queryCmd + ` (.+)`},
+		{&statusRegex, statusCmd},
+		{&helpRegex, helpCmd},
+		{&wakeRegex, wakeCmd},
+		{&quietRegex, quietCmd + ` (.+)`},
+		{&setMaxRegex, setMaxCmd + ` (.+)`},
+		{&appendRegex, appendCmd + ` (.+)`},
+		{&channelsRegex, channelsCmd + `$`},
+		{&previewRegex, previewCmd + `$`},
+		{&statsRegex, statsCmd + `(?: ([0-9]+))?$`},
+	} {
+		re, err := regexp.Compile(p + rc.expr)
+		if err != nil {
+			return err
+		}
+		*rc.re = re
 	}
+	commandPrefix = prefix
+	return nil
+}
 
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Url: %s. Error: %v", q, err)
+var configFile = flag.String("config", "config.json",
+	"Path of the config file.")
+
+type Config struct {
+	Token      string              `json:"token"`
+	DiscPrefix string              `json:"discourseprefix"`
+	DiscKey    string              `json:"discoursekey"`
+	Channels   map[string]*Counter `json:"channels"`
+	// Whether the discourse key is sent in the Api-Key and Api-Username
+	// headers instead of the url. Newer versions of discourse need this.
+	DiscAuthHeaders bool `json:"discourse_auth_headers"`
+	// Discourse user that topics are created by. Defaults to wisemonk.
+	DiscUsername string `json:"discourse_username"`
+	// Timeout for outbound HTTP calls, parsed by time.ParseDuration.
+	HttpTimeout string `json:"http_timeout"`
+	// Proxy for outbound calls. HTTP_PROXY/HTTPS_PROXY are used if empty.
+	// The vendored slack library can't be given a client, so the RTM
+	// connection it makes only goes through HTTP_PROXY from the environment.
+	ProxyUrl string `json:"proxy_url"`
+	// File that the state of the counters is saved to, so that it survives
+	// restarts. State isn't saved if this is empty.
+	StateFile string `json:"state_file"`
+	// Channel that a digest of the activity in all the channels is posted
+	// to. No digest is posted if empty.
+	DigestChannel string `json:"digest_channel"`
+	// How often the digest is posted. Defaults to 24h.
+	DigestInterval string `json:"digest_interval"`
+	// How messages are received from slack, either "rtm" or "socket".
+	// Defaults to "rtm".
+	Mode string `json:"mode"`
+	// App level token used to open a Socket Mode connection.
+	AppToken string `json:"app_token"`
+	// Quotes to pick from for the alert, instead of the Go Proverbs.
+	Quotes []string `json:"quotes"`
+	// File to read the quotes from, one per line. Used if Quotes is empty.
+	QuotesFile string `json:"quotes_file"`
+	// Most results a search returns, even if more are asked for. Defaults
+	// to 10.
+	MaxSearchResults int `json:"max_search_results"`
+	// Port that the /healthz and /ready endpoints are served on. Defaults to
+	// 8080.
+	HealthPort int `json:"health_port"`
+	// Whether messages and topics should be logged instead of being sent.
+	DryRun bool `json:"dry_run"`
+	// Number of times a failed call to Discourse is retried.
+	// Defaults to 3 if not set.
+	MaxRetries *int `json:"max_retries"`
+	// Least severe level that is logged, one of debug, info, warn or error.
+	// Defaults to info.
+	LogLevel string `json:"log_level"`
+	// Chat platform wisemonk runs on, either "slack" or "mattermost".
+	// Defaults to "slack".
+	Platform string `json:"platform"`
+	// Url of the Mattermost server, e.g. https://chat.example.com. Token
+	// should be a Mattermost bot or personal access token when using it.
+	MattermostUrl string `json:"mattermost_url"`
+	// Where topics are created and searched for, either "discourse" or
+	// "github". Defaults to "discourse".
+	Forum string `json:"forum"`
+	// Token and repository, as owner/name, whose GitHub Discussions are
+	// used as the forum.
+	GithubToken string `json:"github_token"`
+	GithubRepo  string `json:"github_repo"`
+	// What commands start with. Defaults to "wisemonk".
+	CommandPrefix string `json:"command_prefix"`
+	// Prepended to topic titles shorter than 20 characters. Defaults to
+	// "Topic created by wisemonk with title: ".
+	TitlePrefix string `json:"title_prefix"`
+	// Slack user ids or names of the users who can ask wisemonk to
+	// meditate, be quiet, wake up or change maxmsg. Anyone can if empty.
+	Admins []string `json:"admins"`
+	// How often usernames are fetched again, so that new users have their
+	// names in topics. Defaults to 1h.
+	UserRefresh string `json:"user_refresh_interval"`
+	// Most characters in a topic, as set by max_post_length in discourse.
+	// The messages which don't fit are left out. Defaults to 32000.
+	MaxPostLength int `json:"max_post_length"`
+}
+
+var conf Config
+
+const defaultHttpTimeout = 30 * time.Second
+
+const defaultMaxRetries = 3
+
+var maxRetries = defaultMaxRetries
+
+// Client used for all outbound calls to Slack and Discourse. It is replaced
+// with one having the configured timeout once the config is read.
+var client = &http.Client{Timeout: defaultHttpTimeout}
+
+func newHttpClient(timeout string, proxy string) (*http.Client, error) {
+	d := defaultHttpTimeout
+	if timeout != "" {
+		var err error
+		if d, err = time.ParseDuration(timeout); err != nil {
+			return nil, err
+		}
 	}
 
-	if err := json.Unmarshal(body, data); err != nil {
-		log.Fatalf("Url: %s. Error: %v", q, err)
+	p := http.ProxyFromEnvironment
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, err
+		}
+		p = http.ProxyURL(u)
 	}
+	// A clone keeps the timeouts, keep-alives and HTTP/2 of the default
+	// transport.
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = p
+	return &http.Client{Timeout: d, Transport: t}, nil
 }
 
-func slackQuery(suffix string) string {
-	return fmt.Sprintf("%s/%s?token=%s", slackPrefix, suffix, conf.Token)
+// Guards conf.Channels, which can have channels added to it when the config
+// is reloaded.
+var channelsMu sync.RWMutex
+
+// counterFor returns the Counter for the channel with id cid.
+func counterFor(cid string) (*Counter, bool) {
+	channelsMu.RLock()
+	defer channelsMu.RUnlock()
+	c, ok := conf.Channels[cid]
+	return c, ok
 }
 
-func cacheUsernames(url string) map[string]string {
-	memmap := make(map[string]string)
-	var m Members
+// channels returns a copy of conf.Channels which is safe to iterate over.
+func channels() map[string]*Counter {
+	channelsMu.RLock()
+	defer channelsMu.RUnlock()
+	cs := make(map[string]*Counter, len(conf.Channels))
+	for cid, c := range conf.Channels {
+		cs[cid] = c
+	}
+	return cs
+}
 
-	runQueryAndParseResponse(url, &m)
-	for _, u := range m.Users {
-		memmap[u.Id] = u.Name
+func parseConfig(filename string) (Config, error) {
+	var nc Config
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nc, fmt.Errorf("Error reading file, %s. %s", filename, err)
 	}
-	return memmap
+
+	nc.Channels = make(map[string]*Counter)
+	if err = json.Unmarshal(b, &nc); err != nil {
+		return nc, fmt.Errorf("Error while unmarshaling data from config while. %s",
+			err)
+	}
+	nc.overrideSecrets()
+	return nc, nil
 }
 
-type CategoryRes struct {
-	CategoryList Categories `json:"category_list"`
+// overrideSecrets sets the secrets from the environment, if they are set
+// there, so that they don't have to be kept in the config file.
+func (c *Config) overrideSecrets() {
+	for _, s := range []struct {
+		env   string
+		field *string
+	}{
+		{"WISEMONK_SLACK_TOKEN", &c.Token},
+		{"WISEMONK_APP_TOKEN", &c.AppToken},
+		{"WISEMONK_DISCOURSE_KEY", &c.DiscKey},
+		{"WISEMONK_GITHUB_TOKEN", &c.GithubToken},
+	} {
+		if v := os.Getenv(s.env); v != "" {
+			*s.field = v
+		}
+	}
 }
 
-type Categories struct {
-	Cats []Category `json:"categories"`
+func readConfig(filename string) {
+	nc, err := parseConfig(filename)
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	channelsMu.Lock()
+	conf = nc
+	channelsMu.Unlock()
+
+	if client, err = newHttpClient(conf.HttpTimeout, conf.ProxyUrl); err != nil {
+		logger.Fatalf("Error while creating http client. %s", err)
+	}
+	if err = logger.SetLevel(conf.LogLevel); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	setAdmins(conf.Admins)
+	prefix := conf.CommandPrefix
+	if prefix == "" {
+		prefix = defaultCommandPrefix
+	}
+	if err = compileCommands(prefix); err != nil {
+		logger.Fatalf("Error while compiling commands. %s", err)
+	}
+	maxRetries = defaultMaxRetries
+	if conf.MaxRetries != nil {
+		maxRetries = *conf.MaxRetries
+	}
+	if quotes, err = loadQuotes(conf); err != nil {
+		logger.Fatalf("Error while loading quotes. %s", err)
+	}
 }
 
-type Category struct {
-	Id   int    `json:"id"`
-	Slug string `json:"slug"`
+// update applies the settings from n to the counter. The messages stored in
+// the counter are kept as they are.
+func (c *Counter) update(n *Counter) {
+	c.Lock()
+	defer c.Unlock()
+	c.Interval = n.Interval
+	// The interval has been validated along with the config.
+	c.interval, _ = time.ParseDuration(n.Interval)
+	c.MaxMsg = n.MaxMsg
+	c.SearchOver = n.SearchOver
+	if c.CreateTopicIn != n.CreateTopicIn {
+		// The new category is checked when a topic is created next.
+		c.topicsDisabled = false
+	}
+	c.CreateTopicIn = n.CreateTopicIn
+	c.MaxMeditation = n.MaxMeditation
+	c.TopicTags = n.TopicTags
+	c.IgnoreThreads = n.IgnoreThreads
+	c.NudgeInThread = n.NudgeInThread
+	c.NudgeCooldown = n.NudgeCooldown
+	c.MaxBufferedMsgs = n.MaxBufferedMsgs
+	c.MinMembers = n.MinMembers
+	c.NudgeMessage = n.NudgeMessage
+	c.SummarizeAfter = n.SummarizeAfter
+	c.NudgeBlocks = n.NudgeBlocks
+	c.ReactionHint = n.ReactionHint
+	c.BucketGranularity = n.BucketGranularity
+	c.EscalateAfter = n.EscalateAfter
+	c.EscalationMessage = n.EscalationMessage
+	c.CountMode = n.CountMode
+	c.TidyNudgeAfter = n.TidyNudgeAfter
+	c.TidyNudge = n.TidyNudge
+	c.IgnorePatterns = n.IgnorePatterns
+	// The patterns have been validated along with the config.
+	c.ignoreRegexes, _ = compilePatterns(n.IgnorePatterns)
+	c.ActiveHours = n.ActiveHours
+	c.Timezone = n.Timezone
+	c.active, _ = parseActiveHours(n.ActiveHours, n.Timezone)
+	c.DiscourseEnabled = n.DiscourseEnabled
 }
 
-var discourseCategory map[int]string
+// setup prepares the counter to receive messages for the channel cid.
+func (c *Counter) setup(cid string) {
+	c.ChannelId = cid
+	c.messages = make(chan *slack.Msg, 500)
+	c.stop = make(chan struct{})
+	// The interval and the patterns have been validated along with the
+	// config.
+	c.interval, _ = time.ParseDuration(c.Interval)
+	c.ignoreRegexes, _ = compilePatterns(c.IgnorePatterns)
+	c.active, _ = parseActiveHours(c.ActiveHours, c.Timezone)
+}
 
-func cacheCategories(url string) {
-	if conf.DiscKey == "" {
-		return
+// start starts handling messages for the counter until done is closed.
+func (c *Counter) start(rtm RTM, wg *sync.WaitGroup, users *userCache,
+	done <-chan struct{}) {
+	wg.Add(1)
+	// Meditation might still be on from before a restart.
+	if d := c.MeditationEnd(); d > 0 {
+		go wakeAfter(c, rtm, d, c.wakeChan())
 	}
+	go c.checkOrIncr(rtm, wg, users, done)
+}
 
-	var cr CategoryRes
-	discourseCategory = make(map[int]string)
+// Top level settings that are applied when the config is reloaded. The others
+// are only read at startup.
+var reloadedSettings = map[string]bool{"channels": true, "log_level": true,
+	"admins": true}
 
-	runQueryAndParseResponse(url, &cr)
-	for _, c := range cr.CategoryList.Cats {
-		discourseCategory[c.Id] = c.Slug
+// restartSettings returns the top level settings, by their name in the
+// config, that differ between old and nc and need a restart to take effect.
+func restartSettings(old, nc Config) []string {
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(nc)
+	var changed []string
+	for i := 0; i < ov.NumField(); i++ {
+		name := strings.Split(ov.Type().Field(i).Tag.Get("json"), ",")[0]
+		if reloadedSettings[name] {
+			continue
+		}
+		if !reflect.DeepEqual(ov.Field(i).Interface(),
+			nv.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
 	}
-	checkDiscourseCategory(conf.Channels, url)
+	return changed
 }
 
-// Checks if the discourse Category supplied as flag exists. If not
-// it logs error and exits.
-func checkDiscourseCategory(channels map[string]*Counter, url string) {
-	for _, channel := range channels {
-		exists := false
-		for _, cname := range discourseCategory {
-			if cname == channel.CreateTopicIn {
-				exists = true
-				break
+// reloadConfig reads the config from filename again and applies the settings
+// to the existing channels. Channels that weren't there before are added and
+// returned so that they can be started. Channels that are no longer there are
+// stopped and returned as removed.
+func reloadConfig(filename string) (added, removed []*Counter, err error) {
+	nc, err := parseConfig(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Validated first, so that a missing token is reported as such instead
+	// of as a failure to resolve the channel names.
+	if err := validateConfig(nc); err != nil {
+		return nil, nil, err
+	}
+	if err := resolveChannelNames(&nc); err != nil {
+		return nil, nil, err
+	}
+	logger.SetLevel(nc.LogLevel)
+	setAdmins(nc.Admins)
+	if changed := restartSettings(conf, nc); len(changed) > 0 {
+		logger.Warnf("Changes to %s need a restart to take effect.",
+			strings.Join(changed, ", "))
+	}
+
+	channelsMu.Lock()
+	defer channelsMu.Unlock()
+	for cid, n := range nc.Channels {
+		if c, ok := conf.Channels[cid]; ok {
+			c.update(n)
+			continue
+		}
+		n.setup(cid)
+		conf.Channels[cid] = n
+		added = append(added, n)
+	}
+	for cid, c := range conf.Channels {
+		if _, ok := nc.Channels[cid]; !ok {
+			delete(conf.Channels, cid)
+			if c.stop != nil {
+				close(c.stop)
 			}
+			removed = append(removed, c)
 		}
-		if !exists {
-			log.Fatalf("Category %s doesn't exist in discourse.",
-				channel.CreateTopicIn)
+	}
+	return added, removed, nil
+}
+
+// How often the state of the counters is written to the state file.
+const flushInterval = time.Minute
+
+// Fields of a Bucket that are saved to the state file.
+type BucketState struct {
+	Utime int64       `json:"utime"`
+	Slot  int64       `json:"slot,omitempty"`
+	Count int         `json:"count"`
+	Msgs  []BucketMsg `json:"msgs"`
+}
+
+// CounterState is what we save to the state file for each channel.
+type CounterState struct {
+	Buckets       []BucketState `json:"buckets"`
+	MeditationEnd time.Time     `json:"meditation_end"`
+	Topics        []TopicRecord `json:"topics,omitempty"`
+}
+
+func (c *Counter) State() CounterState {
+	c.RLock()
+	defer c.RUnlock()
+	cs := CounterState{MeditationEnd: c.meditationEnd}
+	cs.Topics = append(cs.Topics, c.topicHistory...)
+	for _, b := range c.buckets {
+		cs.Buckets = append(cs.Buckets, BucketState{Utime: b.utime,
+			Slot: b.slot, Count: b.count, Msgs: b.msgs})
+	}
+	return cs
+}
+
+// Restore sets the buckets, meditation end time and topic history of the
+// counter from cs.
+// Buckets which are older than the interval are dropped.
+func (c *Counter) Restore(cs CounterState) {
+	c.Lock()
+	defer c.Unlock()
+	timeSince := c.now().Add(-c.interval).Unix()
+	c.meditationEnd = cs.MeditationEnd
+	c.topicHistory = cs.Topics
+	c.buckets = nil
+	for _, b := range cs.Buckets {
+		if b.Utime > timeSince {
+			c.buckets = append(c.buckets, Bucket{utime: b.Utime,
+				slot: b.Slot, count: b.Count, msgs: b.Msgs})
 		}
 	}
+	sort.Sort(ByTimestamp(c.buckets))
 }
 
-func init() {
-	var err error
-	yoda, err = ioutil.ReadFile("yoda.txt")
-	if err != nil {
-		log.Fatal(err)
+// saveState writes the state of all the counters to filename. The state is
+// first written to a temporary file which is then renamed, so that we never
+// leave a partially written file behind.
+func saveState(filename string, channels map[string]*Counter) error {
+	state := make(map[string]CounterState)
+	for cid, c := range channels {
+		state[cid] = c.State()
 	}
-	// We capture the duration using a capturing group.
-	meditateRegex, err = regexp.Compile(`wisemonk meditate for (.+)`)
+	b, err := json.Marshal(state)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	createRegex, err = regexp.Compile(`wisemonk create topic (.+)`)
-	if err != nil {
-		log.Fatal(err)
+
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
 	}
-	queryCountRegex, err = regexp.Compile(`wisemonk query (.+) ([0-9]+)`)
-	if err != nil {
-		log.Fatal(err)
+	return os.Rename(tmp, filename)
+}
+
+// loadState restores the counters from the state saved in filename. It is not
+// an error for the file to not exist.
+func loadState(filename string, channels map[string]*Counter) error {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
 	}
-	queryRegex, err = regexp.Compile(`wisemonk query (.+)`)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	state := make(map[string]CounterState)
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+	for cid, cs := range state {
+		if c, ok := channels[cid]; ok {
+			c.Restore(cs)
+		}
 	}
-	readConfig("config.json")
+	return nil
 }
 
-type Config struct {
-	Token      string              `json:"token"`
-	DiscPrefix string              `json:"discourseprefix"`
-	DiscKey    string              `json:"discoursekey"`
-	Channels   map[string]*Counter `json:"channels"`
+func flushState(filename string) {
+	ticker := time.NewTicker(flushInterval)
+	for range ticker.C {
+		if err := saveState(filename, channels()); err != nil {
+			logger.Errorf("Error while saving state. %s", err)
+		}
+	}
 }
 
-var conf Config
+// validateConfig checks the settings for every channel and returns an error
+// listing all the problems found, so that they can be fixed in one go.
+func validateConfig(conf Config) error {
+	var errs []string
+	if _, err := newHttpClient(conf.HttpTimeout, conf.ProxyUrl); err != nil {
+		errs = append(errs, fmt.Sprintf("http client: %s", err))
+	}
+	switch conf.Platform {
+	case "", platformSlack, platformStdin:
+	case platformMattermost:
+		if conf.MattermostUrl == "" {
+			errs = append(errs, "mattermost_url is required for mattermost")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown platform %q", conf.Platform))
+	}
+	if conf.Platform != platformStdin && strings.TrimSpace(conf.Token) == "" {
+		errs = append(errs, "token is required, set it in the config or as WISEMONK_SLACK_TOKEN")
+	}
+	switch conf.Forum {
+	case "", forumDiscourse:
+	case forumGithub:
+		if conf.GithubToken == "" {
+			errs = append(errs, "github_token is required for github")
+		}
+		if len(strings.Split(conf.GithubRepo, "/")) != 2 {
+			errs = append(errs, fmt.Sprintf("github_repo should be owner/name, got %q",
+				conf.GithubRepo))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown forum %q", conf.Forum))
+	}
+	switch conf.Mode {
+	case "", modeRTM:
+	case modeSocket:
+		if conf.AppToken == "" {
+			errs = append(errs, "app_token is required for socket mode")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown mode %q", conf.Mode))
+	}
+	if conf.MaxRetries != nil && *conf.MaxRetries < 0 {
+		errs = append(errs, fmt.Sprintf("max_retries should be >= 0, got %d",
+			*conf.MaxRetries))
+	}
+	if n := utf8.RuneCountInString(conf.TitlePrefix); n > 0 && n < minTitleLen {
+		errs = append(errs, fmt.Sprintf("title_prefix should have at least %d characters, got %d",
+			minTitleLen, n))
+	}
+	if _, ok := logLevels[conf.LogLevel]; conf.LogLevel != "" && !ok {
+		errs = append(errs, fmt.Sprintf("unknown log_level %q", conf.LogLevel))
+	}
+	if conf.MaxPostLength < 0 || (conf.MaxPostLength > 0 &&
+		conf.MaxPostLength < minPostLength) {
+		errs = append(errs, fmt.Sprintf("max_post_length should be at least %d, got %d",
+			minPostLength, conf.MaxPostLength))
+	}
+	if conf.DigestInterval != "" {
+		if d, err := time.ParseDuration(conf.DigestInterval); err != nil || d <= 0 {
+			errs = append(errs, fmt.Sprintf("digest_interval should be a positive duration, got %q",
+				conf.DigestInterval))
+		}
+	}
+	if conf.UserRefresh != "" {
+		if d, err := time.ParseDuration(conf.UserRefresh); err != nil || d <= 0 {
+			errs = append(errs, fmt.Sprintf("user_refresh_interval should be a positive duration, got %q",
+				conf.UserRefresh))
+		}
+	}
 
-func readConfig(filename string) {
-	b, err := ioutil.ReadFile(filename)
-	if err != nil {
-		log.Fatalf("Error reading file, %s. %s", filename, err)
+	slackRTM := (conf.Platform == "" || conf.Platform == platformSlack) &&
+		(conf.Mode == "" || conf.Mode == modeRTM)
+	// Sorting so that the errors are reported in a consistent order.
+	var cids []string
+	for cid := range conf.Channels {
+		cids = append(cids, cid)
+	}
+	sort.Strings(cids)
+	for _, cid := range cids {
+		c := conf.Channels[cid]
+		if _, err := time.ParseDuration(c.Interval); err != nil {
+			errs = append(errs, fmt.Sprintf("channel %s: invalid interval %q",
+				cid, c.Interval))
+		}
+		if c.MaxMsg <= 0 {
+			errs = append(errs, fmt.Sprintf("channel %s: maxmsg should be > 0, got %d",
+				cid, c.MaxMsg))
+		}
+		if (conf.DiscKey != "" || conf.Forum == forumGithub) &&
+			c.CreateTopicIn == "" {
+			errs = append(errs, fmt.Sprintf("channel %s: create_topic_in can't be empty",
+				cid))
+		}
+		if c.MaxMeditation != "" {
+			if _, err := time.ParseDuration(c.MaxMeditation); err != nil {
+				errs = append(errs, fmt.Sprintf("channel %s: invalid max_meditation %q",
+					cid, c.MaxMeditation))
+			}
+		}
+		if c.EscalateAfter < 0 {
+			errs = append(errs, fmt.Sprintf("channel %s: escalate_after should be >= 0, got %d",
+				cid, c.EscalateAfter))
+		}
+		if c.MinMembers < 0 {
+			errs = append(errs, fmt.Sprintf("channel %s: min_members should be >= 0, got %d",
+				cid, c.MinMembers))
+		}
+		if c.MaxBufferedMsgs < 0 {
+			errs = append(errs, fmt.Sprintf("channel %s: max_buffered_msgs should be >= 0, got %d",
+				cid, c.MaxBufferedMsgs))
+		}
+		if c.NudgeCooldown != "" {
+			if _, err := time.ParseDuration(c.NudgeCooldown); err != nil {
+				errs = append(errs, fmt.Sprintf("channel %s: invalid nudge_cooldown %q",
+					cid, c.NudgeCooldown))
+			}
+		}
+		// The RTM library drops thread_ts, so replies can't be told apart.
+		if c.IgnoreThreads && slackRTM {
+			errs = append(errs, fmt.Sprintf("channel %s: ignore_threads only works in socket mode and on mattermost",
+				cid))
+		}
+		switch c.CountMode {
+		case "", countMessages, countWeighted:
+		default:
+			errs = append(errs, fmt.Sprintf("channel %s: unknown count_mode %q",
+				cid, c.CountMode))
+		}
+		if c.TidyNudgeAfter != "" {
+			if d, err := time.ParseDuration(c.TidyNudgeAfter); err != nil || d <= 0 {
+				errs = append(errs, fmt.Sprintf("channel %s: tidy_nudge_after should be a positive duration, got %q",
+					cid, c.TidyNudgeAfter))
+			}
+		}
+		switch c.TidyNudge {
+		case "", tidyShorten, tidyDelete:
+		default:
+			errs = append(errs, fmt.Sprintf("channel %s: tidy_nudge should be shorten or delete, got %q",
+				cid, c.TidyNudge))
+		}
+		if c.BucketGranularity != "" {
+			if d, err := time.ParseDuration(c.BucketGranularity); err != nil ||
+				d <= 0 || d > time.Second {
+				errs = append(errs, fmt.Sprintf("channel %s: bucket_granularity should be a duration up to 1s, got %q",
+					cid, c.BucketGranularity))
+			}
+		}
+		if _, err := parseActiveHours(c.ActiveHours, c.Timezone); err != nil {
+			errs = append(errs, fmt.Sprintf("channel %s: invalid active_hours or timezone. %s",
+				cid, err))
+		}
+		if _, err := compilePatterns(c.IgnorePatterns); err != nil {
+			errs = append(errs, fmt.Sprintf("channel %s: invalid ignore_patterns. %s",
+				cid, err))
+		}
+		if c.SummarizeAfter != "" {
+			// Messages are dropped once they are older than the
+			// interval, so the summary has to be created before that.
+			d, err := time.ParseDuration(c.SummarizeAfter)
+			interval, _ := time.ParseDuration(c.Interval)
+			if err != nil || d <= 0 || d >= interval {
+				errs = append(errs, fmt.Sprintf("channel %s: summarize_after should be a duration less than the interval, got %q",
+					cid, c.SummarizeAfter))
+			}
+		}
 	}
 
-	conf.Channels = make(map[string]*Counter)
-	err = json.Unmarshal(b, &conf)
-	if err != nil {
-		log.Fatalf("Error while unmarshaling data from config while. %s",
-			err)
+	if len(errs) > 0 {
+		return fmt.Errorf("Invalid config:\n%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// loadConfig reads and validates the config from filename, once, at startup
+// and sets up the counters for all the channels in it.
+func loadConfig(filename string) {
+	readConfig(filename)
+	if err := validateConfig(conf); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if err := resolveChannelNames(&conf); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	for cid, c := range conf.Channels {
+		c.setup(cid)
 	}
 }
 
 func main() {
 	flag.Parse()
-	cacheCategories(discourseQuery("categories.json", ""))
-	readConfig("config.json")
-	api := slack.New(conf.Token)
-	api.SetDebug(false)
-	rtm := api.NewRTM()
-	go rtm.ManageConnection()
+	loadConfig(*configFile)
+	if conf.Forum != forumGithub {
+		cacheCategories()
+	}
+	var rtm RTM
+	var src MessageSource
+	var slackRTM *slack.RTM
+	// Events of the RTM connection, which the channels wait on to connect.
+	var events <-chan slack.RTMEvent
+	switch {
+	case conf.Platform == platformStdin:
+		rtm = &stdinClient{w: os.Stdout}
+		src = &stdinSource{r: os.Stdin}
+	case conf.Platform == platformMattermost:
+		rtm = &mattermostClient{url: conf.MattermostUrl, token: conf.Token}
+		src = &mattermostSource{url: conf.MattermostUrl, token: conf.Token}
+		mm := &mattermostMembers{url: conf.MattermostUrl, token: conf.Token}
+		members = newMemberCache(mm, memberCacheTTL)
+		namer = newNameCache(mm)
+	case conf.Mode == modeSocket:
+		rtm = &webClient{token: conf.Token}
+		src = &socketModeSource{appToken: conf.AppToken}
+		sm := &slackMembers{token: conf.Token}
+		members = newMemberCache(sm, memberCacheTTL)
+		namer = newNameCache(sm)
+	default:
+		api := slack.New(conf.Token)
+		api.SetDebug(false)
+		slackRTM = api.NewRTM()
+		go slackRTM.ManageConnection()
+		events = slackRTM.IncomingEvents
+		rtm = &rtmClient{RTM: slackRTM, web: &webClient{token: conf.Token}}
+		src = &rtmSource{rtm: slackRTM}
+		sm := &slackMembers{token: conf.Token}
+		members = newMemberCache(sm, memberCacheTTL)
+		namer = newNameCache(sm)
+	}
+	if conf.DryRun {
+		rtm = &dryRunClient{RTM: rtm}
+	}
 
 	var wg sync.WaitGroup
-	// Map of slack userids to usernames.
-	memmap := cacheUsernames(slackQuery("users.list"))
+	done := make(chan struct{})
+	// Map of userids to usernames.
+	var users *userCache
+	var err error
+	switch conf.Platform {
+	case platformStdin:
+		users = newUserCache(func() map[string]string {
+			return map[string]string{stdinUserId: stdinUser}
+		})
+	case platformMattermost:
+		users = newUserCache(func() map[string]string {
+			return cacheMattermostUsers(conf.MattermostUrl, conf.Token)
+		})
+		botUserId, err = fetchMattermostUserId(conf.MattermostUrl, conf.Token)
+	default:
+		users = newUserCache(func() map[string]string {
+			return cacheUsernames(slackQuery("users.list"))
+		})
+		botUserId, err = fetchBotUserId(conf.Token)
+	}
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	go refreshUsers(users, userRefresh())
+	if conf.DigestChannel != "" {
+		go postDigests(rtm, conf.DigestChannel, digestInterval())
+	}
 
-	for cid, c := range conf.Channels {
-		wg.Add(1)
-		c.messages = make(chan *slack.Msg, 500)
-		c.ChannelId = cid
-		go c.checkOrIncr(rtm, wg, memmap)
+	if conf.StateFile != "" {
+		if err := loadState(conf.StateFile, conf.Channels); err != nil {
+			logger.Errorf("Error while loading state, starting afresh. %s", err)
+		}
+		go flushState(conf.StateFile)
+	}
+
+	go serveHealth()
+	if err := startChannels(events, connectTimeout, channels(),
+		func(c *Counter) { c.start(rtm, &wg, users, done) }); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	health.SetReady(true)
+	if conf.Platform == platformStdin {
+		// There is nothing to reconnect to once the input ends.
+		go func() {
+			if err := src.Listen(); err != io.EOF {
+				logger.Errorf("Error while reading stdin. %s", err)
+			}
+			logger.Infof("End of input, stop wisemonk with Ctrl-C.")
+		}()
+	} else {
+		go runSource(src)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		sig := <-sigs
+		if sig != syscall.SIGHUP {
+			logger.Infof("Got signal %v, shutting down.", sig)
+			break
+		}
+
+		// SIGHUP reloads the config without dropping the connection.
+		added, removed, err := reloadConfig(*configFile)
+		if err != nil {
+			logger.Errorf("Error while reloading config. %s", err)
+			continue
+		}
+		for _, c := range added {
+			c.start(rtm, &wg, users, done)
+		}
+		logger.Infof("Reloaded config, added %d and removed %d channels.",
+			len(added), len(removed))
+	}
+	if slackRTM != nil {
+		if err := slackRTM.Disconnect(); err != nil {
+			logger.Errorf("Error while disconnecting. %s", err)
+		}
 	}
-	go listen(rtm)
+	close(done)
 	wg.Wait()
+
+	if conf.StateFile != "" {
+		if err := saveState(conf.StateFile, channels()); err != nil {
+			logger.Errorf("Error while saving state. %s", err)
+		}
+	}
 }
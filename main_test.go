@@ -17,17 +17,42 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/nlopes/slack"
 )
 
+func init() {
+	// So that tests which hit failing servers don't wait on retries.
+	retryBackoff = time.Millisecond
+}
+
+// saveConf restores conf once the test is done, so that tests can change it
+// without affecting the ones that run after them.
+func saveConf(t *testing.T) {
+	old := conf
+	t.Cleanup(func() { conf = old })
+}
+
 func TestSanitizeTitle(t *testing.T) {
 	title := "Short title"
 	expected := "Topic created by wisemonk with title: Short title"
@@ -62,50 +87,482 @@ func TestSanitizeTitle(t *testing.T) {
 	}
 }
 
+func TestTitlePrefix(t *testing.T) {
+	saveConf(t)
+	conf.TitlePrefix = "Discussion moved from Slack: "
+
+	expected := "Discussion moved from Slack: Short title"
+	if st := sanitizeTitle("Short title"); st != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, st)
+	}
+
+	conf.TitlePrefix = strings.Repeat("Prefix ", 15)
+	if st := sanitizeTitle("Short title"); utf8.RuneCountInString(st) != 100 {
+		t.Errorf("Expected title to be cut to 100 characters, Got: %s", st)
+	}
+
+	if err := validateConfig(Config{TitlePrefix: "Slack: "}); err == nil ||
+		!strings.Contains(err.Error(), "title_prefix") {
+		t.Errorf("Expected title_prefix error, Got: %v", err)
+	}
+}
+
+func TestSanitizeTitleMultiByte(t *testing.T) {
+	title := strings.Repeat("Café 🚀 ", 30)
+	st := sanitizeTitle(title)
+	if !utf8.ValidString(st) {
+		t.Errorf("Expected valid UTF-8, Got: %q", st)
+	}
+	if n := utf8.RuneCountInString(st); n > 100 {
+		t.Errorf("Expected at most 100 runes, Got: %d", n)
+	}
+	// 14 words of 10 bytes each, so more than 100 bytes.
+	if expected := strings.Repeat("Café 🚀 ", 14); st != expected[:len(expected)-1] {
+		t.Errorf("Expected title to be broken after a word, Got: %q", st)
+	}
+
+	// 20 characters, but more bytes.
+	title = "Ünïcödé títlé wïth é"
+	if st = sanitizeTitle(title); st != title {
+		t.Errorf("Expected: %s, Got: %s", title, st)
+	}
+	title = "Déjà vu über café"
+	expected := "Topic created by wisemonk with title: " + title
+	if st = sanitizeTitle(title); st != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, st)
+	}
+
+	// Without a word break, cutting at 100 bytes would split an é.
+	title = "Cafe " + strings.Repeat("é", 200)
+	if st = sanitizeTitle(title); !utf8.ValidString(st) ||
+		utf8.RuneCountInString(st) != 100 {
+		t.Errorf("Expected 100 runes of valid UTF-8, Got: %q", st)
+	}
+}
+
+func TestCommandPrefix(t *testing.T) {
+	if err := compileCommands("sage"); err != nil {
+		t.Fatal(err)
+	}
+	defer compileCommands(defaultCommandPrefix)
+	c := &Counter{ChannelId: "general"}
+	rtm := &r{}
+
+	if m := askToMeditate(c, rtm, "wisemonk meditate for 5m"); m != "" {
+		t.Errorf("Expected wisemonk to be ignored, Got: %s", m)
+	}
+	expected := "Okay, I am going to meditate for 5m0s"
+	if m := askToMeditate(c, rtm, "sage meditate for 5m"); m != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, m)
+	}
+	c.WakeUp()
+
+	// Special characters in the prefix are matched literally.
+	if err := compileCommands("sage.bot"); err != nil {
+		t.Fatal(err)
+	}
+	if m := askToMeditate(c, rtm, "sagexbot meditate for 5m"); m != "" {
+		t.Errorf("Expected sagexbot to be ignored, Got: %s", m)
+	}
+	if m := askToMeditate(c, rtm, "sage.bot meditate for 5m"); m != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, m)
+	}
+	c.WakeUp()
+}
+
+func TestNormalizeCommand(t *testing.T) {
+	botUserId = "U0WISEMNK"
+	defer func() { botUserId = "" }()
+
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{"<@U0WISEMNK> meditate for 10m", "wisemonk meditate for 10m"},
+		{"<@U0WISEMNK|wisemonk>: status", "wisemonk status"},
+		{"  <@U0WISEMNK> help", "wisemonk help"},
+		{"<@U0WISEMNKX> help", "<@U0WISEMNKX> help"},
+		{"<@U13LHF42F> meditate for 10m", "<@U13LHF42F> meditate for 10m"},
+		{"ask <@U0WISEMNK> for help", "ask <@U0WISEMNK> for help"},
+	} {
+		if out := normalizeCommand(tc.in); out != tc.out {
+			t.Errorf("Expected %q for %q, Got: %q", tc.out, tc.in, out)
+		}
+	}
+}
+
+func TestMentionCommand(t *testing.T) {
+	botUserId = "U0WISEMNK"
+	defer func() { botUserId = "" }()
+	c := &Counter{Interval: "10m", MaxMsg: 20}
+	c.setup("general")
+	rtm := &r{}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	c.start(rtm, &wg, noUsers(), done)
+
+	c.messages <- &slack.Msg{Channel: "general", User: "U13LHF42F",
+		Text: "<@U0WISEMNK> meditate for 10m", Timestamp: "1465010249"}
+	expected := "Okay, I am going to meditate for 10m0s"
+	for i := 0; i < 100 && rtm.lastMsg() != expected; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+	if rtm.lastMsg() != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, rtm.lastMsg())
+	}
+	c.WakeUp()
+}
+
+func TestDuplicateMessages(t *testing.T) {
+	c := &Counter{Interval: "10m", MaxMsg: 20}
+	c.setup("general")
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	c.start(&r{}, &wg, noUsers(), done)
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	m := slack.Msg{Channel: "general", User: "U13LHF42F", Text: "hello",
+		Timestamp: ts + ".000100"}
+	dup := m
+	c.messages <- &m
+	c.messages <- &dup
+	c.messages <- &slack.Msg{Channel: "general", User: "U13LHF42F",
+		Text: "last", Timestamp: ts + ".000200"}
+	for i := 0; i < 100 && !strings.Contains(c.transcript(), "last"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+	if count := c.Count(); count != 2 {
+		t.Errorf("Expected the message to be counted once, Got: %d", count)
+	}
+}
+
+func TestRecentMsgs(t *testing.T) {
+	r := newRecentMsgs(2)
+	a := &slack.Msg{User: "U1", Timestamp: "1.1"}
+	b := &slack.Msg{User: "U1", Timestamp: "1.2"}
+	c := &slack.Msg{User: "U2", Timestamp: "1.2"}
+	if !r.add(a) || !r.add(b) || r.add(a) {
+		t.Errorf("Expected only the repeated message to be dropped")
+	}
+	// The oldest message is forgotten once there are more than the size.
+	if !r.add(c) || !r.add(a) {
+		t.Errorf("Expected the oldest message to be forgotten")
+	}
+}
+
+func TestUpdateInterval(t *testing.T) {
+	c := &Counter{Interval: "10m"}
+	c.setup("general")
+	if c.interval != 10*time.Minute {
+		t.Errorf("Expected the interval to be parsed, Got: %s", c.interval)
+	}
+	now := time.Now()
+	addBuckets(c, "New buckets", now.Unix())
+	addBuckets(c, "Old buckets", now.Add(-8*time.Minute).Unix())
+	if count := c.Count(); count != 20 {
+		t.Errorf("Expected count %d, Got: %d", 20, count)
+	}
+
+	// A new interval from the config is parsed along with it.
+	c.update(&Counter{Interval: "5m"})
+	if count := c.Count(); count != 10 {
+		t.Errorf("Expected count %d after the update, Got: %d", 10, count)
+	}
+}
+
+func TestFindCommand(t *testing.T) {
+	for _, tc := range []struct {
+		m    string
+		name string
+	}{
+		{"wisemonk query release v0.3 5", "query"},
+		{"wisemonk query release", "query"},
+		{"wisemonk create topic Release plans", "create"},
+		{"wisemonk status", "status"},
+		{"wisemonk help", "help"},
+		{"wisemonk wake up", "wake"},
+		{"wisemonk quiet for 20m", "quiet"},
+		{"wisemonk set maxmsg 50", "set maxmsg"},
+		{"wisemonk channels", "channels"},
+		{"wisemonk append to https://discuss.dgraph.io/t/release/12", "append"},
+		{"wisemonk meditate for 20m", "meditate"},
+		{"wisemonk meditate", ""},
+		{"what does wisemonk do?", ""},
+	} {
+		name := ""
+		if cmd := findCommand(tc.m); cmd != nil {
+			name = cmd.name
+		}
+		if name != tc.name {
+			t.Errorf("Expected command %q for %q, Got: %q", tc.name, tc.m,
+				name)
+		}
+	}
+}
+
+func TestHandleCommandNotCounted(t *testing.T) {
+	saveConf(t)
+	conf.DiscKey = ""
+	c := &Counter{Interval: "10m", MaxMsg: 20}
+	c.setup("general")
+	rtm := &r{}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	c.start(rtm, &wg, noUsers(), done)
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	c.messages <- &slack.Msg{Channel: "general", Text: "wisemonk query foo 3",
+		Timestamp: ts + ".000100"}
+	c.messages <- &slack.Msg{Channel: "general", Text: "wisemonk status",
+		Timestamp: ts + ".000200"}
+	c.messages <- &slack.Msg{Channel: "general", Text: "hello",
+		Timestamp: ts + ".000300"}
+	for i := 0; i < 100 && c.Count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+	if !strings.HasPrefix(rtm.lastMsg(), "Messages in the last 10m") {
+		t.Errorf("Expected status reply, Got: %s", rtm.lastMsg())
+	}
+	if count := c.Count(); count != 1 {
+		t.Errorf("Expected only the message to be counted, Got: %d", count)
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	setAdmins([]string{"U0ADMIN01", "janardhan"})
+	defer setAdmins(nil)
+	c := &Counter{ChannelId: "general", Interval: "10m", MaxMsg: 20}
+	rtm := &r{}
+
+	handleCommand(c, "wisemonk meditate for 10m", "U13LHF42F", "pawan", rtm)
+	if c.MeditationEnd() > 0 {
+		t.Errorf("Expected a non-admin to not be able to make wisemonk meditate")
+	}
+	expected := "You're not allowed to do that."
+	if rtm.lastMsg() != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, rtm.lastMsg())
+	}
+
+	handleCommand(c, "wisemonk help", "U13LHF42F", "pawan", rtm)
+	if !strings.Contains(rtm.lastMsg(), "wisemonk status") {
+		t.Errorf("Expected help to be open to everyone, Got: %s",
+			rtm.lastMsg())
+	}
+
+	handleCommand(c, "wisemonk meditate for 10m", "U0ADMIN01", "", rtm)
+	if c.MeditationEnd() <= 0 {
+		t.Errorf("Expected an admin to be able to make wisemonk meditate")
+	}
+	c.WakeUp()
+	handleCommand(c, "wisemonk meditate for 10m", "U0ADMIN02", "janardhan",
+		rtm)
+	if c.MeditationEnd() <= 0 {
+		t.Errorf("Expected admins to be matched by name too")
+	}
+	c.WakeUp()
+}
+
+func TestSetMaxMsg(t *testing.T) {
+	c := &Counter{ChannelId: "general", MaxMsg: 20}
+	rtm := &r{}
+
+	setMaxMsg(c, "wisemonk set maxmsg 50", rtm)
+	if c.MaxMsg != 50 {
+		t.Errorf("Expected maxmsg to be %d, Got: %d", 50, c.MaxMsg)
+	}
+	expected := "Okay, I will alert after 50 messages."
+	if rtm.lastMsg() != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, rtm.lastMsg())
+	}
+
+	for _, m := range []string{"wisemonk set maxmsg 0",
+		"wisemonk set maxmsg -5", "wisemonk set maxmsg lots"} {
+		setMaxMsg(c, m, rtm)
+		if c.MaxMsg != 50 {
+			t.Errorf("Expected maxmsg to stay %d for %q, Got: %d", 50, m,
+				c.MaxMsg)
+		}
+		if !strings.HasPrefix(rtm.lastMsg(), "Sorry") {
+			t.Errorf("Expected %q to be rejected, Got: %s", m, rtm.lastMsg())
+		}
+	}
+}
+
 func TestAskToMeditate(t *testing.T) {
 	c := &Counter{}
+	rtm := &r{}
 
 	message := "wisemonk meditat for 1hr"
-	m := askToMeditate(c, message)
+	m := askToMeditate(c, rtm, message)
 	em := ""
 	if m != em {
 		t.Errorf("Expected: %s, Got: %s", em, m)
 	}
 
-	message = "wisemonk meditate for 1hr"
-	m = askToMeditate(c, message)
+	message = "wisemonk meditate for a while"
+	m = askToMeditate(c, rtm, message)
 	em = "Sorry, I don't understand you."
 	if m != em {
 		t.Errorf("Expected: %s, Got: %s", em, m)
 	}
 
 	message = "wisemonk meditate for 200h"
-	m = askToMeditate(c, message)
+	m = askToMeditate(c, rtm, message)
 	em = "It's hard to meditate for more than an hour at one go you know."
 	if m != em {
 		t.Errorf("Expected: %s, Got: %s", em, m)
 	}
 
 	message = "wisemonk meditate for -5m"
-	m = askToMeditate(c, message)
+	m = askToMeditate(c, rtm, message)
 	em = "Sorry, going back in time is not what I can do."
 	if m != em {
 		t.Errorf("Expected: %s, Got: %s", em, m)
 	}
 
 	message = "wisemonk meditate for 5m"
-	m = askToMeditate(c, message)
+	m = askToMeditate(c, rtm, message)
 	em = "Okay, I am going to meditate for 5m0s"
 	if m != em {
 		t.Errorf("Expected: %s, Got: %s", em, m)
 	}
 
 	message = "wisemonk meditate for 5m"
-	m = askToMeditate(c, message)
-	em = "I am meditating. My meditation will finish in 5 mins"
+	m = askToMeditate(c, rtm, message)
+	em = "I am meditating. My meditation will finish in 5m0s"
+	if m != em {
+		t.Errorf("Expected: %s, Got: %s", em, m)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for _, tc := range []struct {
+		s string
+		d time.Duration
+	}{
+		{"5m", 5 * time.Minute},
+		{"1h30m", 90 * time.Minute},
+		{"30 minutes", 30 * time.Minute},
+		{"45 mins", 45 * time.Minute},
+		{"1 hour", time.Hour},
+		{"1hr", time.Hour},
+		{"2 Hours", 2 * time.Hour},
+		{"1.5 hours", 90 * time.Minute},
+		{"90 seconds", 90 * time.Second},
+		{"1 hour and 15 minutes", 75 * time.Minute},
+		{"half an hour", 30 * time.Minute},
+		{"an hour", time.Hour},
+		{"-5m", -5 * time.Minute},
+	} {
+		if d, err := parseDuration(tc.s); err != nil || d != tc.d {
+			t.Errorf("Expected %s for %q, Got: %s, %v", tc.d, tc.s, d, err)
+		}
+	}
+	for _, s := range []string{"a while", "30 moments", "and 5m", "minutes",
+		"5 minutes and"} {
+		if d, err := parseDuration(s); err == nil {
+			t.Errorf("Expected an error for %q, Got: %s", s, d)
+		}
+	}
+
+	c := &Counter{}
+	rtm := &r{}
+	if m := askToMeditate(c, rtm, "wisemonk meditate for 20 minutes"); m !=
+		"Okay, I am going to meditate for 20m0s" {
+		t.Errorf("Expected to meditate for 20 minutes, Got: %s", m)
+	}
+}
+
+func TestMeditationRemaining(t *testing.T) {
+	c := &Counter{ChannelId: "general"}
+	rtm := &r{}
+
+	c.SetMeditationEnd(30 * time.Second)
+	m := askToMeditate(c, rtm, "wisemonk meditate for 5m")
+	em := "I am meditating. My meditation will finish in 30s"
+	if m != em {
+		t.Errorf("Expected: %s, Got: %s", em, m)
+	}
+
+	c.SetMeditationEnd(4*time.Minute + 30*time.Second)
+	m = askToMeditate(c, rtm, "wisemonk meditate for 5m")
+	em = "I am meditating. My meditation will finish in 4m30s"
+	if m != em {
+		t.Errorf("Expected: %s, Got: %s", em, m)
+	}
+
+	if s := formatRemaining(200 * time.Millisecond); s != "1s" {
+		t.Errorf("Expected: %s, Got: %s", "1s", s)
+	}
+}
+
+func TestMaxMeditation(t *testing.T) {
+	c := &Counter{ChannelId: "general", MaxMeditation: "8h"}
+	rtm := &r{}
+
+	m := askToMeditate(c, rtm, "wisemonk meditate for 9h")
+	em := "It's hard to meditate for more than 8h0m0s at one go you know."
 	if m != em {
 		t.Errorf("Expected: %s, Got: %s", em, m)
 	}
+
+	m = askToMeditate(c, rtm, "wisemonk meditate for 5h")
+	em = "Okay, I am going to meditate for 5h0m0s"
+	if m != em {
+		t.Errorf("Expected: %s, Got: %s", em, m)
+	}
+}
+
+func TestMeditationWakeMessage(t *testing.T) {
+	c := &Counter{ChannelId: "general"}
+	rtm := &r{}
+
+	askToMeditate(c, rtm, "wisemonk meditate for 50ms")
+	// Asking again while meditating shouldn't schedule another wake up.
+	askToMeditate(c, rtm, "wisemonk meditate for 50ms")
+	time.Sleep(200 * time.Millisecond)
+
+	rtm.Lock()
+	defer rtm.Unlock()
+	wakes := 0
+	for _, m := range rtm.msgs {
+		if m == wakeMsg {
+			wakes++
+		}
+	}
+	if wakes != 1 {
+		t.Errorf("Expected %d wake message, Got: %d", 1, wakes)
+	}
+}
+
+func TestWakeUp(t *testing.T) {
+	c := &Counter{ChannelId: "general"}
+	rtm := &r{}
+
+	wakeUp(c, "wisemonk wake up", rtm)
+	if m := rtm.lastMsg(); m != "I am not meditating." {
+		t.Errorf("Expected: %s, Got: %s", "I am not meditating.", m)
+	}
+
+	askToMeditate(c, rtm, "wisemonk meditate for 50ms")
+	wakeUp(c, "wisemonk wake up", rtm)
+	if m := rtm.lastMsg(); m != "I'm awake now." {
+		t.Errorf("Expected: %s, Got: %s", "I'm awake now.", m)
+	}
+	if d := c.MeditationEnd(); d > 0 {
+		t.Errorf("Expected meditation to have ended, Got: %v", d)
+	}
+
+	// The pending wake up message shouldn't be sent anymore.
+	time.Sleep(200 * time.Millisecond)
+	if m := rtm.lastMsg(); m != "I'm awake now." {
+		t.Errorf("Expected no wake message after waking up, Got: %s", m)
+	}
 }
 
 func TestIncrement(t *testing.T) {
@@ -135,6 +592,26 @@ func TestIncrement(t *testing.T) {
 	}
 }
 
+func TestIncrementUser(t *testing.T) {
+	c := &Counter{ChannelId: "general"}
+	memmap := map[string]string{"U13LHF42F": "mrjn"}
+	c.Increment(&slack.Msg{Channel: "general", User: "U13LHF42F",
+		Timestamp: "1465010249.000606", Text: "First message"}, memmap)
+
+	m := c.buckets[0].msgs[0]
+	if m.User != "U13LHF42F" || m.Name != "mrjn" {
+		t.Errorf("Expected message from U13LHF42F (mrjn), Got: %s (%s)",
+			m.User, m.Name)
+	}
+	if m.Timestamp != "1465010249.000606" {
+		t.Errorf("Expected timestamp %s, Got: %s", "1465010249.000606",
+			m.Timestamp)
+	}
+	if s := m.String(); s != "mrjn          : First message" {
+		t.Errorf("Expected: %s, Got: %s", "mrjn          : First message", s)
+	}
+}
+
 func addBuckets(c *Counter, text string, t int64) {
 	for i := 0; i < 10; i++ {
 		c.Increment(&slack.Msg{Channel: "general",
@@ -143,8 +620,194 @@ func addBuckets(c *Counter, text string, t int64) {
 	}
 }
 
-func TestCount(t *testing.T) {
+// sortingCount is how Count used to work, sorting the buckets on every call.
+func sortingCount(c *Counter) int {
+	c.Lock()
+	defer c.Unlock()
+	sort.Sort(ByTimestamp(c.buckets))
+	interval, _ := time.ParseDuration(c.Interval)
+	timeSince := time.Now().Add(-interval).Unix()
+	idx := 0
+	for i, b := range c.buckets {
+		if b.utime > timeSince {
+			idx = i
+			break
+		}
+	}
+	if idx > 0 {
+		for i := idx; i < len(c.buckets); i++ {
+			c.buckets[i-idx] = c.buckets[i]
+		}
+		c.buckets = c.buckets[0 : len(c.buckets)-idx]
+	}
+	count := 0
+	for _, b := range c.buckets {
+		count += b.count
+	}
+	return count
+}
+
+// newBenchCounters returns two counters with the same n buckets, a tenth of
+// which have expired. The buckets are added in a random order if shuffle is
+// set.
+func newBenchCounters(n int, shuffle bool) (*Counter, *Counter) {
+	now := time.Now().Unix()
+	ts := make([]int64, n)
+	for i := range ts {
+		ts[i] = now - int64(n) + int64(i) + int64(n/10) - 3600
+	}
+	if shuffle {
+		rand.Shuffle(len(ts), func(i, j int) { ts[i], ts[j] = ts[j], ts[i] })
+	}
+	a := &Counter{Interval: "1h", MaxBufferedMsgs: 2 * n}
+	a.setup("general")
+	b := &Counter{Interval: "1h", MaxBufferedMsgs: 2 * n}
+	b.setup("general")
+	for _, t := range ts {
+		m := &slack.Msg{Channel: "general", Text: "bench",
+			Timestamp: strconv.FormatInt(t, 10)}
+		a.Increment(m, nil)
+		b.Increment(m, nil)
+	}
+	return a, b
+}
+
+func TestCountMatchesSortingCount(t *testing.T) {
+	a, b := newBenchCounters(1000, true)
+	if !sort.IsSorted(ByTimestamp(a.buckets)) {
+		t.Errorf("Expected buckets to be kept sorted")
+	}
+	if got, want := a.Count(), sortingCount(b); got != want || got == 0 {
+		t.Errorf("Expected count to be %d, Got: %d", want, got)
+	}
+	if len(a.buckets) != len(b.buckets) {
+		t.Errorf("Expected %d buckets, Got: %d", len(b.buckets),
+			len(a.buckets))
+	}
+}
+
+func TestCountAllExpired(t *testing.T) {
 	c := &Counter{ChannelId: "general", Interval: "10m"}
+	addBuckets(c, "Old buckets", time.Now().Add(-time.Hour).Unix())
+	// sortingCount kept all the buckets when none of them were in the
+	// interval.
+	if count := c.Count(); count != 0 {
+		t.Errorf("Expected count to be %d, Got: %d", 0, count)
+	}
+	if len(c.buckets) != 0 {
+		t.Errorf("Expected %d buckets, Got: %d", 0, len(c.buckets))
+	}
+}
+
+func BenchmarkCount(b *testing.B) {
+	c, _ := newBenchCounters(10000, false)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Count()
+	}
+}
+
+// shiftExpired is how expired buckets used to be dropped, by shifting the rest
+// of the buckets to the start of the slice.
+func shiftExpired(c *Counter, timeSince int64) {
+	idx := 0
+	for i, b := range c.buckets {
+		if b.utime > timeSince {
+			idx = i
+			break
+		}
+	}
+	if idx > 0 {
+		for i := idx; i < len(c.buckets); i++ {
+			c.buckets[i-idx] = c.buckets[i]
+		}
+		c.buckets = c.buckets[0 : len(c.buckets)-idx]
+	}
+}
+
+func TestDropExpiredMatchesShiftExpired(t *testing.T) {
+	a, b := newBenchCounters(1000, true)
+	for _, d := range []int64{0, 5, 5, 200} {
+		timeSince := time.Now().Add(-time.Hour).Unix() - 1000 + d
+		a.dropExpired(timeSince)
+		shiftExpired(b, timeSince)
+		if len(a.buckets) != len(b.buckets) ||
+			a.buckets[0].utime != b.buckets[0].utime {
+			t.Errorf("Expected %d buckets from %d, Got: %d from %d",
+				len(b.buckets), b.buckets[0].utime, len(a.buckets),
+				a.buckets[0].utime)
+		}
+	}
+}
+
+// benchmarkExpiry benchmarks 1000 ticks on 10k buckets, one second apart, with
+// one bucket expiring every tick.
+func benchmarkExpiry(b *testing.B, drop func(*Counter, int64)) {
+	c := &Counter{}
+	var buckets []Bucket
+	for i := 0; i < 10000; i++ {
+		buckets = append(buckets, Bucket{utime: int64(i), count: 1})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		c.buckets = append([]Bucket(nil), buckets...)
+		b.StartTimer()
+		for tick := int64(0); tick < 1000; tick++ {
+			drop(c, tick)
+		}
+	}
+}
+
+func BenchmarkDropExpired(b *testing.B) {
+	benchmarkExpiry(b, (*Counter).dropExpired)
+}
+
+func BenchmarkShiftExpired(b *testing.B) {
+	benchmarkExpiry(b, shiftExpired)
+}
+
+func BenchmarkSortingCount(b *testing.B) {
+	c, _ := newBenchCounters(10000, false)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sortingCount(c)
+	}
+}
+
+func TestMaxBufferedMsgs(t *testing.T) {
+	c := &Counter{Interval: "10m", MaxBufferedMsgs: 50}
+	c.setup("general")
+	now := time.Now().Unix()
+	// 500 messages spread over 100 seconds.
+	for i := 0; i < 500; i++ {
+		c.Increment(&slack.Msg{Channel: "general", User: "U13LHF42F",
+			Text:      "flood " + strconv.Itoa(i),
+			Timestamp: strconv.FormatInt(now-100+int64(i/5), 10)}, nil)
+	}
+
+	msgs := 0
+	for _, b := range c.buckets {
+		msgs += len(b.msgs)
+	}
+	if msgs != 50 {
+		t.Errorf("Expected %d messages to be kept, Got: %d", 50, msgs)
+	}
+	if len(c.buckets) != 100 {
+		t.Errorf("Expected %d buckets, Got: %d", 100, len(c.buckets))
+	}
+	if count := c.Count(); count != 500 {
+		t.Errorf("Expected count to be %d, Got: %d", 500, count)
+	}
+	if first := c.firstMessage(); !strings.HasSuffix(first, ": flood 450") {
+		t.Errorf("Expected oldest kept message to be flood 450, Got: %s",
+			first)
+	}
+}
+
+func TestCount(t *testing.T) {
+	c := &Counter{Interval: "10m"}
+	c.setup("general")
 	timeNow := time.Now().Unix()
 	addBuckets(c, "New buckets", timeNow)
 
@@ -158,6 +821,31 @@ func TestCount(t *testing.T) {
 	}
 }
 
+func TestConcurrentIncrementAndCount(t *testing.T) {
+	c := &Counter{Interval: "10m"}
+	c.setup("general")
+	timeNow := time.Now().Unix()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			addBuckets(c, "New buckets", timeNow)
+		}()
+		go func() {
+			defer wg.Done()
+			c.Count()
+			c.transcript()
+		}()
+	}
+	wg.Wait()
+
+	if count := c.Count(); count != 100 {
+		t.Errorf("Expected count to be %d, Got: %d", 100, count)
+	}
+}
+
 func createServer(t *testing.T, status int, i interface{}) *httptest.Server {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
 		r *http.Request) {
@@ -172,6 +860,7 @@ func createServer(t *testing.T, status int, i interface{}) *httptest.Server {
 }
 
 func TestCreateTopic(t *testing.T) {
+	saveConf(t)
 	c := &Counter{ChannelId: "general"}
 	timeNow := time.Now().Unix()
 	addBuckets(c, "New buckets", timeNow)
@@ -180,48 +869,338 @@ func TestCreateTopic(t *testing.T) {
 	conf.DiscPrefix = ts.URL
 	defer ts.Close()
 
-	if url := createTopic(c, "Test title"); url != "" {
-		t.Errorf("Expected url to be blank, Got: ", url)
+	if url, err := createTopic(c, "Test title"); url != "" || err == nil {
+		t.Errorf("Expected url to be blank and an error, Got: %s, %v",
+			url, err)
 	}
 
 	ts = createServer(t, http.StatusOK,
 		TopicBody{Id: 1, Slug: "test-title-created"})
 	conf.DiscPrefix = ts.URL
-	if url := createTopic(c, "Test title"); !strings.Contains(url,
+	if url, _ := createTopic(c, "Test title"); !strings.Contains(url,
 		"test-title-created") {
 		t.Errorf("Expected url to contain test-title-created, Got: %s",
 			url)
 	}
 }
 
-type r struct {
-}
+func TestCreateTopicRetryAfter(t *testing.T) {
+	saveConf(t)
+	c := &Counter{ChannelId: "general"}
+	addBuckets(c, "New buckets", time.Now().Unix())
 
-var invoked = false
+	calls := 0
+	retryAfterSecs := "1"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", retryAfterSecs)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		json.NewEncoder(w).Encode(TopicBody{Id: 1, Slug: "test-title-created"})
+	}))
+	defer ts.Close()
+	conf.DiscPrefix = ts.URL
 
-func (rtm *r) SendMessage(msg *slack.OutgoingMessage) {
-	invoked = true
-}
+	start := time.Now()
+	url, err := createTopic(c, "Test title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(url, "test-title-created") {
+		t.Errorf("Expected url to contain test-title-created, Got: %s", url)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("Expected to wait for a second before retrying, Got: %v", d)
+	}
 
-func (rtm *r) NewOutgoingMessage(text string, channel string) *slack.OutgoingMessage {
-	return new(slack.OutgoingMessage)
+	// Waits longer than maxRetryWait aren't made.
+	calls = 0
+	retryAfterSecs = "3600"
+	start = time.Now()
+	if _, err := createTopic(c, "Test title"); err == nil {
+		t.Errorf("Expected error when asked to wait too long")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected to give up right away, Got: %v", d)
+	}
 }
 
-func TestSearchDiscourse(t *testing.T) {
-	c := &Counter{ChannelId: "general", SearchOver: []string{"Slack"}}
-	discourseCategory = make(map[int]string)
-	discourseCategory[1] = "Slack"
-	discourseCategory[2] = "Reading"
-	rtm := &r{}
-	invoked = false
-	conf.DiscKey = "testkey"
-	ts := createServer(t, http.StatusOK,
-		SearchResponse{Topics: []SearchTopic{
-			{Id: 1, Slug: "test-1", Category: 1},
-			{Id: 2, Slug: "test-2", Category: 2},
-		}})
-	conf.DiscPrefix = ts.URL
-	if searchDiscourse(c, "wisemonk search something", rtm); invoked {
+func TestCreateTopicRetry(t *testing.T) {
+	saveConf(t)
+	c := &Counter{ChannelId: "general"}
+	addBuckets(c, "New buckets", time.Now().Unix())
+
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		calls++
+		if calls <= 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		json.NewEncoder(w).Encode(TopicBody{Id: 1, Slug: "test-title-created"})
+	}))
+	defer ts.Close()
+	conf.DiscPrefix = ts.URL
+
+	url, err := createTopic(c, "Test title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(url, "test-title-created") {
+		t.Errorf("Expected url to contain test-title-created, Got: %s", url)
+	}
+	if calls != 3 {
+		t.Errorf("Expected %d calls, Got: %d", 3, calls)
+	}
+
+	// Client errors are not retried.
+	calls = 0
+	ts403 := createServer(t, http.StatusForbidden, TopicBody{})
+	defer ts403.Close()
+	conf.DiscPrefix = ts403.URL
+	if _, err := createTopic(c, "Test title"); err == nil {
+		t.Errorf("Expected an error for status %d", http.StatusForbidden)
+	}
+}
+
+func TestCreateNewTopicReply(t *testing.T) {
+	saveConf(t)
+	conf.DiscKey = "testkey"
+	ok := createServer(t, http.StatusOK, TopicBody{Id: 1, Slug: "release-plans"})
+	defer ok.Close()
+	failed := createServer(t, http.StatusUnprocessableEntity, TopicBody{})
+	defer failed.Close()
+
+	for _, tc := range []struct {
+		prefix   string
+		expected string
+	}{
+		{ok.URL, "New topic created: <" + ok.URL +
+			"/t/release-plans/1|Plans &amp; dates for v0.8>"},
+		{failed.URL, errMsg},
+	} {
+		conf.DiscPrefix = tc.prefix
+		c := &Counter{ChannelId: "general"}
+		addBuckets(c, "New buckets", time.Now().Unix())
+		rtm := &r{}
+		createNewTopic(c, "wisemonk create topic Plans & dates for v0.8", rtm)
+		if rtm.lastMsg() != tc.expected {
+			t.Errorf("Expected: %s, Got: %s", tc.expected, rtm.lastMsg())
+		}
+	}
+}
+
+func TestParseTopicId(t *testing.T) {
+	saveConf(t)
+	conf.DiscPrefix = "https://discuss.dgraph.io"
+
+	for _, tc := range []struct {
+		topic string
+		id    int
+	}{
+		{"12", 12},
+		{"https://discuss.dgraph.io/t/release-plans/12", 12},
+		{"https://discuss.dgraph.io/t/release-plans/12/4", 12},
+		{"<https://discuss.dgraph.io/t/release-plans/12/>", 12},
+		{"<https://discuss.dgraph.io/t/release-plans/12|plans>", 12},
+		{"https://example.com/t/release-plans/12", 0},
+		{"https://discuss.dgraph.io/t/release-plans", 0},
+		{"https://discuss.dgraph.io/t/release-plans/latest", 0},
+		{"-3", 0},
+	} {
+		id, err := parseTopicId(tc.topic)
+		if tc.id == 0 && err == nil {
+			t.Errorf("Expected an error for %s, Got: %d", tc.topic, id)
+		}
+		if tc.id != 0 && (err != nil || id != tc.id) {
+			t.Errorf("Expected %d for %s, Got: %d, %v", tc.id, tc.topic, id,
+				err)
+		}
+	}
+}
+
+func TestAppendToTopic(t *testing.T) {
+	saveConf(t)
+	var reply map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&reply); err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(ReplyBody{TopicBody: TopicBody{Id: 12,
+			Slug: "release-plans"}, PostNumber: 5})
+	}))
+	defer ts.Close()
+	conf.DiscKey = "testkey"
+	conf.DiscPrefix = ts.URL
+
+	c := &Counter{ChannelId: "general"}
+	addBuckets(c, "New buckets", time.Now().Unix())
+	rtm := &r{}
+	appendToTopic(c, "wisemonk append to <"+ts.URL+"/t/release-plans/12>",
+		rtm)
+
+	if id, ok := reply["topic_id"].(float64); !ok || id != 12 {
+		t.Errorf("Expected the reply to be for topic 12, Got: %v", reply)
+	}
+	if _, ok := reply["title"]; ok {
+		t.Errorf("Expected no title for a reply, Got: %v", reply)
+	}
+	if raw, _ := reply["raw"].(string); !strings.Contains(raw, "New buckets") {
+		t.Errorf("Expected the messages in the reply, Got: %s", raw)
+	}
+	expected := "Messages added to <" + ts.URL + "/t/release-plans/12/5|the topic>"
+	if rtm.lastMsg() != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, rtm.lastMsg())
+	}
+	if count := c.Count(); count != 0 {
+		t.Errorf("Expected the buckets to be cleared, Got: %d", count)
+	}
+
+	appendToTopic(c, "wisemonk append to the release topic", rtm)
+	expected = "Sorry, I don't understand which topic that is."
+	if rtm.lastMsg() != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, rtm.lastMsg())
+	}
+}
+
+func TestTopicTags(t *testing.T) {
+	saveConf(t)
+	c := &Counter{ChannelId: "general", CreateTopicIn: "slack",
+		TopicTags: []string{"release", "from-slack"}}
+	addBuckets(c, "New buckets", time.Now().Unix())
+	discourse().cats.set(map[int]string{1: "slack"})
+
+	var topic Topic
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&topic); err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(TopicBody{Id: 1, Slug: "test"})
+	}))
+	defer ts.Close()
+	conf.DiscPrefix = ts.URL
+
+	if _, err := createTopic(c, "Test title"); err != nil {
+		t.Fatal(err)
+	}
+	if len(topic.Tags) != 2 || topic.Tags[0] != "from-slack" ||
+		topic.Tags[1] != "release" {
+		t.Errorf("Expected tags [from-slack release], Got: %v", topic.Tags)
+	}
+}
+
+func TestTopicRaw(t *testing.T) {
+	// The counter is for the channel with id general, which is named dev.
+	namer = newNameCache(&fakeNamer{names: map[string]string{
+		"general": "dev"}})
+	defer func() { namer = nil }()
+	c := &Counter{ChannelId: "general"}
+	addBuckets(c, "New buckets", 1465010249)
+
+	raw := topicRaw(c)
+	for _, s := range []string{
+		"[#dev](https://slack.com/app_redirect?channel=general)",
+		"from Sat, 04 Jun 2016 03:17:20 UTC to Sat, 04 Jun 2016 03:17:29 UTC",
+		"[10]               : New buckets",
+	} {
+		if !strings.Contains(raw, s) {
+			t.Errorf("Expected raw to contain %s, Got: %s", s, raw)
+		}
+	}
+}
+
+func TestTopicRawTruncated(t *testing.T) {
+	saveConf(t)
+	conf.MaxPostLength = 1000
+
+	c := &Counter{ChannelId: "general"}
+	for i := 0; i < 10; i++ {
+		addBuckets(c, strings.Repeat("long message ", 5), 1465010249)
+	}
+	raw := topicRaw(c)
+	if n := utf8.RuneCountInString(raw); n > conf.MaxPostLength {
+		t.Errorf("Expected at most %d characters, Got: %d", conf.MaxPostLength,
+			n)
+	}
+	if !strings.HasSuffix(raw, " more messages omitted\n```") {
+		t.Errorf("Expected a note about the omitted messages, Got: %s", raw)
+	}
+	if !strings.Contains(raw, "[ 1] ") {
+		t.Errorf("Expected the first messages to be kept, Got: %s", raw)
+	}
+
+	// The count in the note covers all the messages left out.
+	lines := strings.Count(raw, ": long message")
+	var omitted int
+	fmt.Sscanf(raw[strings.LastIndex(raw, "... "):], "... %d", &omitted)
+	if lines+omitted != 100 {
+		t.Errorf("Expected %d messages in all, Got: %d kept and %d omitted",
+			100, lines, omitted)
+	}
+
+	conf.MaxPostLength = 0
+	if raw := topicRaw(c); strings.Contains(raw, "omitted") {
+		t.Errorf("Expected no messages to be omitted by default")
+	}
+}
+
+type r struct {
+	sync.Mutex
+	// Text of the messages sent through this rtm.
+	msgs []string
+	// Thread timestamp of the last reply sent in a thread.
+	threadTs string
+}
+
+var invoked = false
+
+func (rtm *r) SendMessage(msg *slack.OutgoingMessage) {
+	rtm.Lock()
+	defer rtm.Unlock()
+	invoked = true
+	rtm.msgs = append(rtm.msgs, msg.Text)
+}
+
+func (rtm *r) SendThreadReply(msg *slack.OutgoingMessage, threadTs string) {
+	rtm.SendMessage(msg)
+	rtm.Lock()
+	defer rtm.Unlock()
+	rtm.threadTs = threadTs
+}
+
+func (rtm *r) NewOutgoingMessage(text string, channel string) *slack.OutgoingMessage {
+	return &slack.OutgoingMessage{Text: text, Channel: channel}
+}
+
+func (rtm *r) lastMsg() string {
+	rtm.Lock()
+	defer rtm.Unlock()
+	if len(rtm.msgs) == 0 {
+		return ""
+	}
+	return rtm.msgs[len(rtm.msgs)-1]
+}
+
+func TestSearchDiscourse(t *testing.T) {
+	saveConf(t)
+	c := &Counter{ChannelId: "general", SearchOver: []string{"Slack"}}
+	discourse().cats.set(map[int]string{1: "Slack", 2: "Reading"})
+	rtm := &r{}
+	invoked = false
+	conf.DiscKey = "testkey"
+	ts := createServer(t, http.StatusOK,
+		SearchResponse{Topics: []SearchTopic{
+			{Id: 1, Slug: "test-1", Category: 1},
+			{Id: 2, Slug: "test-2", Category: 2},
+		}})
+	conf.DiscPrefix = ts.URL
+	if searchDiscourse(c, "wisemonk search something", rtm); invoked {
 		t.Errorf("rtm.SendMessage() should have been called")
 	}
 
@@ -230,151 +1209,2632 @@ func TestSearchDiscourse(t *testing.T) {
 	}
 }
 
-func TestFilterTopics(t *testing.T) {
-	c := &Counter{ChannelId: "general", SearchOver: []string{"Slack"}}
-	discourseCategory = make(map[int]string)
-	discourseCategory[1] = "Slack"
-	discourseCategory[2] = "Reading"
-	topics := []SearchTopic{
-		{Id: 1, Slug: "test-1", Category: 1},
-		{Id: 2, Slug: "test-2", Category: 2},
+func TestSearchAllCategories(t *testing.T) {
+	saveConf(t)
+	c := &Counter{ChannelId: "general", SearchOver: []string{"slack", "dev"}}
+	discourse().cats.set(map[int]string{1: "slack", 2: "reading", 3: "dev"})
+	ts := createServer(t, http.StatusOK,
+		SearchResponse{Topics: []SearchTopic{
+			{Id: 1, Title: "In slack", Slug: "in-slack", Category: 1},
+			{Id: 2, Title: "In reading", Slug: "in-reading", Category: 2},
+			{Id: 3, Title: "In dev", Slug: "in-dev", Category: 3},
+		}})
+	defer ts.Close()
+	conf.DiscPrefix = ts.URL
+	conf.DiscKey = "testkey"
+	rtm := &r{}
+
+	// Topics in any of the search_over categories.
+	searchDiscourse(c, "wisemonk query foo 5", rtm)
+	if m := rtm.lastMsg(); !strings.Contains(m, "In slack") ||
+		!strings.Contains(m, "In dev") || strings.Contains(m, "In reading") {
+		t.Errorf("Expected topics in slack and dev, Got: %s", m)
+	}
+
+	searchDiscourse(c, "wisemonk query foo 5 all", rtm)
+	if n := strings.Count(rtm.lastMsg(), "\n"); n != 3 {
+		t.Errorf("Expected %d results, Got: %d in %s", 3, n, rtm.lastMsg())
+	}
+}
+
+func TestSearchDuplicates(t *testing.T) {
+	saveConf(t)
+	c := &Counter{ChannelId: "general"}
+	ts := createServer(t, http.StatusOK,
+		SearchResponse{Topics: []SearchTopic{
+			{Id: 3, Title: "Third", Slug: "third", Category: 1},
+			{Id: 1, Title: "First", Slug: "first", Category: 1},
+			{Id: 3, Title: "Third", Slug: "third", Category: 1},
+			{Id: 2, Title: "Second", Slug: "second", Category: 1},
+			{Id: 1, Title: "First", Slug: "first", Category: 1},
+		}})
+	defer ts.Close()
+	conf.DiscPrefix = ts.URL
+	conf.DiscKey = "testkey"
+	rtm := &r{}
+
+	searchDiscourse(c, "wisemonk query foo 3", rtm)
+	lines := strings.Split(strings.TrimSpace(rtm.lastMsg()), "\n")
+	var titles []string
+	for _, l := range lines {
+		titles = append(titles, strings.SplitN(l, " ", 2)[0])
+	}
+	if got := strings.Join(titles, ","); got != "Third,First,Second" {
+		t.Errorf("Expected each topic once in the order discourse ranked them, Got: %s",
+			got)
+	}
+}
+
+func TestSearchResultsCount(t *testing.T) {
+	saveConf(t)
+	c := &Counter{ChannelId: "general", SearchOver: []string{"Slack"}}
+	discourse().cats.set(map[int]string{1: "Slack"})
+	var topics []SearchTopic
+	for i := 0; i < 15; i++ {
+		topics = append(topics, SearchTopic{Id: i, Slug: "test",
+			Category: 1})
+	}
+	ts := createServer(t, http.StatusOK, SearchResponse{Topics: topics})
+	defer ts.Close()
+	conf.DiscPrefix = ts.URL
+	conf.DiscKey = "testkey"
+	rtm := &r{}
+
+	searchDiscourse(c, "wisemonk query foo 15", rtm)
+	if n := strings.Count(rtm.lastMsg(), "\n"); n != 10 {
+		t.Errorf("Expected %d results, Got: %d", 10, n)
+	}
+
+	searchDiscourse(c, "wisemonk query foo 3", rtm)
+	if n := strings.Count(rtm.lastMsg(), "\n"); n != 3 {
+		t.Errorf("Expected %d results, Got: %d", 3, n)
+	}
+
+	searchDiscourse(c, "wisemonk query foo 0", rtm)
+	if m := rtm.lastMsg(); m != "Okay, I won't look for any topics then." {
+		t.Errorf("Expected no results to be searched for, Got: %s", m)
+	}
+
+	searchDiscourse(c, "wisemonk query foo -3", rtm)
+	if m := rtm.lastMsg(); m != "Sorry, I can't find less than zero topics." {
+		t.Errorf("Expected negative count to be rejected, Got: %s", m)
+	}
+}
+
+func TestSearchResultTitles(t *testing.T) {
+	saveConf(t)
+	c := &Counter{ChannelId: "general"}
+	ts := createServer(t, http.StatusOK, SearchResponse{Topics: []SearchTopic{
+		{Id: 1, Slug: "release-v0-3", Title: "Release v0.3 is out"},
+		{Id: 2, Slug: "no-title"},
+	}})
+	defer ts.Close()
+	conf.DiscPrefix = ts.URL
+	conf.DiscKey = "testkey"
+	rtm := &r{}
+
+	searchDiscourse(c, "wisemonk query release", rtm)
+	m := rtm.lastMsg()
+	for _, s := range []string{
+		"Release v0.3 is out — " + ts.URL + "/t/release-v0-3/1",
+		"no-title — " + ts.URL + "/t/no-title/2",
+	} {
+		if !strings.Contains(m, s) {
+			t.Errorf("Expected results to contain %s, Got: %s", s, m)
+		}
+	}
+}
+
+func TestSearchOrder(t *testing.T) {
+	saveConf(t)
+	c := &Counter{ChannelId: "general"}
+	var order string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		order = r.URL.Query().Get("order")
+		json.NewEncoder(w).Encode(SearchResponse{})
+	}))
+	defer ts.Close()
+	conf.DiscPrefix = ts.URL
+	conf.DiscKey = "testkey"
+	rtm := &r{}
+
+	for _, o := range []string{"latest", "likes"} {
+		searchDiscourse(c, "wisemonk query foo 3 "+o, rtm)
+		if order != o {
+			t.Errorf("Expected order to be %s, Got: %s", o, order)
+		}
+	}
+
+	order = ""
+	searchDiscourse(c, "wisemonk query foo 3 oldest", rtm)
+	if order != "" {
+		t.Errorf("Expected search to not be done for an unknown order")
+	}
+	if m := rtm.lastMsg(); !strings.Contains(m, "views, latest, likes") {
+		t.Errorf("Expected reply to list the orders, Got: %s", m)
+	}
+}
+
+func TestDiscourseServerError(t *testing.T) {
+	saveConf(t)
+	c := &Counter{ChannelId: "general", SearchOver: []string{"Slack"}}
+	timeNow := time.Now().Unix()
+	ts := createServer(t, http.StatusInternalServerError, TopicBody{})
+	defer ts.Close()
+	conf.DiscPrefix = ts.URL
+	conf.DiscKey = "testkey"
+	rtm := &r{}
+
+	searchDiscourse(c, "wisemonk query test 5", rtm)
+	if m := rtm.lastMsg(); m != errMsg {
+		t.Errorf("Expected: %s, Got: %s", errMsg, m)
+	}
+
+	addBuckets(c, "New buckets", timeNow)
+	createNewTopic(c, "wisemonk create topic testing wisemonk", rtm)
+	if m := rtm.lastMsg(); m != errMsg {
+		t.Errorf("Expected: %s, Got: %s", errMsg, m)
+	}
+
+	sendMessage(c, rtm)
+	if m := rtm.lastMsg(); !strings.Contains(m, errMsg) {
+		t.Errorf("Expected message to contain %s, Got: %s", errMsg, m)
+	}
+}
+
+func TestReportStatus(t *testing.T) {
+	c := &Counter{Interval: "10m", MaxMsg: 20}
+	c.setup("general")
+	addBuckets(c, "New buckets", time.Now().Unix())
+	rtm := &r{}
+
+	reportStatus(c, "wisemonk stats", rtm)
+	if len(rtm.msgs) != 0 {
+		t.Errorf("Expected no reply, Got: %s", rtm.lastMsg())
+	}
+
+	reportStatus(c, "wisemonk status", rtm)
+	m := rtm.lastMsg()
+	for _, s := range []string{"last 10m: 10", "Max messages: 20",
+		"not meditating"} {
+		if !strings.Contains(m, s) {
+			t.Errorf("Expected reply to contain %s, Got: %s", s, m)
+		}
+	}
+
+	c.SetMeditationEnd(5 * time.Minute)
+	reportStatus(c, "wisemonk status", rtm)
+	if m = rtm.lastMsg(); !strings.Contains(m, "meditating for another 5m0s") {
+		t.Errorf("Expected reply to mention meditation, Got: %s", m)
+	}
+}
+
+func TestLastMessage(t *testing.T) {
+	c := &Counter{ChannelId: "general", Interval: "10m", MaxMsg: 20}
+	rtm := &r{}
+	reportStatus(c, "wisemonk status", rtm)
+	if m := rtm.lastMsg(); !strings.HasSuffix(m, "No messages since I started.") {
+		t.Errorf("Expected reply to say there are no messages, Got: %s", m)
+	}
+
+	now := time.Now().Unix()
+	c.Increment(&slack.Msg{Channel: "general", Text: "hello",
+		Timestamp: strconv.FormatInt(now-120, 10)}, map[string]string{})
+	if lm := c.LastMessage(); lm.Unix() != now-120 {
+		t.Errorf("Expected last message at %d, Got: %d", now-120, lm.Unix())
+	}
+	// An older message that arrives late doesn't change it.
+	c.Increment(&slack.Msg{Channel: "general", Text: "late",
+		Timestamp: strconv.FormatInt(now-300, 10)}, map[string]string{})
+	if lm := c.LastMessage(); lm.Unix() != now-120 {
+		t.Errorf("Expected last message at %d, Got: %d", now-120, lm.Unix())
+	}
+
+	reportStatus(c, "wisemonk status", rtm)
+	if m := rtm.lastMsg(); !strings.Contains(m, "The last message was 2m") {
+		t.Errorf("Expected reply to mention the last message, Got: %s", m)
+	}
+}
+
+func TestSendHelp(t *testing.T) {
+	c := &Counter{ChannelId: "general"}
+	rtm := &r{}
+
+	sendHelp(c, "wisemonk hlp", rtm)
+	if len(rtm.msgs) != 0 {
+		t.Errorf("Expected no reply, Got: %s", rtm.lastMsg())
+	}
+
+	sendHelp(c, "wisemonk help", rtm)
+	m := rtm.lastMsg()
+	for _, s := range []string{"meditate", "create topic", "query", "status"} {
+		if !strings.Contains(m, s) {
+			t.Errorf("Expected help to mention %s, Got: %s", s, m)
+		}
+	}
+}
+
+func TestDiscourseAuthHeaders(t *testing.T) {
+	saveConf(t)
+	var key, username, query string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		key = r.Header.Get("Api-Key")
+		username = r.Header.Get("Api-Username")
+		query = r.URL.RawQuery
+		json.NewEncoder(w).Encode(TopicBody{Id: 1, Slug: "test"})
+	}))
+	defer ts.Close()
+	conf.DiscPrefix = ts.URL
+	conf.DiscKey = "testkey"
+	conf.DiscAuthHeaders = true
+
+	c := &Counter{ChannelId: "general", SearchOver: []string{"Slack"}}
+	addBuckets(c, "New buckets", time.Now().Unix())
+	for _, f := range []func(){
+		func() { createTopic(c, "Test title") },
+		func() { searchDiscourse(c, "wisemonk query test", &r{}) },
+	} {
+		key, username, query = "", "", ""
+		f()
+		if key != "testkey" || username != "wisemonk" {
+			t.Errorf("Expected credentials in the headers, Got: %s, %s",
+				key, username)
+		}
+		if strings.Contains(query, "testkey") {
+			t.Errorf("Expected key to not be in the url, Got: %s", query)
+		}
+	}
+}
+
+func TestDiscourseUsername(t *testing.T) {
+	saveConf(t)
+	conf.DiscPrefix = "https://discuss.dgraph.io"
+	conf.DiscKey = "testkey"
+	if q := discourseQuery("posts.json", ""); !strings.Contains(q,
+		"api_username=wisemonk&") {
+		t.Errorf("Expected default username in the query, Got: %s", q)
+	}
+
+	conf.DiscUsername = "system"
+	if q := discourseQuery("posts.json", ""); !strings.Contains(q,
+		"api_username=system&") {
+		t.Errorf("Expected username system in the query, Got: %s", q)
+	}
+}
+
+func TestFilterTopics(t *testing.T) {
+	c := &Counter{ChannelId: "general", SearchOver: []string{"Slack"}}
+	d := newDiscourseClient("", "", "")
+	d.cats.set(map[int]string{1: "Slack", 2: "Reading"})
+	topics := []SearchTopic{
+		{Id: 1, Slug: "test-1", Category: 1},
+		{Id: 2, Slug: "test-2", Category: 2},
+	}
+	ft := d.filterTopics(c.SearchOver, topics)
+	if len(ft) != 1 {
+		t.Errorf("Expected filtered topics to have length %d. Got: %d",
+			1, len(ft))
+	}
+}
+
+func TestDiscourseClient(t *testing.T) {
+	var posted Topic
+	var auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		auth = r.Header.Get("Api-Key") + " " + r.Header.Get("Api-Username")
+		switch r.URL.Path {
+		case "/categories.json":
+			w.Write([]byte(`{"category_list": {"categories": [
+				{"id": 1, "slug": "slack"}, {"id": 2, "slug": "dev"}]}}`))
+		case "/posts.json":
+			json.NewDecoder(r.Body).Decode(&posted)
+			w.Write([]byte(`{"topic_id": 7, "topic_slug": "release-plans"}`))
+		case "/search.json":
+			w.Write([]byte(`{"topics": [
+				{"id": 1, "title": "In slack", "slug": "in-slack", "category_id": 1},
+				{"id": 2, "title": "In dev", "slug": "in-dev", "category_id": 2}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	oldPrefix := conf.DiscPrefix
+	oldSlugs := strings.Join(discourse().cats.sortedSlugs(), ",")
+
+	d := newDiscourseClient(ts.URL, "testkey", "system")
+	d.AuthHeaders = true
+	d.HTTP = ts.Client()
+	cats, err := d.Categories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cats) != 2 || cats[2] != "dev" {
+		t.Errorf("Expected categories slack and dev, Got: %v", cats)
+	}
+	if auth != "testkey system" {
+		t.Errorf("Expected credentials in the headers, Got: %s", auth)
+	}
+
+	u, err := d.CreateTopic(Topic{Title: "Release plans for v0.8",
+		Raw: "Some messages", Category: "dev"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != ts.URL+"/t/release-plans/7" || posted.Category != "2" {
+		t.Errorf("Expected topic 7 in category 2, Got: %s in %s", u,
+			posted.Category)
+	}
+	if _, err := d.CreateTopic(Topic{Title: "Release plans for v0.8",
+		Category: "missing"}); err != errUnknownCategory {
+		t.Errorf("Expected error %v, Got: %v", errUnknownCategory, err)
+	}
+
+	results, err := d.Search("release", "views", []string{"dev"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Url != ts.URL+"/t/in-dev/2" {
+		t.Errorf("Expected only the topic in dev, Got: %+v", results)
+	}
+
+	// The client doesn't touch the config or the categories of the other clients.
+	if conf.DiscPrefix != oldPrefix {
+		t.Errorf("Expected the config to be unchanged, Got: %s", conf.DiscPrefix)
+	}
+	if slugs := strings.Join(discourse().cats.sortedSlugs(), ","); slugs != oldSlugs {
+		t.Errorf("Expected the config's categories to be %s, Got: %s", oldSlugs,
+			slugs)
+	}
+}
+
+func TestFilterTopicsEmptySearchOver(t *testing.T) {
+	c := &Counter{ChannelId: "general"}
+	d := newDiscourseClient("", "", "")
+	d.cats.set(map[int]string{1: "Slack", 2: "Reading"})
+	topics := []SearchTopic{
+		{Id: 1, Slug: "test-1", Category: 1},
+		{Id: 2, Slug: "test-2", Category: 2},
+		{Id: 3, Slug: "test-3", Category: 3},
+	}
+	if ft := d.filterTopics(c.SearchOver, topics); len(ft) != 3 {
+		t.Errorf("Expected filtered topics to have length %d. Got: %d",
+			3, len(ft))
+	}
+}
+
+func TestCheckOrIncrDone(t *testing.T) {
+	c := &Counter{ChannelId: "general", Interval: "10m",
+		messages: make(chan *slack.Msg)}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go c.checkOrIncr(&r{}, &wg, noUsers(), done)
+
+	returned := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(returned)
+	}()
+	close(done)
+
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Errorf("Expected checkOrIncr to return after done was closed")
+	}
+}
+
+func TestCallYoda(t *testing.T) {
+	c := &Counter{ChannelId: "general"}
+	timeNow := time.Now().Unix()
+	addBuckets(c, "New buckets", timeNow)
+	rtm := &r{}
+
+	if callYoda(c, rtm, "Message to append"); !invoked {
+		t.Errorf("Expected invoked to be %t, Got: %t", true, false)
+	}
+}
+
+func TestCallYodaNudgeMessage(t *testing.T) {
+	msg := "#random is for chitchat, please take engineering talk to #eng."
+	c := &Counter{ChannelId: "general", NudgeMessage: msg}
+	rtm := &r{}
+
+	callYoda(c, rtm, "")
+	if !strings.Contains(rtm.lastMsg(), msg) {
+		t.Errorf("Expected alert to contain %s, Got: %s", msg, rtm.lastMsg())
+	}
+	if !strings.Contains(rtm.lastMsg(), string(yoda)) {
+		t.Errorf("Expected alert to contain yoda, Got: %s", rtm.lastMsg())
+	}
+	for _, q := range quotes {
+		if strings.Contains(rtm.lastMsg(), q) {
+			t.Errorf("Expected no quote in the alert, Got: %s", rtm.lastMsg())
+		}
+	}
+}
+
+func TestCallYodaLongMessage(t *testing.T) {
+	link := "Please move your discussion to https://discuss.dgraph.io/t/long/1"
+	for _, tc := range []struct {
+		quote string
+		m     string
+	}{
+		{"Clear is better than clever.", strings.Repeat("a", 39900) + link},
+		{strings.Repeat("q", 50000), link},
+		{"Clear is better than clever.", strings.Repeat("é", 50000) + link},
+	} {
+		c := &Counter{ChannelId: "general", NudgeMessage: tc.quote}
+		rtm := &r{}
+		callYoda(c, rtm, tc.m)
+		msg := rtm.lastMsg()
+		if n := utf8.RuneCountInString(msg); n > maxSlackMsgLen {
+			t.Errorf("Expected at most %d characters, Got: %d", maxSlackMsgLen, n)
+		}
+		if !strings.HasSuffix(msg, link+"```") {
+			t.Errorf("Expected the alert to end with the link, Got: ...%s",
+				msg[len(msg)-100:])
+		}
+	}
+
+	// Short alerts are left as they are.
+	c := &Counter{ChannelId: "general", NudgeMessage: "Clear is better than clever."}
+	rtm := &r{}
+	callYoda(c, rtm, link)
+	if !strings.Contains(rtm.lastMsg(), string(yoda)) {
+		t.Errorf("Expected alert to contain yoda, Got: %s", rtm.lastMsg())
+	}
+}
+
+func TestCodeFences(t *testing.T) {
+	c := &Counter{Interval: "1h", MaxMsg: 20}
+	c.setup("general")
+	ts := time.Now().Unix()
+	for i, text := range []string{"try this", "```go\nfmt.Println(1)\n```",
+		"or ````this````", "done"} {
+		c.Increment(&slack.Msg{Channel: "general", User: "U13LHF42F",
+			Text: text, Timestamp: strconv.FormatInt(ts+int64(i), 10)},
+			map[string]string{})
+	}
+	raw := topicRaw(c)
+	// The block is fenced with more backticks than any message has, and
+	// both fences are on lines of their own.
+	if !strings.Contains(raw, ".\n\n`````\n") || !strings.HasSuffix(raw, "done\n`````") {
+		t.Errorf("Expected the messages in a block fenced by 5 backticks, Got: %s", raw)
+	}
+	if strings.Count(raw, "`````") != 2 {
+		t.Errorf("Expected only the fences to have 5 backticks, Got: %s", raw)
+	}
+
+	rtm := &r{}
+	nc := &Counter{ChannelId: "general",
+		NudgeMessage: "Please don't paste ```logs``` here."}
+	callYoda(nc, rtm, "")
+	msg := rtm.lastMsg()
+	if !strings.HasPrefix(msg, "```") || !strings.HasSuffix(msg, "```") {
+		t.Errorf("Expected the alert in a code block, Got: %s", msg)
+	}
+	if inner := msg[3 : len(msg)-3]; strings.Contains(inner, "```") {
+		t.Errorf("Expected no fences inside the code block, Got: %s", msg)
+	}
+	if !strings.Contains(msg, "logs") {
+		t.Errorf("Expected the quote in the alert, Got: %s", msg)
+	}
+}
+
+func TestTopUsers(t *testing.T) {
+	c := &Counter{ChannelId: "general"}
+	memmap := map[string]string{"U1": "alice", "U2": "bob", "U3": "carol",
+		"U4": "dave"}
+	counts := map[string]int{"U1": 3, "U2": 5, "U3": 3, "U4": 1}
+	ts := time.Now().Unix()
+	for uid, n := range counts {
+		for i := 0; i < n; i++ {
+			c.Increment(&slack.Msg{Channel: "general", User: uid,
+				Timestamp: strconv.FormatInt(ts, 10), Text: "hi"}, memmap)
+		}
+	}
+
+	ucs := c.topUsers(3)
+	expected := []UserCount{{"bob", 5}, {"alice", 3}, {"carol", 3}}
+	if len(ucs) != len(expected) {
+		t.Fatalf("Expected %d users, Got: %v", len(expected), ucs)
+	}
+	for i := range expected {
+		if ucs[i] != expected[i] {
+			t.Errorf("Expected %v at %d, Got: %v", expected[i], i, ucs[i])
+		}
+	}
+
+	if ucs = c.topUsers(10); len(ucs) != 4 {
+		t.Errorf("Expected %d users, Got: %d", 4, len(ucs))
+	}
+	em := "Most active: @bob (5), @alice (3), @carol (3)"
+	if m := mostActive(c); m != em {
+		t.Errorf("Expected: %s, Got: %s", em, m)
+	}
+
+	rtm := &r{}
+	callYoda(c, rtm, "")
+	if m := rtm.lastMsg(); !strings.Contains(m, em) {
+		t.Errorf("Expected alert to contain %s, Got: %s", em, m)
+	}
+}
+
+func TestNudgeInThread(t *testing.T) {
+	c := &Counter{ChannelId: "general"}
+	addBuckets(c, "New buckets", time.Now().Unix())
+	c.Increment(&slack.Msg{Channel: "general",
+		Timestamp: "1465010249.000606", Text: "Last message"},
+		map[string]string{})
+	rtm := &r{}
+
+	callYoda(c, rtm, "")
+	if rtm.threadTs != "" {
+		t.Errorf("Expected alert to be sent in the channel, Got thread: %s",
+			rtm.threadTs)
+	}
+
+	c.NudgeInThread = true
+	c.Increment(&slack.Msg{Channel: "general",
+		Timestamp: "1465010249.000606", Text: "Last message"},
+		map[string]string{})
+	callYoda(c, rtm, "")
+	if rtm.threadTs != "1465010249.000606" {
+		t.Errorf("Expected alert to be sent in thread %s, Got: %s",
+			"1465010249.000606", rtm.threadTs)
+	}
+}
+
+func TestLoadQuotes(t *testing.T) {
+	f, err := ioutil.TempFile("", "quotes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("Talk less, write more.\n\n")
+	f.Close()
+
+	qs, err := loadQuotes(Config{QuotesFile: f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(qs) != 1 || qs[0] != "Talk less, write more." {
+		t.Errorf("Expected quotes from the file, Got: %v", qs)
+	}
+
+	old := quotes
+	quotes = qs
+	defer func() { quotes = old }()
+	c := &Counter{ChannelId: "general"}
+	rtm := &r{}
+	callYoda(c, rtm, "")
+	if m := rtm.lastMsg(); !strings.Contains(m, "Talk less, write more.") {
+		t.Errorf("Expected alert to contain the quote, Got: %s", m)
+	}
+
+	if qs, _ = loadQuotes(Config{Quotes: []string{"Inline"}}); qs[0] != "Inline" {
+		t.Errorf("Expected inline quotes to be used, Got: %v", qs)
+	}
+	if qs, _ = loadQuotes(Config{}); len(qs) != len(proverbs) {
+		t.Errorf("Expected the Go Proverbs to be used, Got: %v", qs)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer logger.SetLevel("info")
+
+	if err := logger.SetLevel("error"); err != nil {
+		t.Fatal(err)
+	}
+	logger.Infof("Reloaded config")
+	logger.Warnf("Retrying")
+	if buf.Len() != 0 {
+		t.Errorf("Expected info and warn messages to be suppressed, Got: %s",
+			buf.String())
+	}
+	logger.Errorf("Error while sending message")
+	if !strings.Contains(buf.String(), "level=error") {
+		t.Errorf("Expected error message to be logged, Got: %s", buf.String())
+	}
+
+	if err := logger.SetLevel("verbose"); err == nil {
+		t.Error("Expected error for unknown log level")
+	}
+	if err := validateConfig(Config{LogLevel: "verbose"}); err == nil ||
+		!strings.Contains(err.Error(), "log_level") {
+		t.Errorf("Expected log_level error, Got: %v", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	saveConf(t)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	conf.DryRun = true
+	conf.DiscKey = "testkey"
+	called := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		called = true
+	}))
+	defer ts.Close()
+	conf.DiscPrefix = ts.URL
+
+	c := &Counter{ChannelId: "general", NudgeInThread: true}
+	addBuckets(c, "New buckets", time.Now().Unix())
+	rtm := &dryRunClient{RTM: &r{}}
+	invoked = false
+	sendMessage(c, rtm)
+	addBuckets(c, "New buckets", time.Now().Unix())
+	createNewTopic(c, "wisemonk create topic testing wisemonk", rtm)
+
+	if invoked {
+		t.Errorf("Expected SendMessage to not be invoked in dry run")
+	}
+	if called {
+		t.Errorf("Expected no topic to be created in dry run")
+	}
+	for _, s := range []string{"Dry run, not creating topic",
+		"Dry run, not sending to channel general",
+		"Dry run, not sending to thread"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("Expected log to contain %s, Got: %s", s, buf.String())
+		}
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	saveConf(t)
+	c := &Counter{ChannelId: "general"}
+	timeNow := time.Now().Unix()
+	addBuckets(c, "New buckets", timeNow)
+	rtm := &r{}
+
+	invoked = false
+	if sendMessage(c, rtm); !invoked {
+		t.Errorf("Expected invoked to be %t, Got: %t", true, false)
+	}
+
+	conf.DiscKey = "testkey"
+	addBuckets(c, "New buckets", timeNow)
+	invoked = false
+	ts := createServer(t, http.StatusOK, TopicBody{Id: 1,
+		Slug: "test-title-created"})
+	conf.DiscPrefix = ts.URL
+	defer ts.Close()
+
+	if sendMessage(c, rtm); !invoked {
+		t.Errorf("Expected invoked to be %t, Got: %t", true, false)
+	}
+}
+
+// noUsers returns a userCache without any users.
+func noUsers() *userCache {
+	return newUserCache(func() map[string]string {
+		return map[string]string{}
+	})
+}
+
+func TestUserCacheRefresh(t *testing.T) {
+	names := map[string]string{"U13LHF42F": "mrjn"}
+	users := newUserCache(func() map[string]string { return names })
+	c := &Counter{Interval: "10m", MaxMsg: 20}
+	c.setup("general")
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// A user who joined after the names were fetched.
+	c.Increment(&slack.Msg{Channel: "general", User: "U0NEWUSER",
+		Text: "hi", Timestamp: ts}, users.Names())
+	if tr := c.transcript(); strings.Contains(tr, "pawan") {
+		t.Errorf("Expected the new user to not have a name, Got: %s", tr)
+	}
+
+	names = map[string]string{"U13LHF42F": "mrjn", "U0NEWUSER": "pawan"}
+	users.refresh()
+	c.Increment(&slack.Msg{Channel: "general", User: "U0NEWUSER",
+		Text: "hello", Timestamp: ts}, users.Names())
+	if tr := c.transcript(); !strings.Contains(tr, "pawan") {
+		t.Errorf("Expected the refreshed name to be used, Got: %s", tr)
+	}
+
+	// Names are kept if fetching them fails.
+	names = map[string]string{}
+	users.refresh()
+	if users.Names()["U0NEWUSER"] != "pawan" {
+		t.Errorf("Expected names to be kept, Got: %v", users.Names())
+	}
+}
+
+func TestBucketGranularity(t *testing.T) {
+	now := time.Now().Unix()
+	stamps := []string{".000100", ".050000", ".150000", ".9", "", ".999999"}
+	for _, tc := range []struct {
+		granularity string
+		buckets     int
+	}{
+		{"", 1},
+		{"1s", 1},
+		// 0-100ms, 100-200ms and 900ms-1s.
+		{"100ms", 3},
+		{"1ms", 5},
+	} {
+		c := &Counter{Interval: "10m", MaxMsg: 20,
+			BucketGranularity: tc.granularity}
+		c.setup("general")
+		// Out of order, so that the buckets have to be kept sorted.
+		for i := len(stamps) - 1; i >= 0; i-- {
+			c.Increment(&slack.Msg{Channel: "general", User: "U13LHF42F",
+				Text: "burst", Timestamp: strconv.FormatInt(now, 10) + stamps[i]},
+				map[string]string{})
+		}
+		if len(c.buckets) != tc.buckets {
+			t.Errorf("Expected %d buckets for %q, Got: %d", tc.buckets,
+				tc.granularity, len(c.buckets))
+		}
+		if !sort.IsSorted(ByTimestamp(c.buckets)) {
+			t.Errorf("Expected the buckets to be sorted, Got: %+v", c.buckets)
+		}
+		if count := c.Count(); count != len(stamps) {
+			t.Errorf("Expected count %d for %q, Got: %d", len(stamps),
+				tc.granularity, count)
+		}
+
+		// The buckets survive a restart.
+		r := &Counter{Interval: "10m", MaxMsg: 20}
+		r.setup("general")
+		r.Restore(c.State())
+		if len(r.buckets) != tc.buckets {
+			t.Errorf("Expected %d buckets after restoring, Got: %d",
+				tc.buckets, len(r.buckets))
+		}
+	}
+
+	for _, ts := range []string{"1503435956.000247", "1503435956", "1503435956.5"} {
+		if _, _, err := parseTimestamp(ts); err != nil {
+			t.Errorf("Expected %s to be parsed, Got: %v", ts, err)
+		}
+	}
+	if sec, nsec, _ := parseTimestamp("1503435956.000247"); sec != 1503435956 ||
+		nsec != 247000 {
+		t.Errorf("Expected 1503435956 and 247000, Got: %d and %d", sec, nsec)
+	}
+	if _, _, err := parseTimestamp("now"); err == nil {
+		t.Errorf("Expected an error for an invalid timestamp")
+	}
+}
+
+func TestIncrementIgnorePatterns(t *testing.T) {
+	c := &Counter{Interval: "10m", MaxMsg: 20,
+		IgnorePatterns: []string{"^BUILD ", "deployed to (staging|prod)"}}
+	c.setup("general")
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	for _, text := range []string{"BUILD #42 passed", "hello",
+		"v1.2 deployed to prod", "the BUILD is broken"} {
+		c.Increment(&slack.Msg{Channel: "general", User: "U13LHF42F",
+			Text: text, Timestamp: ts}, map[string]string{})
+	}
+	if count := c.Count(); count != 2 {
+		t.Errorf("Expected %d messages to be counted, Got: %d", 2, count)
+	}
+	if tr := c.transcript(); strings.Contains(tr, "BUILD #42") {
+		t.Errorf("Expected ignored messages to not be stored, Got: %s", tr)
+	}
+}
+
+func TestIncrementWeighted(t *testing.T) {
+	texts := []string{"", "short", strings.Repeat("a", 280),
+		strings.Repeat("a", 281), strings.Repeat("é", 700)}
+	for _, tc := range []struct {
+		mode  string
+		count int
+	}{
+		{"", 5},
+		{countMessages, 5},
+		// 1 + 1 + 1 + 2 + 3
+		{countWeighted, 8},
+	} {
+		c := &Counter{Interval: "10m", MaxMsg: 20, CountMode: tc.mode}
+		c.setup("general")
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		for _, text := range texts {
+			c.Increment(&slack.Msg{Channel: "general", User: "U13LHF42F",
+				Text: text, Timestamp: ts}, map[string]string{})
+		}
+		if count := c.Count(); count != tc.count {
+			t.Errorf("Expected count %d with count_mode %q, Got: %d",
+				tc.count, tc.mode, count)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	saveConf(t)
+	ts := createServer(t, http.StatusOK, TopicBody{Id: 1,
+		Slug: "test-title-created"})
+	defer ts.Close()
+	conf.DiscKey = "testkey"
+	conf.DiscPrefix = ts.URL
+
+	c := &Counter{ChannelId: "general", Interval: "1h", MaxMsg: 20,
+		SummarizeAfter: "15m", CreateTopicIn: "1"}
+	// Activity that ended 5 minutes ago.
+	now := time.Now()
+	addBuckets(c, "Discussion about the release",
+		now.Add(-5*time.Minute).Unix())
+	if c.shouldSummarize(now) {
+		t.Errorf("Expected no summary while the channel is active")
+	}
+
+	// Followed by silence.
+	now = now.Add(15 * time.Minute)
+	if !c.shouldSummarize(now) {
+		t.Fatalf("Expected a summary after %s of silence", c.SummarizeAfter)
+	}
+	if c.shouldSummarize(now) {
+		t.Errorf("Expected the messages to be summarized only once")
+	}
+
+	rtm := &r{}
+	summarize(c, rtm)
+	expected := "The discussion has been saved to " + ts.URL +
+		"/t/test-title-created/1"
+	if rtm.lastMsg() != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, rtm.lastMsg())
+	}
+	if count := c.Count(); count != 0 {
+		t.Errorf("Expected the buckets to be cleared, Got: %d", count)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	saveConf(t)
+	ts := createServer(t, http.StatusOK, TopicBody{Id: 1,
+		Slug: "test-title-created"})
+	defer ts.Close()
+	conf.DiscKey = "testkey"
+	conf.DiscPrefix = ts.URL
+	namer = newNameCache(&fakeNamer{names: map[string]string{
+		"G1D59039B": "general"}})
+	defer func() { namer = nil }()
+
+	general := &Counter{Interval: "1h", MaxMsg: 20, CreateTopicIn: "1"}
+	general.setup("G1D59039B")
+	dev := &Counter{Interval: "1h", MaxMsg: 20, CountMode: countWeighted}
+	dev.setup("C13LH03RS")
+	quiet := &Counter{Interval: "1h", MaxMsg: 20}
+	quiet.setup("C0UNKNOWN")
+	cs := map[string]*Counter{"G1D59039B": general, "C13LH03RS": dev,
+		"C0UNKNOWN": quiet}
+
+	// A day's activity, spread over more than an interval. The messages
+	// are counted once each, even if they have expired or are weighted.
+	day := time.Now().Add(-24 * time.Hour).Unix()
+	now := time.Now().Unix()
+	for i := int64(0); i < 15; i++ {
+		at := day + i
+		if i >= 5 {
+			at = now - i
+		}
+		general.Increment(&slack.Msg{Channel: "G1D59039B", User: "U13LHF42F",
+			Text: "Release discussion", Timestamp: strconv.FormatInt(at, 10)},
+			map[string]string{})
+	}
+	for i := int64(0); i < 3; i++ {
+		dev.Increment(&slack.Msg{Channel: "C13LH03RS", User: "U13LHF42F",
+			Text: strings.Repeat("a", 1000), Timestamp: strconv.FormatInt(day+i, 10)},
+			map[string]string{})
+	}
+	if _, err := createTopic(general, "Release discussion from slack"); err != nil {
+		t.Fatal(err)
+	}
+
+	topic := ts.URL + "/t/test-title-created/1"
+	expected := "Activity since the last digest:\n" +
+		"C0UNKNOWN (C0UNKNOWN): 0 messages\n" +
+		"C13LH03RS (C13LH03RS): 3 messages\n" +
+		"#general (G1D59039B): 15 messages, topics: " + topic + "\n"
+	if d := digest(cs); d != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, d)
+	}
+
+	// The counts start afresh after a digest.
+	expected = "Activity since the last digest:\n" +
+		"C0UNKNOWN (C0UNKNOWN): 0 messages\n" +
+		"C13LH03RS (C13LH03RS): 0 messages\n" +
+		"#general (G1D59039B): 0 messages\n"
+	if d := digest(cs); d != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, d)
+	}
+}
+
+func TestSendMessageTopicFailed(t *testing.T) {
+	saveConf(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		w.Header().Set("X-Request-Id", "req-1234")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"errors":["Title has already been used"]}`))
+	}))
+	defer ts.Close()
+	conf.DiscKey = "testkey"
+	conf.DiscPrefix = ts.URL
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	c := &Counter{ChannelId: "general", CreateTopicIn: "1"}
+	addBuckets(c, "New buckets", time.Now().Unix())
+	rtm := &r{}
+	sendMessage(c, rtm)
+
+	out := buf.String()
+	for _, s := range []string{"level=warn",
+		"Topic creation failed, posted nudge without link",
+		`\"status\":422`, "Title has already been used", "req-1234"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected log to contain %s, Got: %s", s, out)
+		}
+	}
+	if !strings.Contains(rtm.lastMsg(), errMsg) {
+		t.Errorf("Expected the nudge to be posted, Got: %s", rtm.lastMsg())
+	}
+}
+
+func TestSendMessageResetsCount(t *testing.T) {
+	saveConf(t)
+	ok := createServer(t, http.StatusOK, TopicBody{Id: 1, Slug: "test"})
+	defer ok.Close()
+	failed := createServer(t, http.StatusForbidden, TopicBody{})
+	defer failed.Close()
+
+	for _, tc := range []struct {
+		name   string
+		key    string
+		prefix string
+	}{
+		{"yoda", "", ""},
+		{"topic created", "testkey", ok.URL},
+		{"topic failed", "testkey", failed.URL},
+	} {
+		conf.DiscKey = tc.key
+		conf.DiscPrefix = tc.prefix
+		c := &Counter{Interval: "10m", MaxMsg: 5}
+		c.setup("general")
+		addBuckets(c, "New buckets", time.Now().Unix())
+		if !c.shouldNudge() {
+			t.Fatalf("%s: Expected count to reach maxmsg", tc.name)
+		}
+		sendMessage(c, &r{})
+		if count := c.Count(); count != 0 {
+			t.Errorf("%s: Expected count to be 0 after alert, Got: %d",
+				tc.name, count)
+		}
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	saveConf(t)
+	conf.DiscKey = "testkey"
+	discourse().cats.set(map[int]string{1: "Slack"})
+	ts := createServer(t, http.StatusOK,
+		SearchResponse{Topics: []SearchTopic{{Id: 1, Slug: "test-1",
+			Category: 1}}})
+	defer ts.Close()
+	conf.DiscPrefix = ts.URL
+	c := &Counter{Interval: "10m", MaxMsg: 5}
+	c.setup("general")
+	rtm := &r{}
+
+	beQuiet(c, "wisemonk quiet for 30m", rtm)
+	if !strings.HasPrefix(rtm.lastMsg(), "Okay, I won't alert for 30m0s") {
+		t.Errorf("Expected quiet to be acknowledged, Got: %s", rtm.lastMsg())
+	}
+	addBuckets(c, "New buckets", time.Now().Unix())
+	if c.nudgeDue() {
+		t.Errorf("Expected no alert while quiet")
+	}
+
+	searchDiscourse(c, "wisemonk query test 5", rtm)
+	if !strings.Contains(rtm.lastMsg(), "test-1") {
+		t.Errorf("Expected search results while quiet, Got: %s",
+			rtm.lastMsg())
+	}
+
+	beQuiet(c, "wisemonk quiet for 2d", rtm)
+	if rtm.lastMsg() != "Sorry, I don't understand you." {
+		t.Errorf("Expected invalid duration to be rejected, Got: %s",
+			rtm.lastMsg())
+	}
+
+	c.SetQuiet(0)
+	if !c.nudgeDue() {
+		t.Errorf("Expected alert once no longer quiet")
+	}
+}
+
+// fakeClock is a Clock whose time only moves when it is advanced.
+type fakeClock struct {
+	sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+// fakeWaiter is a channel which gets the time once it is at or after at. The
+// channels of tickers get it every period.
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	return f.wait(d, 0)
+}
+
+func (f *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{f.wait(d, d)}
+}
+
+func (f *fakeClock) wait(d, period time.Duration) chan time.Time {
+	f.Lock()
+	defer f.Unlock()
+	c := make(chan time.Time, 1)
+	f.waiters = append(f.waiters, fakeWaiter{at: f.now.Add(d),
+		period: period, c: c})
+	return c
+}
+
+// Advance moves the time forward by d, sending it to the waiters that are due.
+func (f *fakeClock) Advance(d time.Duration) {
+	f.Lock()
+	defer f.Unlock()
+	f.now = f.now.Add(d)
+	var waiting []fakeWaiter
+	for _, w := range f.waiters {
+		if w.at.After(f.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+		// Like time.Ticker, ticks are dropped if the last one wasn't read.
+		select {
+		case w.c <- f.now:
+		default:
+		}
+		if w.period > 0 {
+			for !w.at.After(f.now) {
+				w.at = w.at.Add(w.period)
+			}
+			waiting = append(waiting, w)
+		}
+	}
+	f.waiters = waiting
+}
+
+// ticked returns whether all the ticks sent so far have been read.
+func (f *fakeClock) ticked() bool {
+	f.Lock()
+	defer f.Unlock()
+	for _, w := range f.waiters {
+		if w.period > 0 && len(w.c) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type fakeTicker struct {
+	c chan time.Time
+}
+
+func (t fakeTicker) C() <-chan time.Time { return t.c }
+func (t fakeTicker) Stop()               {}
+
+func TestFakeClock(t *testing.T) {
+	clock := newFakeClock(time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC))
+	c := &Counter{Interval: "10m", MaxMsg: 20, clock: clock}
+	c.setup("general")
+	rtm := &r{}
+
+	c.SetMeditationEnd(5 * time.Minute)
+	woken := make(chan struct{})
+	go func() {
+		wakeAfter(c, rtm, c.MeditationEnd(), c.wakeChan())
+		close(woken)
+	}()
+	// Let wakeAfter start waiting.
+	for {
+		clock.Lock()
+		n := len(clock.waiters)
+		clock.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(5*time.Minute - time.Second)
+	if d := c.MeditationEnd(); d != time.Second {
+		t.Errorf("Expected meditation to end in %s, Got: %s", time.Second, d)
+	}
+	select {
+	case <-woken:
+		t.Errorf("Expected wisemonk to still be meditating")
+	default:
+	}
+	clock.Advance(time.Second)
+	if d := c.MeditationEnd(); d != 0 {
+		t.Errorf("Expected meditation to have ended, Got: %s", d)
+	}
+	select {
+	case <-woken:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected wisemonk to wake up once the meditation ended")
+	}
+	if rtm.lastMsg() != wakeMsg {
+		t.Errorf("Expected: %s, Got: %s", wakeMsg, rtm.lastMsg())
+	}
+
+	// Messages from 12:05:00 and 12:04:51 to 12:04:59.
+	addBuckets(c, "New buckets", clock.Now().Unix())
+	clock.Advance(10*time.Minute - 10*time.Second)
+	if count := c.Count(); count != 10 {
+		t.Errorf("Expected %d messages in the interval, Got: %d", 10, count)
+	}
+	// Buckets expire once they are an interval old.
+	clock.Advance(time.Second)
+	if count := c.Count(); count != 9 {
+		t.Errorf("Expected %d messages in the interval, Got: %d", 9, count)
+	}
+	clock.Advance(9 * time.Second)
+	if count := c.Count(); count != 0 {
+		t.Errorf("Expected %d messages in the interval, Got: %d", 0, count)
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	saveConf(t)
+	conf.DiscKey = ""
+	setAdmins([]string{"U13LHF42F", "karthic"})
+	defer setAdmins(nil)
+
+	clock := newFakeClock(time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC))
+	c := &Counter{Interval: "10m", MaxMsg: 5, EscalateAfter: 3,
+		clock: clock}
+	c.setup("general")
+	rtm := &r{}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go c.checkOrIncr(rtm, &wg, noUsers(), done)
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+	// Let checkOrIncr create its ticker.
+	for {
+		clock.Lock()
+		n := len(clock.waiters)
+		clock.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	escalation := "<@U13LHF42F> @karthic " + defaultEscalationMessage
+	// sent returns the number of alerts and escalations sent so far.
+	sent := func() (alerts int, escalations int) {
+		rtm.Lock()
+		defer rtm.Unlock()
+		for _, m := range rtm.msgs {
+			if m == escalation {
+				escalations++
+			} else {
+				alerts++
+			}
+		}
+		return alerts, escalations
+	}
+	// run moves the clock forward by d, one tick of checkOrIncr at a time,
+	// with a message before every tick if the channel is busy.
+	run := func(d time.Duration, busy bool) {
+		for end := clock.Now().Add(d); clock.Now().Before(end); {
+			if busy {
+				ts := strconv.FormatInt(clock.Now().Unix(), 10)
+				c.messages <- &slack.Msg{Channel: "general",
+					User: "U13GH76YT", Text: "Still busy", Timestamp: ts}
+			}
+			clock.Advance(10 * time.Second)
+			for !clock.ticked() {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		// Alerts are sent in their own goroutine.
+		time.Sleep(50 * time.Millisecond)
+	}
+	check := func(when string, alerts, escalations int) {
+		if a, e := sent(); a != alerts || e != escalations {
+			t.Errorf("%s: Expected %d alerts and %d escalations, Got: %d and %d",
+				when, alerts, escalations, a, e)
+		}
+	}
+
+	// The channel keeps chatting through two alerts, a cooldown apart.
+	run(6*time.Minute, true)
+	check("busy", 2, 0)
+	// The alerts in a row are counted afresh after a break.
+	run(20*time.Minute, false)
+	run(6*time.Minute, true)
+	check("busy after a break", 4, 0)
+	run(5*time.Minute, true)
+	check("third alert in a row", 5, 1)
+}
+
+func TestActiveHours(t *testing.T) {
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		hours  string
+		tz     string
+		at     time.Time
+		active bool
+	}{
+		{"09:00-18:00", "", time.Date(2017, 3, 1, 9, 0, 0, 0, time.UTC), true},
+		{"09:00-18:00", "", time.Date(2017, 3, 1, 17, 59, 0, 0, time.UTC), true},
+		{"09:00-18:00", "", time.Date(2017, 3, 1, 18, 0, 0, 0, time.UTC), false},
+		{"09:00-18:00", "", time.Date(2017, 3, 1, 3, 0, 0, 0, time.UTC), false},
+		// 03:00 in UTC is 08:30 in Kolkata.
+		{"08:00-17:00", "Asia/Kolkata", time.Date(2017, 3, 1, 3, 0, 0, 0,
+			time.UTC), true},
+		{"09:00-18:00", "Asia/Kolkata", time.Date(2017, 3, 1, 8, 59, 0, 0,
+			kolkata), false},
+		// Windows crossing midnight.
+		{"22:00-06:00", "", time.Date(2017, 3, 1, 23, 0, 0, 0, time.UTC), true},
+		{"22:00-06:00", "", time.Date(2017, 3, 1, 5, 0, 0, 0, time.UTC), true},
+		{"22:00-06:00", "", time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC), false},
+		{"", "", time.Date(2017, 3, 1, 3, 0, 0, 0, time.UTC), true},
+	} {
+		c := &Counter{Interval: "10m", MaxMsg: 5, ActiveHours: tc.hours,
+			Timezone: tc.tz}
+		c.setup("general")
+		if active := c.inActiveHours(tc.at); active != tc.active {
+			t.Errorf("Expected active %t for %s in %q at %s, Got: %t",
+				tc.active, tc.hours, tc.tz, tc.at, active)
+		}
+	}
+
+	// The window is the hour that ended a minute ago, so the current time
+	// is always outside it.
+	now := time.Now().UTC()
+	hours := fmt.Sprintf("%s-%s", now.Add(-61*time.Minute).Format("15:04"),
+		now.Add(-time.Minute).Format("15:04"))
+	c := &Counter{Interval: "10m", MaxMsg: 5, ActiveHours: hours}
+	c.setup("general")
+	addBuckets(c, "New buckets", time.Now().Unix())
+	if c.nudgeDue() {
+		t.Errorf("Expected no alert outside %s", hours)
+	}
+	c.update(&Counter{Interval: "10m", MaxMsg: 5})
+	if !c.nudgeDue() {
+		t.Errorf("Expected an alert once active_hours is removed")
+	}
+
+	for _, tc := range []struct{ hours, tz string }{
+		{"9-18", ""}, {"09:00", ""}, {"09:00-09:00", ""},
+		{"09:00-18:00", "Mars/Olympus"},
+	} {
+		if _, err := parseActiveHours(tc.hours, tc.tz); err == nil {
+			t.Errorf("Expected error for %q in %q", tc.hours, tc.tz)
+		}
+	}
+}
+
+func TestNudgeCooldown(t *testing.T) {
+	saveConf(t)
+	conf.DiscKey = ""
+	c := &Counter{Interval: "10m", MaxMsg: 5}
+	c.setup("general")
+	rtm := &r{}
+
+	// The channel stays busy across two ticks.
+	for i := 0; i < 2; i++ {
+		addBuckets(c, "New buckets", time.Now().Unix())
+		if c.shouldNudge() {
+			sendMessage(c, rtm)
+		}
+	}
+	if len(rtm.msgs) != 1 {
+		t.Errorf("Expected 1 alert within the cooldown, Got: %d",
+			len(rtm.msgs))
+	}
+
+	c.NudgeCooldown = "1ns"
+	addBuckets(c, "New buckets", time.Now().Unix())
+	if !c.shouldNudge() {
+		t.Errorf("Expected alert after the cooldown")
+	}
+}
+
+type fakeMembers struct {
+	count int
+	calls int
+}
+
+func (f *fakeMembers) MemberCount(channel string) (int, error) {
+	f.calls++
+	return f.count, nil
+}
+
+type fakeNamer struct {
+	names map[string]string
+	calls int
+}
+
+func (f *fakeNamer) ChannelName(channel string) (string, error) {
+	f.calls++
+	if name, ok := f.names[channel]; ok {
+		return name, nil
+	}
+	return "", errors.New("channel_not_found")
+}
+
+func TestListChannels(t *testing.T) {
+	saveConf(t)
+	fn := &fakeNamer{names: map[string]string{"C13LH03RS": "dev",
+		"G1D59039B": "general"}}
+	namer = newNameCache(fn)
+	defer func() { namer = nil }()
+	channelsMu.Lock()
+	conf.Channels = map[string]*Counter{
+		"G1D59039B": {ChannelId: "G1D59039B", Interval: "10m", MaxMsg: 20,
+			CreateTopicIn: "slack"},
+		"C13LH03RS": {ChannelId: "C13LH03RS", Interval: "5m", MaxMsg: 10},
+		"C0UNKNOWN": {ChannelId: "C0UNKNOWN", Interval: "1h", MaxMsg: 50},
+	}
+	channelsMu.Unlock()
+
+	c := &Counter{ChannelId: "G1D59039B"}
+	rtm := &r{}
+	listChannels(c, "wisemonk channels", rtm)
+	expected := "C0UNKNOWN (C0UNKNOWN): interval 1h, maxmsg 50\n" +
+		"#dev (C13LH03RS): interval 5m, maxmsg 10\n" +
+		"#general (G1D59039B): interval 10m, maxmsg 20, topics in slack\n"
+	if rtm.lastMsg() != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, rtm.lastMsg())
+	}
+
+	// The names are fetched only once.
+	listChannels(c, "wisemonk channels", rtm)
+	if fn.calls != 4 {
+		t.Errorf("Expected %d calls for names, Got: %d", 4, fn.calls)
+	}
+}
+
+func TestPreviewTopic(t *testing.T) {
+	saveConf(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		t.Errorf("Expected discourse to not be called, Got: %s %s",
+			req.Method, req.URL.Path)
+	}))
+	defer ts.Close()
+	conf.DiscKey = "testkey"
+	conf.DiscPrefix = ts.URL
+
+	c := &Counter{Interval: "1h", MaxMsg: 20, CreateTopicIn: "1"}
+	c.setup("general")
+	rtm := &r{}
+	previewTopic(c, "wisemonk preview topic", rtm)
+	if expected := "There are no messages to create a topic with."; rtm.lastMsg() != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, rtm.lastMsg())
+	}
+
+	now := time.Now().Unix()
+	addBuckets(c, "Should we cut the release today?", now)
+	previewTopic(c, "wisemonk preview topic", rtm)
+	if preview := rtm.lastMsg(); preview != topicRaw(c) ||
+		!strings.Contains(preview, ": Should we cut the release today?") {
+		t.Errorf("Expected the preview to be the topic body, Got: %s", preview)
+	}
+	if rtm.threadTs != c.lastTimestamp {
+		t.Errorf("Expected the preview in the thread of %s, Got: %s",
+			c.lastTimestamp, rtm.threadTs)
+	}
+	if count := c.Count(); count != 10 {
+		t.Errorf("Expected the messages to be kept, Got count: %d", count)
+	}
+}
+
+func TestMinMembers(t *testing.T) {
+	fm := &fakeMembers{count: 3}
+	members = newMemberCache(fm, time.Hour)
+	defer func() { members = nil }()
+	clock := newFakeClock(time.Now())
+	c := &Counter{Interval: "10m", MaxMsg: 5, MinMembers: 10, clock: clock}
+	c.setup("general")
+
+	addBuckets(c, "New buckets", clock.Now().Unix())
+	if c.shouldNudge() {
+		t.Errorf("Expected no alert with %d members", fm.count)
+	}
+	if c.shouldNudge(); fm.calls != 1 {
+		t.Errorf("Expected member count to be cached, Got %d calls",
+			fm.calls)
+	}
+	// The cache expires by the clock of the counter.
+	clock.Advance(59 * time.Minute)
+	addBuckets(c, "New buckets", clock.Now().Unix())
+	if c.shouldNudge(); fm.calls != 1 {
+		t.Errorf("Expected member count to be cached, Got %d calls",
+			fm.calls)
+	}
+	clock.Advance(time.Minute)
+	addBuckets(c, "New buckets", clock.Now().Unix())
+	if c.shouldNudge(); fm.calls != 2 {
+		t.Errorf("Expected member count to be fetched again, Got %d calls",
+			fm.calls)
+	}
+
+	members = newMemberCache(&fakeMembers{count: 10}, time.Hour)
+	if !c.shouldNudge() {
+		t.Errorf("Expected alert once the channel has enough members")
+	}
+}
+
+func TestSendMessageEmptyBuckets(t *testing.T) {
+	saveConf(t)
+	c := &Counter{ChannelId: "general"}
+	rtm := &r{}
+	called := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		called = true
+	}))
+	defer ts.Close()
+	conf.DiscPrefix = ts.URL
+	conf.DiscKey = "testkey"
+
+	invoked = false
+	if sendMessage(c, rtm); !invoked {
+		t.Errorf("Expected invoked to be %t, Got: %t", true, false)
+	}
+	if called {
+		t.Errorf("Expected no topic to be created for empty buckets")
+	}
+}
+
+func TestCreateNewTopic(t *testing.T) {
+	saveConf(t)
+	c := &Counter{ChannelId: "general"}
+	timeNow := time.Now().Unix()
+	addBuckets(c, "New buckets", timeNow)
+	m := "wisemonk create topic testing wisemonk"
+	rtm := &r{}
+	ts := createServer(t, http.StatusOK, TopicBody{Id: 1,
+		Slug: "test-title-created"})
+	conf.DiscPrefix = ts.URL
+	defer ts.Close()
+
+	conf.DiscKey = "testkey"
+	invoked = false
+	if createNewTopic(c, m, rtm); !invoked {
+		t.Errorf("Expected invoked to be %t, Got: %t", true, false)
+	}
+}
+
+func TestSubstituteUsernames(t *testing.T) {
+	memmap := make(map[string]string)
+	memmap["U13LHF42F"] = "mrjn"
+	memmap["U13LHF42G"] = "pawan"
+	text := "<@U13LHF42F> <@U13LHF42F> <@U13LHF42G>"
+
+	text = substituteUsernames(text, memmap)
+	expected := "@mrjn @mrjn @pawan"
+	if text != expected {
+		t.Errorf("Expected %s, Got: %s", expected, text)
+	}
+}
+
+func TestSubstituteLongUsernames(t *testing.T) {
+	memmap := map[string]string{"W012A3CDE4F": "mrjn",
+		"U013LHF42FGH": "pawan"}
+	text := substituteUsernames("<@W012A3CDE4F> and <@U013LHF42FGH>", memmap)
+	expected := "@mrjn and @pawan"
+	if text != expected {
+		t.Errorf("Expected %s, Got: %s", expected, text)
+	}
+}
+
+func TestStripFormatting(t *testing.T) {
+	for _, tc := range []struct {
+		text     string
+		expected string
+	}{
+		{"see <#C13LH03RS|general>", "see #general"},
+		{"see <#C13LH03RS>", "see #C13LH03RS"},
+		{"read <https://dgraph.io/docs|the docs>", "read the docs"},
+		{"read <https://dgraph.io/docs>", "read https://dgraph.io/docs"},
+		{"mail <mailto:hi@dgraph.io|hi@dgraph.io>", "mail hi@dgraph.io"},
+		{"<!here> release is out", "@here release is out"},
+		{"<!channel|channel> hi", "channel hi"},
+		{"<!subteam^S0614TZR7|@eng> look", "@eng look"},
+		{"<@U13LHF42F|mrjn> hi", "@mrjn hi"},
+		{"if a &lt; b &amp;&amp; c &gt; d", "if a < b && c > d"},
+		{"a <b> c", "a <b> c"},
+	} {
+		if got := stripFormatting(tc.text); got != tc.expected {
+			t.Errorf("Expected %q for %q, Got: %q", tc.expected, tc.text, got)
+		}
+	}
+}
+
+func TestIncrementStripsFormatting(t *testing.T) {
+	c := &Counter{Interval: "10m", MaxMsg: 20}
+	c.setup("general")
+	c.Increment(&slack.Msg{Channel: "general", User: "U13LHF42F",
+		Text:      "<!here> <@U13LHF42G> see <#C13LH03RS|dev> and <https://dgraph.io|this>",
+		Timestamp: strconv.FormatInt(time.Now().Unix(), 10)},
+		map[string]string{"U13LHF42F": "mrjn", "U13LHF42G": "pawan"})
+	expected := "@here @pawan see #dev and this"
+	if first := c.firstMessage(); !strings.HasSuffix(first, expected) {
+		t.Errorf("Expected message to end with %q, Got: %q", expected, first)
+	}
+}
+
+func TestUnknownUsername(t *testing.T) {
+	memmap := map[string]string{"U13LHF42F": "mrjn"}
+	text := substituteUsernames("<@U13LHF42F> ask <@U0EXTERNL>", memmap)
+	expected := "@mrjn ask @U0EXTERNL"
+	if text != expected {
+		t.Errorf("Expected %s, Got: %s", expected, text)
+	}
+
+	c := &Counter{Interval: "10m", MaxMsg: 20}
+	c.setup("general")
+	c.Increment(&slack.Msg{Channel: "general", User: "U0EXTERNL",
+		Text: "hello", Timestamp: strconv.FormatInt(time.Now().Unix(), 10)},
+		memmap)
+	if first := c.firstMessage(); !strings.HasPrefix(first, "U0EXTERNL ") {
+		t.Errorf("Expected the user id in place of the name, Got: %q", first)
+	}
+}
+
+func TestRunQueryAndParseResponse(t *testing.T) {
+	mems := Members{}
+	mems.Users = append(mems.Users, Member{Id: "U13GH76YT", Name: "mrjn"},
+		Member{Id: "U13GH13YT", Name: "pawan"})
+	ts := createServer(t, http.StatusOK, mems)
+	defer ts.Close()
+
+	var m Members
+	if err := runQueryAndParseResponse(ts.URL, &m); err != nil {
+		t.Error(err)
+	}
+	if len(m.Users) != 2 {
+		t.Errorf("Expected %d users, Got: %d", 2, len(m.Users))
+	}
+
+	ts = createServer(t, http.StatusInternalServerError, mems)
+	defer ts.Close()
+	if err := runQueryAndParseResponse(ts.URL, &m); err == nil {
+		t.Errorf("Expected an error for status %d",
+			http.StatusInternalServerError)
+	}
+}
+
+func TestRunQueryAndParseResponseNotJSON(t *testing.T) {
+	page := "<html>\n<body>Bad gateway" + strings.Repeat(".", 500) +
+		"</body></html>"
+	for _, tc := range []struct {
+		body string
+		want []string
+	}{
+		{page, []string{"Invalid JSON", `"text/html"`, "<html> <body>Bad gateway",
+			"..."}},
+		{"", []string{"Empty response", `"text/html"`}},
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(tc.body))
+		}))
+		var m Members
+		err := runQueryAndParseResponse(ts.URL, &m)
+		ts.Close()
+		if err == nil {
+			t.Fatalf("Expected an error for body %.20q", tc.body)
+		}
+		for _, s := range tc.want {
+			if !strings.Contains(err.Error(), s) {
+				t.Errorf("Expected error to contain %s, Got: %v", s, err)
+			}
+		}
+		if strings.Contains(err.Error(), "</html>") {
+			t.Errorf("Expected the body to be truncated, Got: %v", err)
+		}
+	}
+}
+
+func TestHttpTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	old := client
+	defer func() { client = old }()
+	maxRetries = 0
+	defer func() { maxRetries = defaultMaxRetries }()
+	var err error
+	if client, err = newHttpClient("50ms", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	var m Members
+	if err = runQueryAndParseResponse(ts.URL, &m); err == nil {
+		t.Errorf("Expected a timeout error. Got nil")
+	}
+	if d := time.Since(start); d >= 500*time.Millisecond {
+		t.Errorf("Expected request to abort before %v, took %v",
+			500*time.Millisecond, d)
+	}
+
+	if _, err = newHttpClient("ten seconds", ""); err == nil {
+		t.Errorf("Expected an error for an invalid timeout")
+	}
+	c, _ := newHttpClient("", "")
+	if c.Timeout != defaultHttpTimeout {
+		t.Errorf("Expected timeout to be %v, Got: %v", defaultHttpTimeout,
+			c.Timeout)
+	}
+	def := http.DefaultTransport.(*http.Transport)
+	if tr := c.Transport.(*http.Transport); tr == def ||
+		tr.TLSHandshakeTimeout != def.TLSHandshakeTimeout ||
+		tr.ForceAttemptHTTP2 != def.ForceAttemptHTTP2 {
+		t.Errorf("Expected a clone of the default transport, Got: %+v", tr)
+	}
+}
+
+func TestProxyUrl(t *testing.T) {
+	var host string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		host = r.Host
+		json.NewEncoder(w).Encode(Members{})
+	}))
+	defer proxy.Close()
+
+	old := client
+	defer func() { client = old }()
+	var err error
+	if client, err = newHttpClient("", proxy.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	var m Members
+	err = runQueryAndParseResponse("http://discuss.example.com/users.json", &m)
+	if err != nil {
+		t.Error(err)
+	}
+	if host != "discuss.example.com" {
+		t.Errorf("Expected request to go through proxy, Got host: %s", host)
+	}
+}
+
+func TestCacheUsernames(t *testing.T) {
+	mems := Members{}
+	mems.Users = append(mems.Users, Member{Id: "U13GH76YT", Name: "mrjn"},
+		Member{Id: "U13GH13YT", Name: "pawan"})
+	ts := createServer(t, http.StatusOK, mems)
+	defer ts.Close()
+
+	memmap := cacheUsernames(ts.URL)
+	if _, ok := memmap["U13GH76YT"]; !ok {
+		t.Errorf("Expected ok to be true. Got false")
+	}
+	uname := memmap["U13GH76YT"]
+	if uname != "mrjn" {
+		t.Errorf("Expected username to be mrjn, Got: %s", uname)
+	}
+	if _, ok := memmap["U13GH13YT"]; !ok {
+		t.Errorf("Expected ok to be true. Got false")
+	}
+}
+
+func TestCheckDiscourseCategory(t *testing.T) {
+	saveConf(t)
+	readConfig("config_test.json")
+	discourse().cats.set(map[int]string{1: "slack", 2: "user"})
+	cr := CategoryRes{CategoryList: Categories{}}
+	cr.CategoryList.Cats = append(cr.CategoryList.Cats,
+		Category{Slug: "slack"},
+		Category{Slug: "user"})
+	ts := createServer(t, http.StatusOK, cr)
+	defer ts.Close()
+
+	discourse().checkDiscourseCategory(conf.Channels)
+}
+
+// categoryServer serves the slack category with id 1 and creates topics,
+// recording the category that they were created in.
+func categoryServer(t *testing.T, category *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/categories.json") {
+			cr := CategoryRes{}
+			cr.CategoryList.Cats = append(cr.CategoryList.Cats,
+				Category{Id: 1, Slug: "slack"})
+			json.NewEncoder(w).Encode(cr)
+			return
+		}
+		var tp Topic
+		if err := json.NewDecoder(r.Body).Decode(&tp); err != nil {
+			t.Error(err)
+		}
+		*category = tp.Category
+		json.NewEncoder(w).Encode(TopicBody{Id: 1, Slug: "test"})
+	}))
+}
+
+func TestCreateTopicCategory(t *testing.T) {
+	saveConf(t)
+	var category string
+	ts := categoryServer(t, &category)
+	defer ts.Close()
+	conf.DiscKey = "testkey"
+	conf.DiscPrefix = ts.URL
+	discourse().cats.set(nil)
+
+	for _, tc := range []struct {
+		createIn string
+		expected string
+	}{
+		{"7", "7"},
+		// Resolved using the categories fetched when it isn't cached.
+		{"slack", "1"},
+	} {
+		c := &Counter{ChannelId: "general", CreateTopicIn: tc.createIn}
+		addBuckets(c, "New buckets", time.Now().Unix())
+		if _, err := createTopic(c, "Test title"); err != nil {
+			t.Fatal(err)
+		}
+		if category != tc.expected {
+			t.Errorf("Expected category %s for %s, Got: %s", tc.expected,
+				tc.createIn, category)
+		}
+	}
+}
+
+func TestMissingCategory(t *testing.T) {
+	saveConf(t)
+	var category string
+	ts := categoryServer(t, &category)
+	defer ts.Close()
+	conf.DiscKey = "testkey"
+	conf.DiscPrefix = ts.URL
+
+	c := &Counter{ChannelId: "general", CreateTopicIn: "unknown"}
+	addBuckets(c, "New buckets", time.Now().Unix())
+	if _, err := createTopic(c, "Test title"); err != errUnknownCategory {
+		t.Errorf("Expected error %v, Got: %v", errUnknownCategory, err)
+	}
+	if c.topicsEnabled() {
+		t.Errorf("Expected topics to be disabled for the channel")
+	}
+
+	// The alert is still sent, just without a topic.
+	rtm := &r{}
+	sendMessage(c, rtm)
+	if msg := rtm.lastMsg(); msg == "" || strings.Contains(msg, errMsg) {
+		t.Errorf("Expected the alert without an error, Got: %s", msg)
+	}
+
+	// Channels whose category exists still get topics.
+	byId := &Counter{ChannelId: "eng", CreateTopicIn: "12"}
+	bySlug := &Counter{ChannelId: "dev", CreateTopicIn: "slack"}
+	discourse().checkDiscourseCategory(map[string]*Counter{"eng": byId, "dev": bySlug})
+	if !byId.topicsEnabled() || !bySlug.topicsEnabled() {
+		t.Errorf("Expected topics to be enabled for known categories")
+	}
+
+	c.update(&Counter{CreateTopicIn: "slack"})
+	if !c.topicsEnabled() {
+		t.Errorf("Expected topics to be enabled once the category changes")
+	}
+}
+
+func TestCategorySuggestion(t *testing.T) {
+	discourse().cats.set(map[int]string{1: "slack", 2: "user", 3: "dev"})
+	defer discourse().cats.set(nil)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	c := &Counter{ChannelId: "general", CreateTopicIn: "Slak"}
+	discourse().checkDiscourseCategory(map[string]*Counter{"general": c})
+	for _, s := range []string{"Category Slak doesn't exist",
+		"Did you mean slack?", "Available categories: dev, slack, user."} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("Expected log to contain %s, Got: %s", s, buf.String())
+		}
+	}
+
+	if hint := discourse().categoryHint("announcements"); strings.Contains(hint,
+		"Did you mean") {
+		t.Errorf("Expected no suggestion for an unrelated name, Got: %s", hint)
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		d    int
+	}{
+		{"slak", "slack", 1},
+		{"slack", "slack", 0},
+		{"", "dev", 3},
+		{"kitten", "sitting", 3},
+	} {
+		if d := levenshtein(tc.a, tc.b); d != tc.d {
+			t.Errorf("Expected distance %d between %s and %s, Got: %d", tc.d,
+				tc.a, tc.b, d)
+		}
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	saveConf(t)
+	readConfig("config_test.json")
+	if conf.Token == "" {
+		t.Errorf("Expected token to not be nil.")
+	}
+	if conf.DiscPrefix == "" {
+		t.Errorf("Expected discuss prefix to not be nil.")
+	}
+	if len(conf.Channels) != 2 {
+		t.Errorf("Expected len of Channels to be %d. Got: %d", 2,
+			len(conf.Channels))
+	}
+}
+
+func TestSaveAndLoadState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wisemonk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "state.json")
+
+	c := &Counter{Interval: "10m"}
+	c.setup("general")
+	addBuckets(c, "New buckets", time.Now().Unix())
+	addBuckets(c, "Old buckets", time.Now().Add(-10*time.Minute).Unix())
+	c.SetMeditationEnd(5 * time.Minute)
+	if err := saveState(filename, map[string]*Counter{"general": c}); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := &Counter{Interval: "10m"}
+	fresh.setup("general")
+	if err := loadState(filename, map[string]*Counter{"general": fresh}); err != nil {
+		t.Fatal(err)
+	}
+	// Old buckets are dropped on load.
+	if len(fresh.buckets) != 10 {
+		t.Errorf("Expected %d buckets, Got: %d", 10, len(fresh.buckets))
+	}
+	if count := fresh.Count(); count != 10 {
+		t.Errorf("Expected count to be %d, Got: %d", 10, count)
+	}
+	if !fresh.meditationEnd.Equal(c.meditationEnd) {
+		t.Errorf("Expected meditation end to be %v, Got: %v",
+			c.meditationEnd, fresh.meditationEnd)
+	}
+
+	if err := loadState(filepath.Join(dir, "missing.json"),
+		map[string]*Counter{"general": fresh}); err != nil {
+		t.Errorf("Expected no error for a missing file, Got: %v", err)
+	}
+}
+
+func TestConfigFlag(t *testing.T) {
+	saveConf(t)
+	old := *configFile
+	defer flag.Set("config", old)
+	if err := flag.Set("config", "config_test.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	conf = Config{}
+	readConfig(*configFile)
+	if len(conf.Channels) != 2 {
+		t.Errorf("Expected len of Channels to be %d. Got: %d", 2,
+			len(conf.Channels))
+	}
+	if _, ok := conf.Channels["C13LH03RR"]; !ok {
+		t.Errorf("Expected channel C13LH03RR to be in the config")
+	}
+}
+
+func TestStartupKeepsChannels(t *testing.T) {
+	saveConf(t)
+	loadConfig("config_test.json")
+	cr := CategoryRes{}
+	cr.CategoryList.Cats = append(cr.CategoryList.Cats,
+		Category{Id: 1, Slug: "slack"}, Category{Id: 2, Slug: "user"})
+	ts := createServer(t, http.StatusOK, cr)
+	defer ts.Close()
+	conf.DiscPrefix = ts.URL
+	cacheCategories()
+
+	if len(conf.Channels) != 2 {
+		t.Fatalf("Expected len of Channels to be %d. Got: %d", 2,
+			len(conf.Channels))
+	}
+	for cid, c := range conf.Channels {
+		if c.ChannelId != cid {
+			t.Errorf("Expected channel id %s, Got: %s", cid, c.ChannelId)
+		}
+		if c.messages == nil {
+			t.Errorf("Expected channel %s to be set up for messages", cid)
+		}
+	}
+	if c := conf.Channels["G1D59039B"]; c.MaxMsg != 20 || c.Interval != "10m" {
+		t.Errorf("Expected maxmsg %d and interval %s, Got: %d and %s", 20,
+			"10m", c.MaxMsg, c.Interval)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	saveConf(t)
+	readConfig("config_test.json")
+	if err := validateConfig(conf); err != nil {
+		t.Errorf("Expected config_test.json to be valid, Got: %v", err)
+	}
+
+	c := Config{DiscKey: "testkey", UserRefresh: "hourly",
+		Channels: map[string]*Counter{
+			"general": {Interval: "10 mins", MaxMsg: 20, CreateTopicIn: "slack"},
+			"random":  {Interval: "10m", MaxMsg: -1},
+			"dev": {Interval: "10m", MaxMsg: 20, CreateTopicIn: "dev",
+				MaxMeditation: "a day", NudgeCooldown: "soon"},
+			"eng": {Interval: "10m", MaxMsg: 20, CreateTopicIn: "dev",
+				SummarizeAfter: "1h", IgnorePatterns: []string{"BUILD ("},
+				CountMode: "characters", ActiveHours: "9am-5pm",
+				BucketGranularity: "2s", IgnoreThreads: true},
+		}}
+	err := validateConfig(c)
+	if err == nil {
+		t.Fatalf("Expected an error for an invalid config")
+	}
+	for _, s := range []string{"general: invalid interval",
+		"random: maxmsg", "random: create_topic_in", "dev: invalid max_meditation",
+		"dev: invalid nudge_cooldown", "eng: summarize_after",
+		"eng: invalid ignore_patterns", "eng: unknown count_mode", "eng: invalid active_hours", "eng: bucket_granularity",
+		"eng: ignore_threads", "user_refresh_interval"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("Expected error to contain %s, Got: %v", s, err)
+		}
+	}
+
+	// Threads can be told apart in socket mode.
+	c = Config{Mode: modeSocket, AppToken: "xapp", Token: "xoxb",
+		Channels: map[string]*Counter{
+			"general": {Interval: "10m", MaxMsg: 20, IgnoreThreads: true},
+		}}
+	if err := validateConfig(c); err != nil {
+		t.Errorf("Expected ignore_threads to be valid in socket mode, Got: %v",
+			err)
+	}
+}
+
+func TestSecretsFromEnv(t *testing.T) {
+	saveConf(t)
+	os.Setenv("WISEMONK_SLACK_TOKEN", "xoxb-from-env")
+	os.Setenv("WISEMONK_DISCOURSE_KEY", "key-from-env")
+	defer os.Unsetenv("WISEMONK_SLACK_TOKEN")
+	defer os.Unsetenv("WISEMONK_DISCOURSE_KEY")
+
+	readConfig("config_test.json")
+	if conf.Token != "xoxb-from-env" {
+		t.Errorf("Expected token from the environment, Got: %s", conf.Token)
+	}
+	if conf.DiscKey != "key-from-env" {
+		t.Errorf("Expected discourse key from the environment, Got: %s",
+			conf.DiscKey)
+	}
+
+	os.Unsetenv("WISEMONK_SLACK_TOKEN")
+	readConfig("config_test.json")
+	if conf.Token == "" || conf.Token == "xoxb-from-env" {
+		t.Errorf("Expected token from the file, Got: %s", conf.Token)
+	}
+}
+
+func TestBlankToken(t *testing.T) {
+	saveConf(t)
+	dir, err := ioutil.TempDir("", "wisemonk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+
+	b, err := ioutil.ReadFile("config_test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nc Config
+	if err := json.Unmarshal(b, &nc); err != nil {
+		t.Fatal(err)
+	}
+	nc.Token = "  "
+	// The token is checked before the names are looked up in slack.
+	nc.Channels["#general"] = &Counter{Interval: "10m", MaxMsg: 20,
+		CreateTopicIn: "slack"}
+	if b, err = json.Marshal(nc); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := parseConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = validateConfig(c)
+	if err == nil || !strings.Contains(err.Error(), "token is required") {
+		t.Errorf("Expected error about the missing token, Got: %v", err)
+	}
+	_, _, err = reloadConfig(filename)
+	if err == nil || !strings.Contains(err.Error(), "token is required") {
+		t.Errorf("Expected error about the missing token on reload, Got: %v",
+			err)
+	}
+
+	// No token is needed to try wisemonk out.
+	c.Platform = platformStdin
+	if err := validateConfig(c); err != nil {
+		t.Errorf("Expected no error for the stdin platform, Got: %v", err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	saveConf(t)
+	dir, err := ioutil.TempDir("", "wisemonk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+
+	b, err := ioutil.ReadFile("config_test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	readConfig(filename)
+	c := conf.Channels["G1D59039B"]
+	c.setup("general")
+	addBuckets(c, "New buckets", time.Now().Unix())
+	gone := conf.Channels["C13LH03RR"]
+	gone.setup("C13LH03RR")
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	defer close(done)
+	gone.start(&r{}, &wg, noUsers(), done)
+
+	var nc Config
+	if err := json.Unmarshal(b, &nc); err != nil {
+		t.Fatal(err)
+	}
+	nc.Channels["G1D59039B"].MaxMsg = 50
+	nc.Channels["C13LH03RS"] = &Counter{Interval: "5m", MaxMsg: 10,
+		CreateTopicIn: "dev"}
+	delete(nc.Channels, "C13LH03RR")
+	if b, err = json.Marshal(nc); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	added, removed, err := reloadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MaxMsg != 50 {
+		t.Errorf("Expected maxmsg to be %d, Got: %d", 50, c.MaxMsg)
+	}
+	if len(c.buckets) != 10 {
+		t.Errorf("Expected buckets to be kept, Got: %d", len(c.buckets))
+	}
+	if len(added) != 1 || added[0].ChannelId != "C13LH03RS" {
+		t.Errorf("Expected channel C13LH03RS to be added, Got: %v", added)
+	}
+	if _, ok := counterFor("C13LH03RS"); !ok {
+		t.Errorf("Expected channel C13LH03RS to be in the config")
+	}
+	if len(removed) != 1 || removed[0] != gone {
+		t.Errorf("Expected channel C13LH03RR to be removed, Got: %v", removed)
+	}
+	if _, ok := counterFor("C13LH03RR"); ok {
+		t.Errorf("Expected channel C13LH03RR to be out of the config")
+	}
+	// The removed channel stops without done being closed.
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("Expected the removed channel to be stopped")
+	}
+}
+
+func TestRestartSettings(t *testing.T) {
+	old := Config{Token: "xoxb", LogLevel: "info", TitlePrefix: "Moved: ",
+		Channels: map[string]*Counter{"general": {MaxMsg: 20}}}
+	nc := old
+	nc.LogLevel = "debug"
+	nc.Admins = []string{"mrjn"}
+	nc.Channels = map[string]*Counter{"dev": {MaxMsg: 10}}
+	if changed := restartSettings(old, nc); len(changed) != 0 {
+		t.Errorf("Expected the reloaded settings to be left out, Got: %v",
+			changed)
+	}
+
+	nc.TitlePrefix = "Moved from Slack: "
+	nc.MaxRetries = new(int)
+	changed := restartSettings(old, nc)
+	if strings.Join(changed, ",") != "max_retries,title_prefix" {
+		t.Errorf("Expected max_retries and title_prefix to need a restart, Got: %v",
+			changed)
+	}
+}
+
+func TestDispatchIgnoresBots(t *testing.T) {
+	saveConf(t)
+	readConfig("config_test.json")
+	c := conf.Channels["G1D59039B"]
+	c.setup("G1D59039B")
+	botUserId = "U0WISEMNK"
+	defer func() { botUserId = "" }()
+
+	dispatch(&Message{Msg: slack.Msg{Channel: "G1D59039B",
+		BotID: "B13LHF42F", SubType: "bot_message", Text: "I am a bot",
+		Timestamp: "1465010249"}})
+	dispatch(&Message{Msg: slack.Msg{Channel: "G1D59039B",
+		User: "U0WISEMNK", Text: "Okay, I am going to meditate for 5m0s",
+		Timestamp: "1465010249"}})
+
+	select {
+	case m := <-c.messages:
+		t.Errorf("Expected message to be ignored, Got: %+v", m)
+	default:
+	}
+	if count := c.Count(); count != 0 {
+		t.Errorf("Expected count to be %d, Got: %d", 0, count)
+	}
+
+	dispatch(&Message{Msg: slack.Msg{Channel: "G1D59039B",
+		User: "U13LHF42F", Text: "hello", Timestamp: "1465010249"}})
+	if len(c.messages) != 1 {
+		t.Errorf("Expected message from a user to be dispatched")
+	}
+}
+
+func TestDispatchIgnoresThreads(t *testing.T) {
+	saveConf(t)
+	readConfig("config_test.json")
+	c := conf.Channels["G1D59039B"]
+	c.setup("G1D59039B")
+	reply := &Message{Msg: slack.Msg{Channel: "G1D59039B",
+		User: "U13LHF42F", Text: "In a thread",
+		Timestamp: "1465010259.000606"},
+		ThreadTimestamp: "1465010249.000606"}
+
+	// Thread replies are counted by default.
+	dispatch(reply)
+	if len(c.messages) != 1 {
+		t.Errorf("Expected thread reply to be dispatched")
 	}
-	ft := filterTopics(c, topics)
-	if len(ft) != 1 {
-		t.Errorf("Expected filtered topics to have length %d. Got: %d",
-			1, len(ft))
+	<-c.messages
+
+	c.IgnoreThreads = true
+	dispatch(reply)
+	if len(c.messages) != 0 {
+		t.Errorf("Expected thread reply to be ignored")
+	}
+
+	// The parent of a thread is still counted.
+	parent := &Message{Msg: slack.Msg{Channel: "G1D59039B",
+		User: "U13LHF42F", Text: "Parent",
+		Timestamp: "1465010249.000606"},
+		ThreadTimestamp: "1465010249.000606"}
+	dispatch(parent)
+	if len(c.messages) != 1 {
+		t.Errorf("Expected thread parent to be dispatched")
 	}
 }
 
-func TestCallYoda(t *testing.T) {
-	c := &Counter{ChannelId: "general"}
-	timeNow := time.Now().Unix()
-	addBuckets(c, "New buckets", timeNow)
-	rtm := &r{}
+func TestHealth(t *testing.T) {
+	h := &Health{}
+	ts := httptest.NewServer(h.Handler())
+	defer ts.Close()
 
-	if callYoda(c, rtm, "Message to append"); !invoked {
-		t.Errorf("Expected invoked to be %t, Got: %t", true, false)
+	check := func(path string, expected int) {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("Expected %s to return %d, Got: %d", path, expected,
+				resp.StatusCode)
+		}
 	}
+
+	check("/healthz", http.StatusServiceUnavailable)
+	check("/ready", http.StatusServiceUnavailable)
+	h.SetConnected(true)
+	h.SetReady(true)
+	check("/healthz", http.StatusOK)
+	check("/ready", http.StatusOK)
+	h.SetConnected(false)
+	check("/healthz", http.StatusServiceUnavailable)
 }
 
-func TestSendMessage(t *testing.T) {
+func TestMetrics(t *testing.T) {
+	saveConf(t)
+	old := metrics
+	metrics = NewMetrics()
+	defer func() { metrics = old }()
+
 	c := &Counter{ChannelId: "general"}
-	timeNow := time.Now().Unix()
-	addBuckets(c, "New buckets", timeNow)
-	rtm := &r{}
+	addBuckets(c, "New buckets", time.Now().Unix())
+	c.SetMeditationEnd(5 * time.Minute)
+	ts := createServer(t, http.StatusOK, TopicBody{Id: 1, Slug: "test"})
+	defer ts.Close()
+	conf.DiscPrefix = ts.URL
+	conf.DiscKey = "testkey"
+	sendMessage(c, &r{})
 
-	invoked = false
-	if sendMessage(c, rtm); !invoked {
-		t.Errorf("Expected invoked to be %t, Got: %t", true, false)
+	ms := httptest.NewServer(metrics.Handler(func() map[string]*Counter {
+		return map[string]*Counter{"general": c}
+	}))
+	defer ms.Close()
+	resp, err := http.Get(ms.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	conf.DiscKey = "testkey"
-	addBuckets(c, "New buckets", timeNow)
-	invoked = false
-	ts := createServer(t, http.StatusOK, TopicBody{Id: 1,
-		Slug: "test-title-created"})
-	conf.DiscPrefix = ts.URL
-	defer ts.Close()
+	for _, s := range []string{
+		`wisemonk_messages_total{channel="general"} 10`,
+		`wisemonk_nudges_total{channel="general"} 1`,
+		`wisemonk_topics_created_total 1`,
+		`wisemonk_meditating{channel="general"} 1`,
+	} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("Expected metrics to contain %s, Got: %s", s, b)
+		}
+	}
+}
 
-	if sendMessage(c, rtm); !invoked {
-		t.Errorf("Expected invoked to be %t, Got: %t", true, false)
+func TestHandleEventsReconnect(t *testing.T) {
+	old := metrics
+	metrics = NewMetrics()
+	defer func() { metrics = old }()
+
+	events := make(chan slack.RTMEvent)
+	done := make(chan struct{})
+	go func() {
+		handleEvents(events)
+		close(done)
+	}()
+
+	events <- slack.RTMEvent{Type: "connected", Data: &slack.ConnectedEvent{ConnectionCount: 1}}
+	events <- slack.RTMEvent{Type: "disconnected", Data: &slack.DisconnectedEvent{}}
+	events <- slack.RTMEvent{Type: "rtm_error", Data: &slack.RTMError{Code: 1, Msg: "blip"}}
+	events <- slack.RTMEvent{Type: "connected", Data: &slack.ConnectedEvent{ConnectionCount: 2}}
+	// The loop should still be receiving events.
+	select {
+	case events <- slack.RTMEvent{Type: "latency_report", Data: &slack.LatencyReport{}}:
+	case <-done:
+		t.Fatal("Expected the event loop to keep running")
+	case <-time.After(time.Second):
+		t.Fatal("Timed out sending event")
+	}
+	close(events)
+	<-done
+
+	health.RLock()
+	connected := health.connected
+	health.RUnlock()
+	if !connected {
+		t.Error("Expected health to report connected after reconnecting")
+	}
+	if n := metrics.Reconnects(); n != 1 {
+		t.Errorf("Expected 1 reconnect, Got: %d", n)
 	}
 }
 
-func TestCreateNewTopic(t *testing.T) {
-	c := &Counter{ChannelId: "general"}
-	timeNow := time.Now().Unix()
-	addBuckets(c, "New buckets", timeNow)
-	m := "wisemonk create topic testing wisemonk"
-	rtm := &r{}
-	ts := createServer(t, http.StatusOK, TopicBody{Id: 1,
-		Slug: "test-title-created"})
-	conf.DiscPrefix = ts.URL
-	defer ts.Close()
+func TestWaitForConnection(t *testing.T) {
+	events := make(chan slack.RTMEvent)
+	done := make(chan error)
+	go func() {
+		done <- waitForConnection(events, time.Minute)
+	}()
 
-	conf.DiscKey = "testkey"
-	invoked = false
-	if createNewTopic(c, m, rtm); !invoked {
-		t.Errorf("Expected invoked to be %t, Got: %t", true, false)
+	events <- slack.RTMEvent{Type: "connecting", Data: &slack.ConnectingEvent{Attempt: 1}}
+	events <- slack.RTMEvent{Type: "connection_error",
+		Data: &slack.ConnectionErrorEvent{Attempt: 1, ErrorObj: errors.New("timeout")}}
+	select {
+	case err := <-done:
+		t.Fatalf("Expected to wait for the connection, Got: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	events <- slack.RTMEvent{Type: "connected", Data: &slack.ConnectedEvent{ConnectionCount: 1}}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected to stop waiting once connected")
+	}
+
+	go func() {
+		events <- slack.RTMEvent{Type: "invalid_auth", Data: &slack.InvalidAuthEvent{}}
+	}()
+	if err := waitForConnection(events, time.Minute); err == nil ||
+		!strings.Contains(err.Error(), "Invalid credentials") {
+		t.Errorf("Expected an error for invalid credentials, Got: %v", err)
+	}
+	if err := waitForConnection(events, 10*time.Millisecond); err == nil {
+		t.Errorf("Expected an error when no connection is made")
 	}
 }
 
-func TestSubstituteUsernames(t *testing.T) {
-	memmap := make(map[string]string)
-	memmap["U13LHF42F"] = "mrjn"
-	memmap["U13LHF42G"] = "pawan"
-	text := "<@U13LHF42F> <@U13LHF42F> <@U13LHF42G>"
+func TestStartChannels(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	c := &Counter{Interval: "10m", MaxMsg: 20, clock: clock}
+	c.setup("general")
+	cs := map[string]*Counter{"general": c}
+	var mu sync.Mutex
+	var started []*Counter
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+	start := func(c *Counter) {
+		mu.Lock()
+		started = append(started, c)
+		mu.Unlock()
+		c.start(&r{}, &wg, noUsers(), done)
+	}
+	// checkOrIncr makes its ticker with the clock of the counter.
+	running := func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		clock.Lock()
+		defer clock.Unlock()
+		return len(started), len(clock.waiters)
+	}
 
-	text = substituteUsernames(text, memmap)
-	expected := "@mrjn @mrjn @pawan"
-	if text != expected {
-		t.Errorf("Expected %s, Got: %s", expected, text)
+	events := make(chan slack.RTMEvent)
+	errc := make(chan error)
+	go func() {
+		errc <- startChannels(events, time.Minute, cs, start)
+	}()
+	events <- slack.RTMEvent{Type: "connecting", Data: &slack.ConnectingEvent{Attempt: 1}}
+	time.Sleep(50 * time.Millisecond)
+	if n, w := running(); n != 0 || w != 0 {
+		t.Fatalf("Expected nothing to start before connecting, Got: %d started, %d tickers",
+			n, w)
+	}
+	events <- slack.RTMEvent{Type: "connected", Data: &slack.ConnectedEvent{ConnectionCount: 1}}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, w := running(); w > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n, w := running(); n != 1 || w != 1 {
+		t.Errorf("Expected general to start once connected, Got: %d started, %d tickers",
+			n, w)
+	}
+
+	// Nothing starts if the credentials are wrong.
+	mu.Lock()
+	started = nil
+	mu.Unlock()
+	go func() {
+		events <- slack.RTMEvent{Type: "invalid_auth", Data: &slack.InvalidAuthEvent{}}
+	}()
+	if err := startChannels(events, time.Minute, cs, start); err == nil {
+		t.Errorf("Expected an error for invalid credentials")
+	}
+	if n, _ := running(); n != 0 {
+		t.Errorf("Expected nothing to start on invalid credentials, Got: %d", n)
 	}
 }
 
-func TestRunQueryAndParseResponse(t *testing.T) {
-	mems := Members{}
-	mems.Users = append(mems.Users, Member{Id: "U13GH76YT", Name: "mrjn"},
-		Member{Id: "U13GH13YT", Name: "pawan"})
-	ts := createServer(t, http.StatusOK, mems)
+func TestWebClientSendMessage(t *testing.T) {
+	var auth, text string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		text = r.FormValue("text")
+		w.Write([]byte(`{"ok": true}`))
+	}))
 	defer ts.Close()
 
-	var m Members
-	runQueryAndParseResponse(ts.URL, &m)
+	old := slackPrefix
+	slackPrefix = ts.URL
+	defer func() { slackPrefix = old }()
+
+	w := &webClient{token: "xoxb"}
+	w.SendMessage(w.NewOutgoingMessage("hello", "general"))
+	if auth != "Bearer xoxb" || text != "hello" {
+		t.Errorf("Expected message hello with token xoxb, Got: %s, %s",
+			text, auth)
+	}
 }
 
-func TestCacheUsernames(t *testing.T) {
-	mems := Members{}
-	mems.Users = append(mems.Users, Member{Id: "U13GH76YT", Name: "mrjn"},
-		Member{Id: "U13GH13YT", Name: "pawan"})
-	ts := createServer(t, http.StatusOK, mems)
+func TestReactionHint(t *testing.T) {
+	saveConf(t)
+	conf.DiscKey = ""
+	var mu sync.Mutex
+	var calls []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		calls = append(calls, r.URL.Path+" "+r.Form.Get("timestamp")+
+			r.Form.Get("name"))
+		mu.Unlock()
+		w.Write([]byte(`{"ok": true}`))
+	}))
 	defer ts.Close()
+	old := slackPrefix
+	slackPrefix = ts.URL
+	defer func() { slackPrefix = old }()
+	lastCall := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return strings.Join(calls, ", ")
+	}
 
-	memmap := cacheUsernames(ts.URL)
-	if _, ok := memmap["U13GH76YT"]; !ok {
-		t.Errorf("Expected ok to be true. Got false")
+	c := &Counter{Interval: "10m", MaxMsg: 10, ReactionHint: true}
+	c.setup("general")
+	now := time.Now().Unix()
+	for i := int64(9); i >= 0; i-- {
+		c.Increment(&slack.Msg{Channel: "general", User: "U13LHF42F",
+			Text: "Talking", Timestamp: strconv.FormatInt(now-i, 10)},
+			map[string]string{})
 	}
-	uname := memmap["U13GH76YT"]
-	if uname != "mrjn" {
-		t.Errorf("Expected username to be mrjn, Got: ", uname)
+	w := &webClient{token: "xoxb"}
+	sendMessage(c, w)
+	expected := "/reactions.add " + strconv.FormatInt(now, 10) + hintReaction
+	if calls := lastCall(); calls != expected {
+		t.Errorf("Expected a reaction to the latest message, Got: %s", calls)
 	}
-	if _, ok := memmap["U13GH13YT"]; !ok {
-		t.Errorf("Expected ok to be true. Got false")
+	if count := c.Count(); count != 10 {
+		t.Errorf("Expected the messages to be kept after the hint, Got: %d",
+			count)
+	}
+
+	// No alert till there are more messages.
+	sendMessage(c, w)
+	if calls := lastCall(); calls != expected {
+		t.Errorf("Expected no alert without new messages, Got: %s", calls)
+	}
+
+	c.Increment(&slack.Msg{Channel: "general", User: "U13LHF42F",
+		Text: "Still talking", Timestamp: strconv.FormatInt(now+1, 10)},
+		map[string]string{})
+	sendMessage(c, w)
+	if calls := lastCall(); calls != expected+", /chat.postMessage " {
+		t.Errorf("Expected the alert once the hint was ignored, Got: %s", calls)
+	}
+
+	// Without the option the alert is sent right away.
+	c = &Counter{Interval: "10m", MaxMsg: 10}
+	c.setup("general")
+	addBuckets(c, "New buckets", now)
+	calls = nil
+	sendMessage(c, w)
+	if calls := lastCall(); calls != "/chat.postMessage " {
+		t.Errorf("Expected only the alert, Got: %s", calls)
 	}
 }
 
-func TestCheckDiscourseCategory(t *testing.T) {
-	readConfig("config_test.json")
-	discourseCategory = make(map[int]string)
-	discourseCategory[1] = "slack"
-	discourseCategory[2] = "user"
-	cr := CategoryRes{CategoryList: Categories{}}
-	cr.CategoryList.Cats = append(cr.CategoryList.Cats,
-		Category{Slug: "slack"},
-		Category{Slug: "user"})
-	ts := createServer(t, http.StatusOK, cr)
+func TestNudgeBlocks(t *testing.T) {
+	var text, blocks string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		text = r.FormValue("text")
+		blocks = r.FormValue("blocks")
+		w.Write([]byte(`{"ok": true}`))
+	}))
 	defer ts.Close()
+	old := slackPrefix
+	slackPrefix = ts.URL
+	defer func() { slackPrefix = old }()
 
-	checkDiscourseCategory(conf.Channels, ts.URL)
-}
+	topic := "https://discuss.dgraph.io/t/release-plans/12"
+	c := &Counter{ChannelId: "general", NudgeBlocks: true}
+	addBuckets(c, "New buckets", time.Now().Unix())
+	nudge(c, &webClient{token: "xoxb"}, "Please move your discussion to "+topic,
+		topic)
 
-func TestReadConfig(t *testing.T) {
-	readConfig("config_test.json")
-	if conf.Token == "" {
-		t.Errorf("Expected token to not be nil.")
+	if !strings.Contains(text, string(yoda)) {
+		t.Errorf("Expected the alert as text too, Got: %s", text)
 	}
-	if conf.DiscPrefix == "" {
-		t.Errorf("Expected discuss prefix to not be nil.")
+	var bs []map[string]interface{}
+	if err := json.Unmarshal([]byte(blocks), &bs); err != nil {
+		t.Fatalf("Expected blocks, Got: %s. %v", blocks, err)
 	}
-	if len(conf.Channels) != 2 {
-		t.Errorf("Expected len of Channels to be %d. Got: %d", 2,
-			len(conf.Channels))
+	last := bs[len(bs)-1]
+	els, _ := last["elements"].([]interface{})
+	if last["type"] != "actions" || len(els) != 1 {
+		t.Fatalf("Expected the last block to have a button, Got: %v", last)
+	}
+	button := els[0].(map[string]interface{})
+	if button["type"] != "button" || button["url"] != topic {
+		t.Errorf("Expected a button for %s, Got: %v", topic, button)
+	}
+
+	// Without a topic there is no button.
+	for _, b := range nudgeBlocks("quote", errMsg, "") {
+		if b.Type == "actions" {
+			t.Errorf("Expected no button without a topic, Got: %+v", b)
+		}
 	}
 }
 
 func TestParseSearchQuery(t *testing.T) {
 	m := "wisemonk query performance blogpost abc"
-	q, c := parseSearchQuery(m)
+	q, c, o, all := parseSearchQuery(m)
 	expected := "performance blogpost abc"
 	if q != expected {
 		t.Errorf("Expected query to be: %s. Got: %s", expected, q)
@@ -384,7 +3844,7 @@ func TestParseSearchQuery(t *testing.T) {
 	}
 
 	m = "wisemonk query performance blogpost 4"
-	q, c = parseSearchQuery(m)
+	q, c, o, all = parseSearchQuery(m)
 	expected = "performance blogpost"
 	if q != expected {
 		t.Errorf("Expected query to be: %s. Got: %s", expected, q)
@@ -393,8 +3853,18 @@ func TestParseSearchQuery(t *testing.T) {
 		t.Errorf("Expected count to be %d. Got: %d", 4, c)
 	}
 
+	m = "wisemonk query performance blogpost 15"
+	q, c, o, all = parseSearchQuery(m)
+	expected = "performance blogpost"
+	if q != expected {
+		t.Errorf("Expected query to be: %s. Got: %s", expected, q)
+	}
+	if c != 15 {
+		t.Errorf("Expected count to be %d. Got: %d", 15, c)
+	}
+
 	m = "wisemonk query performance"
-	q, c = parseSearchQuery(m)
+	q, c, o, all = parseSearchQuery(m)
 	expected = "performance"
 	if q != expected {
 		t.Errorf("Expected query to be: %s. Got: %s", expected, q)
@@ -402,4 +3872,311 @@ func TestParseSearchQuery(t *testing.T) {
 	if c != 3 {
 		t.Errorf("Expected count to be %d. Got: %d", 3, c)
 	}
+	if o != "views" {
+		t.Errorf("Expected order to be %s. Got: %s", "views", o)
+	}
+
+	m = "wisemonk query performance 3 latest"
+	q, c, o, all = parseSearchQuery(m)
+	if q != "performance" || c != 3 || o != "latest" {
+		t.Errorf("Expected performance, 3, latest. Got: %s, %d, %s", q, c, o)
+	}
+
+	m = "wisemonk query performance 5 likes"
+	q, c, o, all = parseSearchQuery(m)
+	if q != "performance" || c != 5 || o != "likes" {
+		t.Errorf("Expected performance, 5, likes. Got: %s, %d, %s", q, c, o)
+	}
+	if all {
+		t.Errorf("Expected only the search_over categories to be searched")
+	}
+
+	m = "wisemonk query performance 5 all"
+	q, c, o, all = parseSearchQuery(m)
+	if q != "performance" || c != 5 || o != "views" || !all {
+		t.Errorf("Expected performance, 5, views, true. Got: %s, %d, %s, %t",
+			q, c, o, all)
+	}
+
+	m = "wisemonk query performance 5 latest all"
+	q, c, o, all = parseSearchQuery(m)
+	if q != "performance" || c != 5 || o != "latest" || !all {
+		t.Errorf("Expected performance, 5, latest, true. Got: %s, %d, %s, %t",
+			q, c, o, all)
+	}
+}
+
+func TestDiscourseDisabledForChannel(t *testing.T) {
+	saveConf(t)
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		json.NewEncoder(w).Encode(TopicBody{Id: 1, Slug: "test"})
+	}))
+	defer ts.Close()
+	conf.DiscKey = "testkey"
+	conf.DiscPrefix = ts.URL
+
+	disabled := false
+	c := &Counter{ChannelId: "general", CreateTopicIn: "1",
+		DiscourseEnabled: &disabled}
+	addBuckets(c, "New buckets", time.Now().Unix())
+	rtm := &r{}
+	sendMessage(c, rtm)
+	if rtm.lastMsg() == "" || strings.Contains(rtm.lastMsg(), ts.URL) {
+		t.Errorf("Expected a nudge without a topic, Got: %q", rtm.lastMsg())
+	}
+
+	rtm = &r{}
+	createNewTopic(c, "wisemonk create topic testing", rtm)
+	searchDiscourse(c, "wisemonk query testing", rtm)
+	if len(rtm.msgs) != 0 {
+		t.Errorf("Expected commands to be ignored, Got: %v", rtm.msgs)
+	}
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Errorf("Expected discourse not to be called, Got %d requests", n)
+	}
+}
+
+func TestResolveChannelNames(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		if r.URL.Path != "/conversations.list" {
+			t.Errorf("Unexpected call to %s", r.URL.Path)
+		}
+		// The channels are split across two pages.
+		if r.FormValue("cursor") == "" {
+			w.Write([]byte(`{"ok": true, "channels": [{"id": "C024BE91L", "name": "general"}],
+				"response_metadata": {"next_cursor": "page2"}}`))
+			return
+		}
+		w.Write([]byte(`{"ok": true, "channels": [{"id": "G1D59039B", "name": "dev"}],
+			"response_metadata": {"next_cursor": ""}}`))
+	}))
+	defer ts.Close()
+	old := slackPrefix
+	slackPrefix = ts.URL
+	defer func() { slackPrefix = old }()
+
+	general, dev := &Counter{MaxMsg: 1}, &Counter{MaxMsg: 2}
+	nc := Config{Token: "xoxb", Channels: map[string]*Counter{
+		"#general": general, "#dev": dev, "C13LH03RS": {MaxMsg: 3}}}
+	if err := resolveChannelNames(&nc); err != nil {
+		t.Fatal(err)
+	}
+	if len(nc.Channels) != 3 || nc.Channels["C024BE91L"] != general ||
+		nc.Channels["G1D59039B"] != dev || nc.Channels["C13LH03RS"] == nil {
+		t.Errorf("Expected the names to be replaced by ids, Got: %v",
+			nc.Channels)
+	}
+
+	nc = Config{Token: "xoxb", Channels: map[string]*Counter{
+		"#general": {}, "#random": {}}}
+	err := resolveChannelNames(&nc)
+	if err == nil || !strings.Contains(err.Error(), "#random") ||
+		strings.Contains(err.Error(), "#general") {
+		t.Errorf("Expected an error for #random, Got: %v", err)
+	}
+
+	nc = Config{Platform: platformMattermost, Channels: map[string]*Counter{
+		"#general": {}}}
+	if err := resolveChannelNames(&nc); err == nil {
+		t.Errorf("Expected an error for names on mattermost")
+	}
+
+	// On stdin the names are kept, without the #.
+	nc = Config{Platform: platformStdin, Channels: map[string]*Counter{
+		"#general": general}}
+	if err := resolveChannelNames(&nc); err != nil {
+		t.Fatal(err)
+	}
+	if len(nc.Channels) != 1 || nc.Channels["general"] != general {
+		t.Errorf("Expected general to be keyed by its name, Got: %v",
+			nc.Channels)
+	}
+}
+
+func TestTidyNudge(t *testing.T) {
+	saveConf(t)
+	conf.DiscKey = ""
+	var mu sync.Mutex
+	var calls []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		calls = append(calls, r.URL.Path+" "+r.Form.Get("ts")+" "+
+			r.Form.Get("text"))
+		mu.Unlock()
+		w.Write([]byte(`{"ok": true, "ts": "1488369600.000100"}`))
+	}))
+	defer ts.Close()
+	old := slackPrefix
+	slackPrefix = ts.URL
+	defer func() { slackPrefix = old }()
+
+	for _, tc := range []struct {
+		mode string
+		want string
+	}{
+		{"", "/chat.update 1488369600.000100 This channel got busy"},
+		{tidyDelete, "/chat.delete 1488369600.000100 "},
+	} {
+		mu.Lock()
+		calls = nil
+		mu.Unlock()
+		clock := newFakeClock(time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC))
+		c := &Counter{Interval: "1h", MaxMsg: 5, TidyNudgeAfter: "10m",
+			TidyNudge: tc.mode, clock: clock}
+		c.setup("general")
+		w := &webClient{token: "xoxb"}
+		addBuckets(c, "New buckets", clock.Now().Unix())
+		sendMessage(c, w)
+		if _, _, ok := c.tidyDue(); ok {
+			t.Errorf("%q: Expected the alert to be kept at first", tc.mode)
+		}
+
+		// The alert is kept while the channel is busy.
+		addBuckets(c, "Still going", clock.Now().Unix())
+		clock.Advance(10 * time.Minute)
+		if _, _, ok := c.tidyDue(); ok {
+			t.Errorf("%q: Expected the alert to be kept while busy", tc.mode)
+		}
+		c.clearBuckets()
+		at, topicUrl, ok := c.tidyDue()
+		if !ok {
+			t.Fatalf("%q: Expected the alert to be tidied", tc.mode)
+		}
+		tidyNudge(c, w, at, topicUrl)
+		if _, _, ok := c.tidyDue(); ok {
+			t.Errorf("%q: Expected the alert to be tidied only once", tc.mode)
+		}
+
+		mu.Lock()
+		if len(calls) != 2 || !strings.HasPrefix(calls[0], "/chat.postMessage") ||
+			!strings.HasPrefix(calls[1], tc.want) {
+			t.Errorf("%q: Expected the alert to be posted and then %s, Got: %q",
+				tc.mode, tc.want, calls)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestReportStats(t *testing.T) {
+	saveConf(t)
+	ts := createServer(t, http.StatusOK, TopicBody{Id: 1, Slug: "test"})
+	defer ts.Close()
+	conf.DiscKey = "testkey"
+	conf.DiscPrefix = ts.URL
+
+	c := &Counter{Interval: "1h", MaxMsg: 20, CreateTopicIn: "1"}
+	c.setup("general")
+	rtm := &r{}
+	reportStats(c, "wisemonk stats", rtm)
+	if expected := "I haven't created any topics for this channel yet."; rtm.lastMsg() != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, rtm.lastMsg())
+	}
+
+	for _, title := range []string{"Release plans", "Flaky tests"} {
+		addBuckets(c, "New buckets", time.Now().Unix())
+		createNewTopic(c, "wisemonk create topic "+title, rtm)
+	}
+	reportStats(c, "wisemonk stats", rtm)
+	stats := rtm.lastMsg()
+	first := strings.Index(stats, "Flaky tests>")
+	second := strings.Index(stats, "Release plans>")
+	if !strings.HasPrefix(stats, "The last 2 topics") || first < 0 ||
+		second < first {
+		t.Errorf("Expected both topics, latest first, Got: %s", stats)
+	}
+	reportStats(c, "wisemonk stats 1", rtm)
+	if stats := rtm.lastMsg(); strings.Contains(stats, "Release plans") ||
+		!strings.Contains(stats, "Flaky tests") {
+		t.Errorf("Expected only the latest topic, Got: %s", stats)
+	}
+
+	// The history is kept in the state.
+	restored := &Counter{Interval: "1h", MaxMsg: 20}
+	restored.Restore(c.State())
+	if topics := restored.recentTopics(defaultStatsCount); len(topics) != 2 ||
+		!strings.HasSuffix(topics[0].Title, "Flaky tests") {
+		t.Errorf("Expected the history to be restored, Got: %+v", topics)
+	}
+}
+
+func TestPickQuoteNoRepeats(t *testing.T) {
+	old := quotes
+	defer func() { quotes = old }()
+
+	quotes = []string{"Clear is better than clever.", "Don't panic."}
+	c := &Counter{rng: rand.New(rand.NewSource(1))}
+	last := c.pickQuote()
+	for i := 0; i < 20; i++ {
+		q := c.pickQuote()
+		if q == last {
+			t.Fatalf("Expected consecutive quotes to differ, Got %q twice", q)
+		}
+		last = q
+	}
+
+	quotes = []string{"Don't panic."}
+	for i := 0; i < 2; i++ {
+		if q := c.pickQuote(); q != quotes[0] {
+			t.Errorf("Expected the only quote, Got: %q", q)
+		}
+	}
+}
+
+func TestPickQuoteFixedSource(t *testing.T) {
+	old := quotes
+	defer func() { quotes = old }()
+	quotes = proverbs
+
+	// Two counters with the same seed pick the same quotes.
+	expected := quotes[rand.New(rand.NewSource(42)).Intn(len(quotes))]
+	for i := 0; i < 2; i++ {
+		c := &Counter{rng: rand.New(rand.NewSource(42))}
+		if q := c.pickQuote(); q != expected {
+			t.Errorf("Expected %q with a fixed source, Got: %q", expected, q)
+		}
+	}
+
+	// The first alert shows the chosen quote.
+	c := &Counter{ChannelId: "general", rng: rand.New(rand.NewSource(42))}
+	rtm := &r{}
+	callYoda(c, rtm, "")
+	if !strings.Contains(rtm.lastMsg(), expected) {
+		t.Errorf("Expected the alert to have %q, Got: %s", expected,
+			rtm.lastMsg())
+	}
+}
+
+func TestSlackPostNotRetried(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	old := slackPrefix
+	slackPrefix = ts.URL
+	defer func() { slackPrefix = old }()
+
+	// A retried message could be posted twice.
+	w := &webClient{token: "xoxb"}
+	if _, err := w.PostMessage(w.NewOutgoingMessage("hello", "general"), nil,
+		""); err == nil {
+		t.Errorf("Expected an error for status %d",
+			http.StatusInternalServerError)
+	}
+	if err := jsonRequest("POST", ts.URL+"/api/v4/posts", "token",
+		map[string]string{"message": "hello"}, nil); err == nil {
+		t.Errorf("Expected an error for status %d",
+			http.StatusInternalServerError)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Expected every post to be sent once, Got %d calls", n)
+	}
 }
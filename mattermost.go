@@ -0,0 +1,197 @@
+/*
+ * Copyright 2016 DGraph Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/nlopes/slack"
+	"golang.org/x/net/websocket"
+)
+
+// mattermostClient sends messages to Mattermost using its REST API. Channel ids
+// in the config are Mattermost channel ids when using it.
+type mattermostClient struct {
+	url   string
+	token string
+}
+
+func (m *mattermostClient) NewOutgoingMessage(text string,
+	channel string) *slack.OutgoingMessage {
+	return &slack.OutgoingMessage{Text: text, Channel: channel,
+		Type: "message"}
+}
+
+func (m *mattermostClient) SendMessage(msg *slack.OutgoingMessage) {
+	p := mattermostPost{ChannelId: msg.Channel, Message: msg.Text}
+	if err := jsonRequest("POST", m.url+"/api/v4/posts", m.token, p,
+		nil); err != nil {
+		logger.Errorf("Error while sending message: %v", err)
+	}
+}
+
+type mattermostPost struct {
+	Id        string `json:"id,omitempty"`
+	ChannelId string `json:"channel_id"`
+	UserId    string `json:"user_id,omitempty"`
+	Message   string `json:"message"`
+	RootId    string `json:"root_id,omitempty"`
+	// Set for system messages like users joining the channel.
+	Type string `json:"type,omitempty"`
+	// Milliseconds since the epoch.
+	CreateAt int64 `json:"create_at,omitempty"`
+}
+
+// message converts the post into the message that the counters handle.
+func (p mattermostPost) message() *Message {
+	return &Message{
+		Msg: slack.Msg{Type: "message", Channel: p.ChannelId,
+			User: p.UserId, Text: p.Message,
+			Timestamp: fmt.Sprintf("%d.%03d", p.CreateAt/1000,
+				p.CreateAt%1000)},
+		ThreadTimestamp: p.RootId,
+	}
+}
+
+// Event sent by Mattermost over the websocket.
+type mattermostEvent struct {
+	Event string `json:"event"`
+	Data  struct {
+		// The post is JSON encoded within the event.
+		Post string `json:"post"`
+	} `json:"data"`
+}
+
+// handleMattermostEvent dispatches the post contained in ev, if any.
+func handleMattermostEvent(ev mattermostEvent) {
+	if ev.Event != "posted" {
+		return
+	}
+	var p mattermostPost
+	if err := json.Unmarshal([]byte(ev.Data.Post), &p); err != nil {
+		logger.Errorf("Error while parsing post. %s", err)
+		return
+	}
+	if p.Type != "" {
+		return
+	}
+	dispatch(p.message())
+}
+
+// mattermostSource receives the messages over the Mattermost websocket.
+type mattermostSource struct {
+	url   string
+	token string
+}
+
+func (s *mattermostSource) Listen() error {
+	wsUrl := "ws" + strings.TrimPrefix(s.url, "http") + "/api/v4/websocket"
+	ws, err := websocket.Dial(wsUrl, "", s.url)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	auth := map[string]interface{}{
+		"seq":    1,
+		"action": "authentication_challenge",
+		"data":   map[string]string{"token": s.token},
+	}
+	if err := websocket.JSON.Send(ws, auth); err != nil {
+		return err
+	}
+	health.SetConnected(true)
+	defer health.SetConnected(false)
+
+	for {
+		var ev mattermostEvent
+		if err := websocket.JSON.Receive(ws, &ev); err != nil {
+			return err
+		}
+		handleMattermostEvent(ev)
+	}
+}
+
+type mattermostUser struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+}
+
+const mattermostUsersPerPage = 200
+
+// cacheMattermostUsers returns the map of Mattermost user ids to usernames.
+func cacheMattermostUsers(base string, token string) map[string]string {
+	memmap := make(map[string]string)
+	for page := 0; ; page++ {
+		var users []mattermostUser
+		u := fmt.Sprintf("%s/api/v4/users?page=%d&per_page=%d", base, page,
+			mattermostUsersPerPage)
+		if err := jsonRequest("GET", u, token, nil,
+			&users); err != nil {
+			logger.Errorf("Error while fetching mattermost users. %s", err)
+			return memmap
+		}
+		for _, u := range users {
+			memmap[u.Id] = u.Username
+		}
+		if len(users) < mattermostUsersPerPage {
+			return memmap
+		}
+	}
+}
+
+// fetchMattermostUserId returns the id of the user that the token belongs to.
+func fetchMattermostUserId(base string, token string) (string, error) {
+	var u mattermostUser
+	if err := jsonRequest("GET", base+"/api/v4/users/me", token, nil,
+		&u); err != nil {
+		return "", err
+	}
+	return u.Id, nil
+}
+
+// mattermostMembers gets the member count from the channel stats, and the
+// name from the channel.
+type mattermostMembers struct {
+	url   string
+	token string
+}
+
+func (m *mattermostMembers) ChannelName(channel string) (string, error) {
+	var ch struct {
+		Name string `json:"name"`
+	}
+	u := fmt.Sprintf("%s/api/v4/channels/%s", m.url, channel)
+	if err := jsonRequest("GET", u, m.token, nil, &ch); err != nil {
+		return "", err
+	}
+	return ch.Name, nil
+}
+
+func (m *mattermostMembers) MemberCount(channel string) (int, error) {
+	var stats struct {
+		MemberCount int `json:"member_count"`
+	}
+	u := fmt.Sprintf("%s/api/v4/channels/%s/stats", m.url, channel)
+	if err := jsonRequest("GET", u, m.token, nil, &stats); err != nil {
+		return 0, err
+	}
+	return stats.MemberCount, nil
+}
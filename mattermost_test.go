@@ -0,0 +1,100 @@
+/*
+ * Copyright 2016 DGraph Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestMattermost(t *testing.T) {
+	saveConf(t)
+	readConfig("config_test.json")
+	c := conf.Channels["G1D59039B"]
+	c.setup("G1D59039B")
+
+	var mu sync.Mutex
+	var posted mattermostPost
+	var auth string
+	mux := http.NewServeMux()
+	mux.Handle("/api/v4/websocket", websocket.Handler(func(ws *websocket.Conn) {
+		var challenge struct {
+			Action string            `json:"action"`
+			Data   map[string]string `json:"data"`
+		}
+		if err := websocket.JSON.Receive(ws, &challenge); err != nil {
+			return
+		}
+		mu.Lock()
+		auth = challenge.Action + " " + challenge.Data["token"]
+		mu.Unlock()
+		post, _ := json.Marshal(mattermostPost{Id: "p1",
+			ChannelId: "G1D59039B", UserId: "u1", Message: "hello",
+			CreateAt: 1465010249606})
+		ev := map[string]interface{}{"event": "posted",
+			"data": map[string]string{"post": string(post)}}
+		websocket.JSON.Send(ws, ev)
+	}))
+	mux.HandleFunc("/api/v4/posts", func(w http.ResponseWriter,
+		r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer testtoken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&posted)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": "p2"}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	src := &mattermostSource{url: ts.URL, token: "testtoken"}
+	// Listen returns once the fake server closes the connection.
+	src.Listen()
+	mu.Lock()
+	if auth != "authentication_challenge testtoken" {
+		t.Errorf("Expected authentication challenge with token, Got: %s",
+			auth)
+	}
+	mu.Unlock()
+	select {
+	case m := <-c.messages:
+		if m.Text != "hello" || m.User != "u1" ||
+			m.Timestamp != "1465010249.606" {
+			t.Errorf("Expected message hello from u1, Got: %+v", m)
+		}
+	default:
+		t.Errorf("Expected message to be put on the counter")
+	}
+
+	mc := &mattermostClient{url: ts.URL, token: "testtoken"}
+	mc.SendMessage(mc.NewOutgoingMessage("Meditate", "G1D59039B"))
+	mu.Lock()
+	defer mu.Unlock()
+	if posted.ChannelId != "G1D59039B" || posted.Message != "Meditate" {
+		t.Errorf("Expected message to be posted to the channel, Got: %+v",
+			posted)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2016 DGraph Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"golang.org/x/net/websocket"
+)
+
+// Envelope in which Slack sends events over a Socket Mode connection.
+type socketEnvelope struct {
+	EnvelopeId string          `json:"envelope_id"`
+	Type       string          `json:"type"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// Payload of an envelope of type events_api.
+type eventsPayload struct {
+	Event Message `json:"event"`
+}
+
+type connectionsOpen struct {
+	slackResponse
+	Url string `json:"url"`
+}
+
+// handleEnvelope dispatches the message contained in env, if any. It returns
+// an error if Slack asked us to reconnect.
+func handleEnvelope(env socketEnvelope) error {
+	switch env.Type {
+	case "events_api":
+		var p eventsPayload
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			logger.Errorf("Error while parsing event. %s", err)
+			return nil
+		}
+		if p.Event.Type == "message" {
+			dispatch(&p.Event)
+		}
+	case "disconnect":
+		return errors.New("Slack asked to reconnect")
+	}
+	return nil
+}
+
+// listenSocketMode opens a Socket Mode connection and dispatches the messages
+// received on it until the connection fails.
+func listenSocketMode(token string) error {
+	var co connectionsOpen
+	if err := slackPost(slackPrefix+"/apps.connections.open", token, nil,
+		&co); err != nil {
+		return err
+	}
+	ws, err := websocket.Dial(co.Url, "", "https://api.slack.com")
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	health.SetConnected(true)
+	defer health.SetConnected(false)
+
+	for {
+		var env socketEnvelope
+		if err := websocket.JSON.Receive(ws, &env); err != nil {
+			return err
+		}
+		// Every envelope has to be acknowledged, otherwise Slack sends
+		// it again.
+		if env.EnvelopeId != "" {
+			ack := struct {
+				EnvelopeId string `json:"envelope_id"`
+			}{env.EnvelopeId}
+			if err := websocket.JSON.Send(ws, ack); err != nil {
+				return err
+			}
+		}
+		if err := handleEnvelope(env); err != nil {
+			return err
+		}
+	}
+}
+
+// socketModeSource receives the messages over a Slack Socket Mode connection.
+type socketModeSource struct {
+	appToken string
+}
+
+func (s *socketModeSource) Listen() error {
+	return listenSocketMode(s.appToken)
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright 2016 DGraph Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHandleEnvelope(t *testing.T) {
+	saveConf(t)
+	readConfig("config_test.json")
+	c := conf.Channels["G1D59039B"]
+	c.setup("G1D59039B")
+
+	env := socketEnvelope{EnvelopeId: "1", Type: "events_api",
+		Payload: json.RawMessage(`{"event": {"type": "message",
+		"channel": "G1D59039B", "user": "U13LHF42F",
+		"text": "hello", "ts": "1465010249.000606",
+		"thread_ts": "1465010240.000606"}}`)}
+	if err := handleEnvelope(env); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-c.messages:
+		if m.Text != "hello" || m.User != "U13LHF42F" {
+			t.Errorf("Expected message hello from U13LHF42F, Got: %+v", m)
+		}
+	default:
+		t.Errorf("Expected message to be put on the counter")
+	}
+
+	if err := handleEnvelope(socketEnvelope{Type: "disconnect"}); err == nil {
+		t.Errorf("Expected an error for a disconnect envelope")
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2016 DGraph Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// User that the messages read from stdin are from.
+const (
+	stdinUserId = "U0STDIN"
+	stdinUser   = "you"
+)
+
+// stdinSource reads messages from r, one per line. A line starting with
+// #channel goes to that channel, others go to the first of the channels.
+type stdinSource struct {
+	r io.Reader
+}
+
+// Listen dispatches the lines till the input ends.
+func (s *stdinSource) Listen() error {
+	sc := bufio.NewScanner(s.r)
+	for i := 1; sc.Scan(); i++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		channel := ""
+		if strings.HasPrefix(line, "#") {
+			parts := strings.SplitN(line[1:], " ", 2)
+			channel = parts[0]
+			line = ""
+			if len(parts) == 2 {
+				line = parts[1]
+			}
+		} else {
+			var cids []string
+			for cid := range channels() {
+				cids = append(cids, cid)
+			}
+			sort.Strings(cids)
+			if len(cids) > 0 {
+				channel = cids[0]
+			}
+		}
+		// The line number keeps the timestamps unique.
+		ts := fmt.Sprintf("%d.%06d", time.Now().Unix(), i)
+		dispatch(&Message{Msg: slack.Msg{Type: "message", Channel: channel,
+			User: stdinUserId, Text: line, Timestamp: ts}})
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// stdinClient writes the messages to w along with their channel.
+type stdinClient struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (s *stdinClient) NewOutgoingMessage(text string,
+	channel string) *slack.OutgoingMessage {
+	return &slack.OutgoingMessage{Text: text, Channel: channel,
+		Type: "message"}
+}
+
+func (s *stdinClient) SendMessage(msg *slack.OutgoingMessage) {
+	s.Lock()
+	defer s.Unlock()
+	fmt.Fprintf(s.w, "[#%s] %s\n", msg.Channel, msg.Text)
+}
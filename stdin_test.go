@@ -0,0 +1,114 @@
+/*
+ * Copyright 2016 DGraph Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer that is safe to use from many goroutines.
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestStdinPlatform(t *testing.T) {
+	saveConf(t)
+	readConfig("config_test.json")
+	for cid, c := range conf.Channels {
+		c.setup(cid)
+	}
+	var out syncBuffer
+	rtm := &stdinClient{w: &out}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for _, c := range conf.Channels {
+		c.start(rtm, &wg, noUsers(), done)
+	}
+
+	src := &stdinSource{r: strings.NewReader("hello\n" +
+		"wisemonk status\n\n" +
+		"#G1D59039B wisemonk set maxmsg 30\n")}
+	if err := src.Listen(); err != io.EOF {
+		t.Errorf("Expected %v once the input ends, Got: %v", io.EOF, err)
+	}
+	expected := []string{
+		"[#C13LH03RR] Messages in the last 10m: 1, Max messages: 1000. I am not meditating. The last message was ",
+		"[#G1D59039B] Okay, I will alert after 30 messages.",
+	}
+	for i := 0; i < 100 && len(strings.Split(out.String(), "\n")) <= 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+	for _, e := range expected {
+		if !strings.Contains(out.String(), e) {
+			t.Errorf("Expected output to contain %q, Got: %q", e, out.String())
+		}
+	}
+}
+
+func TestStdinChannelByName(t *testing.T) {
+	saveConf(t)
+	conf = Config{Platform: platformStdin, Channels: map[string]*Counter{
+		"#general": {Interval: "10m", MaxMsg: 20, CreateTopicIn: "slack"}}}
+	if err := resolveChannelNames(&conf); err != nil {
+		t.Fatal(err)
+	}
+	for cid, c := range conf.Channels {
+		c.setup(cid)
+	}
+	var out syncBuffer
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for _, c := range conf.Channels {
+		c.start(&stdinClient{w: &out}, &wg, noUsers(), done)
+	}
+
+	src := &stdinSource{r: strings.NewReader("#general wisemonk set maxmsg 30\n")}
+	if err := src.Listen(); err != io.EOF {
+		t.Errorf("Expected %v once the input ends, Got: %v", io.EOF, err)
+	}
+	expected := "[#general] Okay, I will alert after 30 messages."
+	for i := 0; i < 100 && !strings.Contains(out.String(), expected); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("Expected output to contain %q, Got: %q", expected,
+			out.String())
+	}
+}